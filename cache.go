@@ -0,0 +1,373 @@
+package erofs
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+// Default number of entries held by the dentry and inode caches
+const (
+	DefaultDentryCacheSize = 4096
+	DefaultInodeCacheSize  = 1024
+)
+
+// CacheStats holds hit and miss counts for the caches of an image
+type CacheStats struct {
+	MetadataHits   uint64
+	MetadataMisses uint64
+	DataHits       uint64
+	DataMisses     uint64
+	DentryHits     uint64
+	DentryMisses   uint64
+	InodeHits      uint64
+	InodeMisses    uint64
+}
+
+// WithDentryCache sets the number of directory entries cached for path
+// lookups, mapping a parent directory and name to the node id and type of
+// the entry. Since images are immutable, cached entries never need to be
+// invalidated. A size of zero disables the cache, which otherwise defaults
+// to DefaultDentryCacheSize entries.
+func WithDentryCache(n int) Option {
+	return func(img *Image) error {
+		if n < 0 {
+			return fmt.Errorf("invalid dentry cache size %d: %w", n, ErrInvalid)
+		}
+		img.dentries = nil
+		if n > 0 {
+			img.dentries = newLRU[dentryKey, dentry](n)
+		}
+		return nil
+	}
+}
+
+// WithInodeCache sets the number of decoded inodes cached by node id,
+// including their xattrs. A size of zero disables the cache, which otherwise
+// defaults to DefaultInodeCacheSize entries.
+func WithInodeCache(n int) Option {
+	return func(img *Image) error {
+		if n < 0 {
+			return fmt.Errorf("invalid inode cache size %d: %w", n, ErrInvalid)
+		}
+		img.inodes = nil
+		if n > 0 {
+			img.inodes = newLRU[uint64, *fileInfo](n)
+		}
+		return nil
+	}
+}
+
+// WithBlockCache enables an LRU cache of image blocks shared by all files
+// opened from the image. Metadata blocks (inodes, directory entries and
+// xattrs) and file data blocks are kept in separate tiers so reading large
+// files does not evict metadata, each tier is limited to the given number of
+// bytes. A size of zero disables caching for that tier.
+//
+// Hit and miss counts are returned by the CacheStats method of the image.
+func WithBlockCache(metadata, data int64) Option {
+	return func(img *Image) error {
+		if metadata < 0 || data < 0 {
+			return fmt.Errorf("invalid block cache size: %w", ErrInvalid)
+		}
+		bits := img.sb.BlkSizeBits
+		if n := int(metadata >> bits); n > 0 {
+			img.metaCache = newLRU[int64, []byte](n)
+		}
+		if n := int(data >> bits); n > 0 {
+			img.dataCache = newLRU[int64, []byte](n)
+		}
+		return nil
+	}
+}
+
+// CacheStats returns the hit and miss counts for the image caches
+func (img *Image) CacheStats() CacheStats {
+	var st CacheStats
+	if img.metaCache != nil {
+		st.MetadataHits, st.MetadataMisses = img.metaCache.stats()
+	}
+	if img.dataCache != nil {
+		st.DataHits, st.DataMisses = img.dataCache.stats()
+	}
+	if img.dentries != nil {
+		st.DentryHits, st.DentryMisses = img.dentries.stats()
+	}
+	if img.inodes != nil {
+		st.InodeHits, st.InodeMisses = img.inodes.stats()
+	}
+	return st
+}
+
+type dentryKey struct {
+	parent uint64
+	name   string
+}
+
+type dentry struct {
+	nid   uint64
+	ftype fs.FileMode
+}
+
+func (img *Image) lookupDentry(parent uint64, name string) (dentry, bool) {
+	if img.dentries == nil {
+		return dentry{}, false
+	}
+	return img.dentries.get(dentryKey{parent: parent, name: name})
+}
+
+func (img *Image) cacheDentry(parent uint64, name string, nid uint64, ftype fs.FileMode) {
+	if img.dentries != nil {
+		img.dentries.add(dentryKey{parent: parent, name: name}, dentry{nid: nid, ftype: ftype})
+	}
+}
+
+// cachedInfo returns a copy of the cached info for the inode with the given
+// name, or nil when not cached. When stat is true, only info which includes
+// the stat is returned.
+func (img *Image) cachedInfo(nid uint64, name string, stat bool) *fileInfo {
+	if img.inodes == nil {
+		return nil
+	}
+	cached, ok := img.inodes.get(nid)
+	if !ok || (stat && cached.stat == nil) {
+		return nil
+	}
+	fi := *cached
+	fi.name = name
+	if cached.stat != nil {
+		st := *cached.stat
+		st.Xattrs = maps.Clone(st.Xattrs)
+		fi.stat = &st
+	}
+	return &fi
+}
+
+// cacheInfo adds decoded info to the inode cache, info with a stat
+// is never replaced by info without
+func (img *Image) cacheInfo(fi *fileInfo) {
+	if img.inodes == nil {
+		return
+	}
+	if fi.stat == nil {
+		if cached, ok := img.inodes.peek(fi.inode); ok && cached.stat != nil {
+			return
+		}
+	}
+	c := *fi
+	c.name = ""
+	c.cached = img.cachedTable(fi)
+	if fi.stat != nil {
+		st := *fi.stat
+		st.Xattrs = maps.Clone(st.Xattrs)
+		c.stat = &st
+	}
+	img.inodes.add(fi.inode, &c)
+}
+
+// cachedTable returns a copy of the inode and the chunk table which follows
+// it from the inode block, so files opened from the inode cache do not read
+// the table again. It returns nil for other layouts.
+func (img *Image) cachedTable(fi *fileInfo) *block {
+	if fi.cached == nil || fi.inodeLayout != disk.LayoutChunkBased || fi.size == 0 {
+		return nil
+	}
+	unit := int64(disk.SizeChunkAddr)
+	if uint16(fi.inodeData)&disk.LayoutChunkFormatIndexes != 0 {
+		unit = disk.SizeChunkIndex
+	}
+	chunkbits := img.sb.BlkSizeBits + uint8(uint16(fi.inodeData)&disk.LayoutChunkFormatBits)
+	chunkn := (fi.size-1)>>chunkbits + 1
+	// Include the padding aligning the table to the entry size
+	buf := fi.cached.bytes()
+	buf = buf[:min(int64(len(buf)), fi.dataOffset()+unit-1+chunkn*unit)]
+	return &block{buf: slices.Clone(buf), end: int32(len(buf))}
+}
+
+// readMeta reads metadata from the image through the metadata cache
+func (img *Image) readMeta(p []byte, off int64) (int, error) {
+	return img.readCached(img.metaCache, p, off)
+}
+
+// readData reads file data from the image through the data cache
+func (img *Image) readData(p []byte, off int64) (int, error) {
+	return img.readCached(img.dataCache, p, off)
+}
+
+// readCached reads from the image with the same semantics as io.ReaderAt,
+// serving whole blocks from the cache. Runs of missing blocks are read with
+// a single read and added to the cache.
+func (img *Image) readCached(c *lru[int64, []byte], p []byte, off int64) (int, error) {
+	if c == nil {
+		return img.meta.ReadAt(p, off)
+	}
+	bits := img.sb.BlkSizeBits
+
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		bn := pos >> bits
+		b, ok := c.get(bn)
+		if !ok {
+			var err error
+			if b, err = img.loadCached(c, bn, (pos+int64(len(p)-n)-1)>>bits); err != nil {
+				return n, err
+			}
+		}
+		start := int(pos - bn<<bits)
+		if start >= len(b) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], b[start:])
+	}
+	return n, nil
+}
+
+// fillCached adds the blocks holding n bytes at off to the cache without
+// copying them out, blocks which are already cached are not read again
+func (img *Image) fillCached(c *lru[int64, []byte], off, n int64) error {
+	bits := img.sb.BlkSizeBits
+	last := (off + n - 1) >> bits
+	for bn := off >> bits; bn <= last; bn++ {
+		if c.contains(bn) {
+			continue
+		}
+		b, err := img.loadCached(c, bn, last)
+		if err != nil {
+			return err
+		}
+		if len(b) == 0 {
+			return io.EOF
+		}
+	}
+	return nil
+}
+
+// loadCached reads block bn along with the following blocks up to last which
+// are not cached, limited to what the cache can hold, and adds them to the
+// cache with a single read. The data of block bn is returned.
+func (img *Image) loadCached(c *lru[int64, []byte], bn, last int64) ([]byte, error) {
+	bits := img.sb.BlkSizeBits
+	blkSize := int64(1) << bits
+
+	last = min(last, bn+int64(c.max)-1)
+	end := bn + 1
+	for ; end <= last; end++ {
+		if c.contains(end) {
+			break
+		}
+	}
+	buf := make([]byte, (end-bn)<<bits)
+	rn, err := img.meta.ReadAt(buf, bn<<bits)
+	if rn < len(buf) && err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	buf = buf[:rn]
+	var b []byte
+	for i := bn; i < end && len(buf) > 0; i++ {
+		l := min(blkSize, int64(len(buf)))
+		blk := buf[:l:l]
+		if i == bn {
+			b = blk
+		}
+		c.add(i, blk)
+		buf = buf[l:]
+	}
+	return b, nil
+}
+
+// lru is a fixed size least recently used cache safe for concurrent use
+type lru[K comparable, V any] struct {
+	mu    sync.Mutex
+	max   int
+	ll    *list.List
+	items map[K]*list.Element
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func newLRU[K comparable, V any](max int) *lru[K, V] {
+	return &lru[K, V]{
+		max:   max,
+		ll:    list.New(),
+		items: map[K]*list.Element{},
+	}
+}
+
+func (c *lru[K, V]) get(key K) (v V, ok bool) {
+	c.mu.Lock()
+	e, ok := c.items[key]
+	if ok {
+		c.ll.MoveToFront(e)
+		v = e.Value.(*lruEntry[K, V]).value
+	}
+	c.mu.Unlock()
+
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return v, ok
+}
+
+// peek returns the value for key without updating recency or stats
+func (c *lru[K, V]) peek(key K) (v V, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if ok {
+		v = e.Value.(*lruEntry[K, V]).value
+	}
+	return v, ok
+}
+
+func (c *lru[K, V]) contains(key K) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.items[key]
+	return ok
+}
+
+func (c *lru[K, V]) add(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*lruEntry[K, V]).value = value
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry[K, V]{key: key, value: value})
+	for c.ll.Len() > c.max {
+		last := c.ll.Back()
+		c.ll.Remove(last)
+		delete(c.items, last.Value.(*lruEntry[K, V]).key)
+	}
+}
+
+// purge removes all entries from the cache
+func (c *lru[K, V]) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	clear(c.items)
+}
+
+func (c *lru[K, V]) stats() (hits, misses uint64) {
+	return c.hits.Load(), c.misses.Load()
+}
@@ -0,0 +1,196 @@
+package erofs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+)
+
+func TestBlockCache(t *testing.T) {
+	r := &countingReaderAt{ReaderAt: loadTestFile(t, "basic-default")}
+	efs, err := Open(r, WithBlockCache(1<<20, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer efs.Close()
+
+	walk := func() {
+		err := fs.WalkDir(efs, "/", func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			_, err = d.Info()
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	walk()
+	first := efs.CacheStats()
+	if first.MetadataMisses == 0 {
+		t.Fatal("expected metadata misses on first walk")
+	}
+	reads := r.reads.Load()
+
+	walk()
+	second := efs.CacheStats()
+	if second.MetadataMisses != first.MetadataMisses {
+		t.Errorf("unexpected metadata misses on second walk: %d", second.MetadataMisses-first.MetadataMisses)
+	}
+	if second.MetadataHits <= first.MetadataHits {
+		t.Error("expected metadata hits on second walk")
+	}
+	if n := r.reads.Load(); n != reads {
+		t.Errorf("expected no reads on second walk, got %d", n-reads)
+	}
+
+	content := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 128*16)
+	for i := 0; i < 2; i++ {
+		checkFileBytes(t, efs, "/usr/lib/testdir/16k-sequence.raw", content)
+	}
+	st := efs.CacheStats()
+	if st.DataMisses == 0 || st.DataHits == 0 {
+		t.Errorf("expected data misses and hits, got %+v", st)
+	}
+}
+
+func TestBlockCacheEviction(t *testing.T) {
+	efs, err := EroFS(loadTestFile(t, "basic-default"), WithBlockCache(0, 8192))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := efs.(*Image)
+	if img.metaCache != nil {
+		t.Fatal("expected metadata cache to be disabled")
+	}
+
+	f, err := efs.Open("/usr/lib/testdir/16k-sequence.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 128*16)) {
+		t.Fatal("unexpected content")
+	}
+	if n := img.dataCache.ll.Len(); n != 2 {
+		t.Errorf("expected cache to be limited to 2 blocks, got %d", n)
+	}
+}
+
+func TestDentryInodeCache(t *testing.T) {
+	r := &countingReaderAt{ReaderAt: loadTestFile(t, "basic-default")}
+	efs, err := EroFS(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := efs.(*Image)
+
+	const name = "/usr/lib/withxattr/f1"
+	checkXattrs(t, efs, name, map[string]string{
+		"user.xdg.comment": "comment for f1",
+		"user.common":      "same-value",
+	})
+	first := img.CacheStats()
+	if first.DentryMisses != 4 {
+		t.Errorf("expected 4 dentry misses, got %d", first.DentryMisses)
+	}
+	reads := r.reads.Load()
+
+	checkXattrs(t, efs, name, map[string]string{
+		"user.xdg.comment": "comment for f1",
+		"user.common":      "same-value",
+	})
+	second := img.CacheStats()
+	if hits := second.DentryHits - first.DentryHits; hits != 4 {
+		t.Errorf("expected 4 dentry hits, got %d", hits)
+	}
+	if second.InodeHits == first.InodeHits {
+		t.Error("expected inode cache hit")
+	}
+	if n := r.reads.Load(); n != reads {
+		t.Errorf("expected no reads for cached stat, got %d", n-reads)
+	}
+
+	// Cached xattrs must not be shared with callers
+	fi, err := fs.Stat(efs, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi.Sys().(*Stat).Xattrs["user.common"] = "modified"
+	checkXattrs(t, efs, name, map[string]string{
+		"user.xdg.comment": "comment for f1",
+		"user.common":      "same-value",
+	})
+
+	disabled, err := EroFS(loadTestFile(t, "basic-default"), WithDentryCache(0), WithInodeCache(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFileString(t, disabled, "/in-root.txt", "root file content\n")
+	if st := disabled.(*Image).CacheStats(); st != (CacheStats{}) {
+		t.Errorf("expected no cache stats with caches disabled, got %+v", st)
+	}
+}
+
+func TestInodeCacheChunkTable(t *testing.T) {
+	r := &countingReaderAt{ReaderAt: loadTestFile(t, "basic-chunk-4096")}
+	efs, err := EroFS(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const name = "/usr/lib/testdir/16k-sequence.raw"
+	content := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 128*16)
+	checkFileBytes(t, efs, name, content)
+
+	// The chunk table is kept with the cached inode so a reopened file
+	// is mapped without reading it again
+	f, err := efs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r.reads.Store(0)
+	fi, err := f.(*File).readInfo(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := efs.(*Image).mapExtent(fi, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.reads.Load(); n != 0 {
+		t.Errorf("expected no reads mapping reopened file, got %d", n)
+	}
+	checkFileBytes(t, efs, name, content)
+}
+
+func TestClose(t *testing.T) {
+	img, err := Open(loadTestFile(t, "basic-default"), WithBlockCache(1<<20, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFileString(t, img, "/in-root.txt", "root file content\n")
+	if img.metaCache.ll.Len() == 0 || img.dentries.ll.Len() == 0 {
+		t.Fatal("expected cached blocks and dentries")
+	}
+
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if img.metaCache.ll.Len() != 0 || img.dataCache.ll.Len() != 0 || img.dentries.ll.Len() != 0 || img.inodes.ll.Len() != 0 {
+		t.Error("expected caches to be empty after close")
+	}
+	if _, err := img.Open("/in-root.txt"); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("expected closed error opening after close, got %v", err)
+	}
+	if err := img.Close(); err != nil {
+		t.Errorf("unexpected error closing twice: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/erofs/go-erofs"
+)
+
+// convertTar implements "convert-tar [-i in.tar] -o out.erofs [-b blocksize] [-index] [-whiteouts trusted|user] [-objects dir]"
+func convertTar(args []string) error {
+	var (
+		in        string
+		out       string
+		blkSize   int
+		index     bool
+		whiteouts string
+		objects   string
+	)
+	fs := flag.NewFlagSet("convert-tar", flag.ExitOnError)
+	fs.StringVar(&in, "i", "-", "Path to the tar file, optionally gzip compressed, or - for stdin")
+	fs.StringVar(&out, "o", "", "Path to write the erofs image to")
+	fs.IntVar(&blkSize, "b", 0, "Block size of the image, 4096 or 512 with -index by default")
+	fs.BoolVar(&index, "index", false, "Reference the data in the tar, which is used as extra device of the image")
+	fs.StringVar(&whiteouts, "whiteouts", "keep", "Convert OCI whiteouts for overlayfs with trusted or user xattrs, or keep them")
+	fs.StringVar(&objects, "objects", "", "Write a composefs image, storing file content in this object directory")
+	fs.Parse(args)
+
+	if out == "" {
+		return errors.New("missing output path, use -o")
+	}
+	var format erofs.WhiteoutFormat
+	switch whiteouts {
+	case "keep":
+		format = erofs.WhiteoutKeep
+	case "trusted":
+		format = erofs.WhiteoutOverlay
+	case "user":
+		format = erofs.WhiteoutOverlayUser
+	default:
+		return fmt.Errorf("unknown whiteout format %q, use keep, trusted or user", whiteouts)
+	}
+	var r io.Reader = os.Stdin
+	if in != "-" {
+		f, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	opts := erofs.ConvertOptions{
+		WriterOptions: erofs.WriterOptions{BlockSize: blkSize, ObjectDir: objects},
+		TarIndex:      index,
+		Whiteouts:     format,
+	}
+	if err := erofs.FromTar(r, f, opts); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
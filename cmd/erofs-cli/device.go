@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/erofs/go-erofs"
+)
+
+// deviceFlag collects the paths of extra devices from repeated -device flags
+type deviceFlag []string
+
+func (d *deviceFlag) String() string {
+	return strings.Join(*d, ",")
+}
+
+func (d *deviceFlag) Set(v string) error {
+	*d = append(*d, v)
+	return nil
+}
+
+// openImage opens the image at path with the extra devices, the returned
+// function closes the image and the devices
+func openImage(path string, devices []string) (*erofs.Image, func() error, error) {
+	var files []*os.File
+	closeFiles := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	var devs []io.ReaderAt
+	for _, p := range devices {
+		f, err := os.Open(p)
+		if err != nil {
+			closeFiles()
+			return nil, nil, err
+		}
+		files = append(files, f)
+		devs = append(devs, f)
+	}
+	img, err := erofs.OpenFile(path, erofs.WithExtraDevices(devs...))
+	if err != nil {
+		closeFiles()
+		return nil, nil, err
+	}
+	return img, func() error {
+		defer closeFiles()
+		return img.Close()
+	}, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/erofs/go-erofs"
+)
+
+// dumpTree implements "dump-tree -img x.erofs [-device dev...] [-o out.dump]"
+func dumpTree(args []string) error {
+	var (
+		path    string
+		devices deviceFlag
+		out     string
+	)
+	fs := flag.NewFlagSet("dump-tree", flag.ExitOnError)
+	fs.StringVar(&path, "img", "", "Path to erofs image")
+	fs.Var(&devices, "device", "Path to an extra device of the image, repeated in device table order")
+	fs.StringVar(&out, "o", "-", "Path to write the composefs dumpfile to, - for stdout")
+	fs.Parse(args)
+
+	if path == "" {
+		return errors.New("missing image path, use -img")
+	}
+	img, closeImg, err := openImage(path, devices)
+	if err != nil {
+		return err
+	}
+	defer closeImg()
+
+	if out == "-" {
+		return erofs.WriteDumpfile(img, os.Stdout)
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err := erofs.WriteDumpfile(img, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"time"
+
+	"github.com/erofs/go-erofs"
+)
+
+// exportTar implements "export-tar -img x.erofs [-device dev...] [-o out.tar] [-clamp-mtime secs]"
+func exportTar(args []string) error {
+	var (
+		path    string
+		devices deviceFlag
+		out     string
+		clamp   int64
+	)
+	fs := flag.NewFlagSet("export-tar", flag.ExitOnError)
+	fs.StringVar(&path, "img", "", "Path to erofs image")
+	fs.Var(&devices, "device", "Path to an extra device of the image, repeated in device table order")
+	fs.StringVar(&out, "o", "-", "Path to write the tar to, - for stdout")
+	fs.Int64Var(&clamp, "clamp-mtime", -1, "Clamp modification times to the given unix time")
+	fs.Parse(args)
+
+	if path == "" {
+		return errors.New("missing image path, use -img")
+	}
+	img, closeImg, err := openImage(path, devices)
+	if err != nil {
+		return err
+	}
+	defer closeImg()
+
+	var opts erofs.TarOptions
+	if clamp >= 0 {
+		opts.ClampMtime = time.Unix(clamp, 0)
+	}
+
+	if out == "-" {
+		return erofs.WriteTar(img, os.Stdout, opts)
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err := erofs.WriteTar(img, f, opts); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
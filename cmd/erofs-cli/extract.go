@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"flag"
+
+	"github.com/erofs/go-erofs"
+)
+
+// extract implements "extract -img x.erofs [-device dev...] -C dest [-rootless] [paths...]"
+func extract(args []string) error {
+	var (
+		path     string
+		devices  deviceFlag
+		dest     string
+		rootless bool
+	)
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	fs.StringVar(&path, "img", "", "Path to erofs image")
+	fs.Var(&devices, "device", "Path to an extra device of the image, repeated in device table order")
+	fs.StringVar(&dest, "C", ".", "Directory to extract to")
+	fs.BoolVar(&rootless, "rootless", false, "Record ownership and devices in the "+erofs.OverrideStatXattr+" xattr")
+	fs.Parse(args)
+
+	if path == "" {
+		return errors.New("missing image path, use -img")
+	}
+	img, closeImg, err := openImage(path, devices)
+	if err != nil {
+		return err
+	}
+	defer closeImg()
+
+	return erofs.Extract(img, dest, erofs.ExtractOptions{
+		Paths:    fs.Args(),
+		Rootless: rootless,
+	})
+}
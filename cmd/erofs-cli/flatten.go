@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/erofs/go-erofs"
+)
+
+// flatten implements "flatten -oci layout [-ref tag] [-platform os/arch] -o out.erofs [-b blocksize] [-objects dir]"
+func flatten(args []string) error {
+	var (
+		layout   string
+		ref      string
+		platform string
+		out      string
+		blkSize  int
+		objects  string
+	)
+	fs := flag.NewFlagSet("flatten", flag.ExitOnError)
+	fs.StringVar(&layout, "oci", "", "Path to the OCI image layout directory")
+	fs.StringVar(&ref, "ref", "", "Reference name or digest of the image, optional when the layout holds one image")
+	fs.StringVar(&platform, "platform", runtime.GOOS+"/"+runtime.GOARCH, "Platform selected from multi-platform images")
+	fs.StringVar(&out, "o", "", "Path to write the erofs image to")
+	fs.IntVar(&blkSize, "b", 4096, "Block size of the image")
+	fs.StringVar(&objects, "objects", "", "Write a composefs image, storing file content in this object directory")
+	fs.Parse(args)
+
+	if layout == "" || out == "" {
+		return errors.New("missing layout or output path, use -oci and -o")
+	}
+	manifest, err := resolveManifest(layout, ref, platform)
+	if err != nil {
+		return err
+	}
+
+	var layers []io.Reader
+	for _, l := range manifest.Layers {
+		if strings.HasSuffix(l.MediaType, "+zstd") || !strings.Contains(l.MediaType, "tar") {
+			return fmt.Errorf("layer %s has unsupported media type %s", l.Digest, l.MediaType)
+		}
+		r, err := openBlob(layout, l)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		layers = append(layers, r)
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	opts := erofs.ConvertOptions{WriterOptions: erofs.WriterOptions{BlockSize: blkSize, ObjectDir: objects}}
+	if err := erofs.FromLayers(layers, f, opts); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Media types of OCI and Docker indexes
+const (
+	mediaTypeIndex        = "application/vnd.oci.image.index.v1+json"
+	mediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// descriptor references a blob in an OCI image layout
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+		Variant      string `json:"variant,omitempty"`
+	} `json:"platform,omitempty"`
+}
+
+// index is an OCI image index, as stored in index.json of a layout
+type index struct {
+	Manifests []descriptor `json:"manifests"`
+}
+
+// manifest is an OCI image manifest
+type manifest struct {
+	Layers []descriptor `json:"layers"`
+}
+
+// resolveManifest returns the manifest for ref in the layout, selecting the
+// platform from multi-platform images
+func resolveManifest(layout, ref, platform string) (*manifest, error) {
+	b, err := os.ReadFile(filepath.Join(layout, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	var idx index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, fmt.Errorf("invalid index.json: %w", err)
+	}
+	var matches []descriptor
+	for _, d := range idx.Manifests {
+		if ref == "" || d.Digest == ref || d.Annotations["org.opencontainers.image.ref.name"] == ref {
+			matches = append(matches, d)
+		}
+	}
+	if len(matches) != 1 {
+		return nil, fmt.Errorf("found %d images for reference %q in %s", len(matches), ref, layout)
+	}
+
+	d := matches[0]
+	for d.MediaType == mediaTypeIndex || d.MediaType == mediaTypeManifestList {
+		if err := readBlobJSON(layout, d, &idx); err != nil {
+			return nil, err
+		}
+		var found bool
+		for _, m := range idx.Manifests {
+			if m.Platform != nil && matchPlatform(platform, m.Platform.OS, m.Platform.Architecture, m.Platform.Variant) {
+				d, found = m, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no image for platform %s in %s", platform, d.Digest)
+		}
+	}
+	var m manifest
+	if err := readBlobJSON(layout, d, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// matchPlatform reports whether the platform, formatted as os/arch with an
+// optional /variant, matches
+func matchPlatform(platform, goos, arch, variant string) bool {
+	parts := strings.SplitN(platform, "/", 3)
+	if len(parts) < 2 || parts[0] != goos || parts[1] != arch {
+		return false
+	}
+	return len(parts) < 3 || parts[2] == variant
+}
+
+// readBlobJSON decodes the JSON blob for the descriptor into v
+func readBlobJSON(layout string, d descriptor, v any) error {
+	r, err := openBlob(layout, d)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("invalid blob %s: %w", d.Digest, err)
+	}
+	return nil
+}
+
+// openBlob opens the blob for the descriptor, the content is verified
+// against the digest when the end of the blob is read
+func openBlob(layout string, d descriptor) (io.ReadCloser, error) {
+	alg, encoded, ok := strings.Cut(d.Digest, ":")
+	var h hash.Hash
+	switch alg {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	}
+	if !ok || h == nil || len(encoded) != hex.EncodedLen(h.Size()) || strings.ContainsAny(encoded, "/\\.") {
+		return nil, fmt.Errorf("unsupported digest %q", d.Digest)
+	}
+	f, err := os.Open(filepath.Join(layout, "blobs", alg, encoded))
+	if err != nil {
+		return nil, err
+	}
+	return &verifier{f: f, h: h, digest: d.Digest, encoded: encoded}, nil
+}
+
+// verifier checks the digest of a blob when reaching the end of the file
+type verifier struct {
+	f       *os.File
+	h       hash.Hash
+	digest  string
+	encoded string
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	n, err := v.f.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.h.Sum(nil)) != v.encoded {
+		return n, fmt.Errorf("blob %s does not match digest", v.digest)
+	}
+	return n, err
+}
+
+func (v *verifier) Close() error {
+	return v.f.Close()
+}
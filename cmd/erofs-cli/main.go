@@ -10,7 +10,26 @@ import (
 	"github.com/erofs/go-erofs"
 )
 
+// commands are the subcommands, without a subcommand the image is walked
+var commands = map[string]func(args []string) error{
+	"convert-tar": convertTar,
+	"dump-tree":   dumpTree,
+	"export-tar":  exportTar,
+	"extract":     extract,
+	"flatten":     flatten,
+	"mkfs":        mkfs,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	var (
 		path string
 	)
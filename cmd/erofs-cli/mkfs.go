@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/erofs/go-erofs"
+)
+
+// mkfs implements "mkfs -src dir -o out.erofs [-b blocksize] [-objects dir]"
+func mkfs(args []string) error {
+	var (
+		src     string
+		out     string
+		blkSize int
+		objects string
+	)
+	fs := flag.NewFlagSet("mkfs", flag.ExitOnError)
+	fs.StringVar(&src, "src", "", "Directory to create the image from")
+	fs.StringVar(&out, "o", "", "Path to write the erofs image to")
+	fs.IntVar(&blkSize, "b", 4096, "Block size of the image")
+	fs.StringVar(&objects, "objects", "", "Write a composefs image, storing file content in this object directory")
+	fs.Parse(args)
+
+	if src == "" || out == "" {
+		return errors.New("missing source directory or output path, use -src and -o")
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	w, err := erofs.NewWriter(f, erofs.WriterOptions{BlockSize: blkSize, ObjectDir: objects})
+	if err == nil {
+		err = w.AddSource(erofs.DirSource(src))
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
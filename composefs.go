@@ -0,0 +1,301 @@
+package erofs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+// Overlay xattrs of composefs files referencing their content in the
+// object store, without the trusted.overlay. or user.overlay. prefix
+const (
+	metacopyXattr = "metacopy"
+	redirectXattr = "redirect"
+)
+
+// overlayXattrPrefix is the prefix of the overlay xattrs written to
+// composefs images
+const overlayXattrPrefix = "trusted.overlay."
+
+// metacopyDigestSHA256 is the digest algorithm of an fs-verity SHA-256
+// digest in the overlay metacopy xattr
+const metacopyDigestSHA256 = 1
+
+// WithObjectStore reads the content of composefs files from objects. Regular
+// files with the trusted.overlay.metacopy xattr, or its user.overlay
+// equivalent, are read from the object at the path given by the
+// trusted.overlay.redirect xattr, relative to the root of objects, instead
+// of the image. Objects are opened when a file is first read.
+//
+// As with overlayfs, the trusted.overlay. xattrs of the image are not part
+// of the Stat of files, which holds the trusted.overlay.overlay. xattrs
+// escaped by the writer under their original names.
+func WithObjectStore(objects fs.FS) Option {
+	return func(img *Image) error {
+		img.objects = objects
+		return nil
+	}
+}
+
+// WithVerifyObjects verifies the content of objects read with
+// WithObjectStore against the fs-verity digest stored in the metacopy
+// xattr when the object is opened. Files without a digest cannot be read.
+func WithVerifyObjects() Option {
+	return func(img *Image) error {
+		img.verifyObjects = true
+		return nil
+	}
+}
+
+// object is the content of a composefs file in the object store
+type object struct {
+	f fs.File
+	r io.ReaderAt
+}
+
+// openObject returns the object holding the content of the file, nil when
+// the content is stored in the image
+func (b *File) openObject() (*object, error) {
+	if b.img.objects == nil || !b.ftype.IsRegular() {
+		return nil, nil
+	}
+	if b.object != nil || b.objectChecked {
+		return b.object, nil
+	}
+	fi, err := b.readInfo(true)
+	if err != nil {
+		return nil, err
+	}
+	metacopy, ok := fi.objectXattr(metacopyXattr)
+	if !ok {
+		b.objectChecked = true
+		return nil, nil
+	}
+	redirect, _ := fi.objectXattr(redirectXattr)
+	name := strings.TrimPrefix(redirect, "/")
+	if !fs.ValidPath(name) || name == "." {
+		return nil, fmt.Errorf("invalid object path %q for %s: %w", redirect, b.name, ErrInvalid)
+	}
+
+	f, err := b.img.objects.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open object for %s: %w", b.name, err)
+	}
+	obj, err := newObject(f, fi.size)
+	if err == nil && b.img.verifyObjects {
+		err = verifyObject(obj, fi.size, metacopy)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("object %s for %s: %w", name, b.name, err)
+	}
+	b.object, b.objectChecked = obj, true
+	return obj, nil
+}
+
+// objectXattr returns the value of the overlay xattr of the image
+// referencing the object of the file, trusted overlay xattrs of the file
+// itself are escaped
+func (fi *fileInfo) objectXattr(name string) (string, bool) {
+	if v, ok := fi.overlay[name]; ok {
+		return v, true
+	}
+	v, ok := fi.stat.Xattrs["user.overlay."+name]
+	return v, ok
+}
+
+// escapeOverlayXattrs returns xattrs with the trusted overlay xattrs of a
+// file escaped as trusted.overlay.overlay. xattrs, as done by mkcomposefs,
+// so overlayfs presents them unchanged instead of using them. Other xattrs
+// are kept.
+func escapeOverlayXattrs(xattrs map[string]string) map[string]string {
+	var escaped map[string]string
+	for k, v := range xattrs {
+		if !strings.HasPrefix(k, overlayXattrPrefix) {
+			continue
+		}
+		if escaped == nil {
+			escaped = maps.Clone(xattrs)
+		}
+		delete(escaped, k)
+		escaped[overlayXattrPrefix+"overlay."+strings.TrimPrefix(k, overlayXattrPrefix)] = v
+	}
+	if escaped == nil {
+		return xattrs
+	}
+	return escaped
+}
+
+// unescapeOverlayXattrs moves the trusted overlay xattrs of the image out
+// of the stat of fi and restores the escaped xattrs of the file, as
+// presented by overlayfs
+func unescapeOverlayXattrs(fi *fileInfo) {
+	xattrs := make(map[string]string, len(fi.stat.Xattrs))
+	for k, v := range fi.stat.Xattrs {
+		name, ok := strings.CutPrefix(k, overlayXattrPrefix)
+		switch {
+		case !ok:
+			xattrs[k] = v
+		case strings.HasPrefix(name, "overlay."):
+			xattrs[overlayXattrPrefix+strings.TrimPrefix(name, "overlay.")] = v
+		default:
+			if fi.overlay == nil {
+				fi.overlay = map[string]string{}
+			}
+			fi.overlay[name] = v
+		}
+	}
+	fi.stat.Xattrs = xattrs
+}
+
+// newObject checks the size of the object file f and returns the object
+func newObject(f fs.File, size int64) (*object, error) {
+	ofi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if ofi.Size() != size {
+		return nil, fmt.Errorf("size %d does not match file size %d: %w", ofi.Size(), size, ErrInvalid)
+	}
+	obj := &object{f: f}
+	switch r := f.(type) {
+	case io.ReaderAt:
+		obj.r = r
+	case io.ReadSeeker:
+		obj.r = io.NewSectionReader(readerAtFunc(func(p []byte, off int64) (int, error) {
+			if _, err := r.Seek(off, io.SeekStart); err != nil {
+				return 0, err
+			}
+			return io.ReadFull(r, p)
+		}), 0, size)
+	default:
+		return nil, fmt.Errorf("object cannot be read at offsets: %w", ErrNotImplemented)
+	}
+	return obj, nil
+}
+
+// verifyObject compares the fs-verity digest of the object with the digest
+// from the metacopy xattr, which holds a version, its length, flags, the
+// digest algorithm and the digest
+func verifyObject(obj *object, size int64, metacopy string) error {
+	if len(metacopy) < 4 || metacopy[0] != 0 || int(metacopy[1]) != len(metacopy) {
+		return fmt.Errorf("no fs-verity digest: %w", ErrInvalid)
+	}
+	if metacopy[3] != metacopyDigestSHA256 || len(metacopy) != 4+32 {
+		return fmt.Errorf("unsupported digest algorithm %d: %w", metacopy[3], ErrNotImplemented)
+	}
+	digest, err := verityDigest(io.NewSectionReader(obj.r, 0, size))
+	if err != nil {
+		return err
+	}
+	if expected := []byte(metacopy[4:]); !bytes.Equal(digest[:], expected) {
+		return fmt.Errorf("fs-verity digest %s does not match %s: %w", hex.EncodeToString(digest[:]), hex.EncodeToString(expected), ErrInvalid)
+	}
+	return nil
+}
+
+// readObject reads from the object at the file offset
+func (b *File) readObject(obj *object, fi *fileInfo, p []byte) (int, error) {
+	if b.offset >= fi.size {
+		return 0, io.EOF
+	}
+	p = p[:min(int64(len(p)), fi.size-b.offset)]
+	n, err := obj.r.ReadAt(p, b.offset)
+	b.offset += int64(n)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+// writeObject writes the object from the file offset to w
+func (b *File) writeObject(w io.Writer, obj *object, fi *fileInfo) (int64, error) {
+	l := fi.size - b.offset
+	if l <= 0 {
+		return 0, nil
+	}
+	n, handled, err := copyRange(w, obj.r, b.offset, l)
+	if !handled {
+		n, err = io.CopyN(w, io.NewSectionReader(obj.r, b.offset, l), l)
+	}
+	b.offset += n
+	return n, err
+}
+
+// writeObject copies the content of n to the object directory, named by its
+// fs-verity digest, and references the object with the overlay xattrs. The
+// content of n is not stored in the image, it is a chunk based file
+// consisting of a single hole.
+func (w *Writer) writeObject(n *node) error {
+	r, err := n.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tmp, err := os.CreateTemp(w.objectDir, ".tmp-object-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	digest, err := verityDigest(io.TeeReader(r, tmp))
+	if err != nil {
+		return fmt.Errorf("failed to write object: %w", err)
+	}
+	if size, err := tmp.Seek(0, io.SeekCurrent); err != nil {
+		return err
+	} else if size != n.size {
+		return fmt.Errorf("object is %d bytes, expected %d: %w", size, n.size, ErrInvalid)
+	}
+	h := hex.EncodeToString(digest[:])
+	name := filepath.Join(w.objectDir, h[:2], h[2:])
+	if _, err := os.Stat(name); errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			return err
+		}
+		if err := tmp.Chmod(0o644); err != nil {
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp.Name(), name); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	n.xattrs = maps.Clone(n.xattrs)
+	if n.xattrs == nil {
+		n.xattrs = map[string]string{}
+	}
+	n.xattrs[overlayXattrPrefix+redirectXattr] = "/" + h[:2] + "/" + h[2:]
+	n.xattrs[overlayXattrPrefix+metacopyXattr] = string(append([]byte{0, 4 + sha256.Size, 0, metacopyDigestSHA256}, digest[:]...))
+
+	w.holeChunks(n)
+	return nil
+}
+
+// holeChunks sets up the chunks of a regular file stored as a single hole,
+// as done for files with their content in an object
+func (w *Writer) holeChunks(n *node) {
+	chunkBits := max(uint8(bits.Len64(uint64(n.size-1))), w.bits)
+	n.chunkBits = min(chunkBits, w.bits+disk.LayoutChunkFormatBits)
+	n.chunks = make([]uint32, (n.size-1)>>n.chunkBits+1)
+	for i := range n.chunks {
+		n.chunks[i] = disk.NullAddr
+	}
+}
@@ -0,0 +1,289 @@
+package erofs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+func TestObjectStore(t *testing.T) {
+	content := map[string][]byte{
+		"small": []byte("hello composefs\n"),
+		"large": bytes.Repeat([]byte("0123456789abcdef"), 40000),
+		"empty": {},
+	}
+	objects := fstest.MapFS{}
+	var buf writerAtBuffer
+	w, err := NewWriter(&buf, WriterOptions{BlockSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, b := range content {
+		digest, err := verityDigest(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := hex.EncodeToString(digest[:])
+		objects[h[:2]+"/"+h[2:]] = &fstest.MapFile{Data: b}
+		size := int64(len(b))
+		if err := w.Add(&Entry{
+			Path: name,
+			Stat: Stat{Mode: 0o644, Size: size, Xattrs: map[string]string{
+				"trusted.overlay.redirect": "/" + h[:2] + "/" + h[2:],
+				"trusted.overlay.metacopy": string(append([]byte{0, 36, 0, metacopyDigestSHA256}, digest[:]...)),
+			}},
+			Open: func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(make([]byte, size))), nil
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bad := []*Entry{
+		{Path: "nodigest", Stat: Stat{Mode: 0o644, Size: 16, Xattrs: map[string]string{
+			"user.overlay.redirect": "/" + digestPath(t, content["small"]),
+			"user.overlay.metacopy": "",
+		}}, Open: zeros(16)},
+		{Path: "wrongsize", Stat: Stat{Mode: 0o644, Size: 3, Xattrs: map[string]string{
+			"trusted.overlay.redirect": "/" + digestPath(t, content["small"]),
+			"trusted.overlay.metacopy": "",
+		}}, Open: zeros(3)},
+		{Path: "mismatch", Stat: Stat{Mode: 0o644, Size: 16, Xattrs: map[string]string{
+			"trusted.overlay.redirect": "/" + digestPath(t, content["small"]),
+			"trusted.overlay.metacopy": string(append([]byte{0, 36, 0, metacopyDigestSHA256}, make([]byte, 32)...)),
+		}}, Open: zeros(16)},
+		{Path: "inline", Stat: Stat{Mode: 0o644, Size: 6}, Open: func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader("inline")), nil
+		}},
+	}
+	for _, e := range bad {
+		if err := w.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, verify := range []bool{false, true} {
+		opts := []Option{WithObjectStore(objects)}
+		if verify {
+			opts = append(opts, WithVerifyObjects())
+		}
+		img, err := Open(bytes.NewReader(buf.b), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, expected := range content {
+			b, err := fs.ReadFile(img, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, expected) {
+				t.Errorf("%s: unexpected content", name)
+			}
+			f, err := img.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if _, err := f.(io.Seeker).Seek(3, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.Copy(&out, f); err != nil {
+				t.Fatal(err)
+			}
+			if len(expected) > 3 && !bytes.Equal(out.Bytes(), expected[3:]) {
+				t.Errorf("%s: unexpected content written from offset 3", name)
+			}
+			f.Close()
+		}
+		if b, err := fs.ReadFile(img, "inline"); err != nil || string(b) != "inline" {
+			t.Errorf("unexpected inline content %q: %v", b, err)
+		}
+		if b, err := fs.ReadFile(img, "nodigest"); verify != (err != nil) {
+			t.Errorf("unexpected result reading object without digest: %q, %v", b, err)
+		}
+		if _, err := fs.ReadFile(img, "wrongsize"); !errors.Is(err, ErrInvalid) {
+			t.Errorf("expected invalid size error, got %v", err)
+		}
+		if _, err := fs.ReadFile(img, "mismatch"); verify != errors.Is(err, ErrInvalid) {
+			t.Errorf("unexpected result reading object with wrong digest: %v", err)
+		}
+	}
+
+	// Without an object store the content in the image is read
+	img, err := Open(bytes.NewReader(buf.b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := fs.ReadFile(img, "small"); err != nil || !bytes.Equal(b, make([]byte, len(content["small"]))) {
+		t.Errorf("unexpected content %q: %v", b, err)
+	}
+}
+
+func TestVerityDigest(t *testing.T) {
+	for _, tc := range []struct {
+		size   int
+		digest string
+	}{
+		{0, "3d248ca542a24fc62d1c43b916eae5016878e2533c88238480b26128a1f1af95"},
+		{1, "b803429503d95915829b29fdbc8bbad142f3abfd11b1cadf5526582e685c0551"},
+		{4096, "babc284ee4ffe7f449377fbf6692715b43aec7bc39c094a95878904d34bac97e"},
+		{4097, "093756e4ea9683329106d4a16982682ed182c14bf076463a9e7f97305cbac743"},
+		{128*4096 + 1, "e4143a5705610b7ad2eb85482cfc033c7062a89b9faf9118603f592d53fd10e0"},
+		{1 << 20, "feb19a23e72cb1b8f935d668a09ecaad0bf7c5b9cdfa6dbba7c88a9998ed2b87"},
+	} {
+		digest, err := verityDigest(bytes.NewReader(make([]byte, tc.size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := hex.EncodeToString(digest[:]); h != tc.digest {
+			t.Errorf("%d bytes: unexpected digest %s, expected %s", tc.size, h, tc.digest)
+		}
+	}
+}
+
+// digestPath returns the object path of b in a composefs object store
+func digestPath(t testing.TB, b []byte) string {
+	digest, err := verityDigest(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := hex.EncodeToString(digest[:])
+	return h[:2] + "/" + h[2:]
+}
+
+// zeros returns the content of a file of n zero bytes
+func zeros(n int) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(make([]byte, n))), nil
+	}
+}
+
+func TestCreateComposefs(t *testing.T) {
+	mtime := time.Unix(1700000000, 0)
+	large := bytes.Repeat([]byte("composefs"), 5000)
+	src := fstest.MapFS{
+		".":         {Mode: fs.ModeDir | 0o755, ModTime: mtime},
+		"dir":       {Mode: fs.ModeDir | 0o755, ModTime: mtime},
+		"large":     {Data: large, Mode: 0o644, ModTime: mtime},
+		"dir/same":  {Data: large, Mode: 0o600, ModTime: mtime},
+		"dir/small": {Data: []byte("small\n"), Mode: 0o755, ModTime: mtime},
+		"empty":     {Mode: 0o644, ModTime: mtime},
+		"link":      {Data: []byte("large"), Mode: fs.ModeSymlink | 0o777, ModTime: mtime},
+		"xattrs": {Data: []byte("with xattrs"), Mode: 0o644, ModTime: mtime, Sys: &Stat{
+			Mode: 0o644, Size: 11, Mtime: uint64(mtime.Unix()), Xattrs: map[string]string{"user.keep": "1"},
+		}},
+	}
+	objects := t.TempDir()
+	img := createImage(t, src, WriterOptions{ObjectDir: objects})
+
+	// Without the object store, regular files are holes
+	if b, err := fs.ReadFile(img, "large"); err != nil || !bytes.Equal(b, make([]byte, len(large))) {
+		t.Errorf("expected large to be a hole: %v", err)
+	}
+	if st := statOf(t, img, "/large"); st.InodeLayout != disk.LayoutChunkBased {
+		t.Errorf("expected chunk based layout, got %d", st.InodeLayout)
+	}
+	st := statOf(t, img, "/xattrs")
+	if st.Xattrs["user.keep"] != "1" || !strings.HasPrefix(st.Xattrs["trusted.overlay.redirect"], "/") {
+		t.Errorf("unexpected xattrs %v", st.Xattrs)
+	}
+	if img.sb.FeatureIncompat&disk.FeatureIncompatXattrPrefixes == 0 {
+		t.Error("expected long xattr prefixes")
+	}
+	if _, ok := statOf(t, img, "/empty").Xattrs["trusted.overlay.redirect"]; ok {
+		t.Error("expected no object for empty file")
+	}
+
+	// Identical content is stored once
+	var count int
+	err := filepath.WalkDir(objects, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			count++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("expected 3 objects, found %d", count)
+	}
+
+	cfs, err := Open(img.meta, WithObjectStore(os.DirFS(objects)), WithVerifyObjects())
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareImages(t, src, cfs)
+
+	// Creating the image again reuses the objects
+	again := createImage(t, src, WriterOptions{ObjectDir: objects})
+	if !maps.Equal(statOf(t, again, "/large").Xattrs, statOf(t, img, "/large").Xattrs) {
+		t.Error("expected the same object for the same content")
+	}
+
+	if err := FromTar(bytes.NewReader(nil), &writerAtBuffer{}, ConvertOptions{
+		WriterOptions: WriterOptions{ObjectDir: objects},
+		TarIndex:      true,
+	}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected invalid tar index with objects error, got %v", err)
+	}
+}
+
+func TestComposefsOverlayXattrs(t *testing.T) {
+	mtime := time.Unix(1700000000, 0)
+	src := fstest.MapFS{
+		".": {Mode: fs.ModeDir | 0o755, ModTime: mtime},
+		"opaque": {Mode: fs.ModeDir | 0o755, ModTime: mtime, Sys: &Stat{
+			Mode: fs.ModeDir | 0o755, Mtime: uint64(mtime.Unix()), Xattrs: map[string]string{
+				"trusted.overlay.opaque": "y",
+			},
+		}},
+		"file": {Data: []byte("content"), Mode: 0o644, ModTime: mtime, Sys: &Stat{
+			Mode: 0o644, Size: 7, Mtime: uint64(mtime.Unix()), Xattrs: map[string]string{
+				"trusted.overlay.redirect": "/elsewhere",
+				"user.keep":                "1",
+			},
+		}},
+	}
+	objects := t.TempDir()
+	img := createImage(t, src, WriterOptions{ObjectDir: objects})
+
+	// Overlay xattrs of the files are escaped in the image
+	if st := statOf(t, img, "/opaque"); !maps.Equal(st.Xattrs, map[string]string{"trusted.overlay.overlay.opaque": "y"}) {
+		t.Errorf("unexpected xattrs of directory %v", st.Xattrs)
+	}
+	st := statOf(t, img, "/file")
+	if st.Xattrs["trusted.overlay.overlay.redirect"] != "/elsewhere" || st.Xattrs["trusted.overlay.redirect"] == "/elsewhere" {
+		t.Errorf("unexpected xattrs of file %v", st.Xattrs)
+	}
+
+	// The object store reads the escaped xattrs under their original names
+	// and the content from the object referenced by the image
+	cfs, err := Open(img.meta, WithObjectStore(os.DirFS(objects)), WithVerifyObjects())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := statOf(t, cfs, "/opaque"); !maps.Equal(st.Xattrs, map[string]string{"trusted.overlay.opaque": "y"}) {
+		t.Errorf("unexpected unescaped xattrs of directory %v", st.Xattrs)
+	}
+	if st := statOf(t, cfs, "/file"); !maps.Equal(st.Xattrs, map[string]string{"trusted.overlay.redirect": "/elsewhere", "user.keep": "1"}) {
+		t.Errorf("unexpected unescaped xattrs of file %v", st.Xattrs)
+	}
+	if b, err := fs.ReadFile(cfs, "file"); err != nil || string(b) != "content" {
+		t.Errorf("unexpected content %q: %v", b, err)
+	}
+}
@@ -0,0 +1,328 @@
+package erofs
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+// zmap holds the logical cluster indexes of a compressed inode
+type zmap struct {
+	header  disk.MapHeader
+	bits    uint8 // logical cluster size bits
+	compact bool
+	total   int    // number of logical clusters
+	ebase   int64  // address of the first index
+	buf     []byte // all indexes starting at ebase
+
+	// compact indexes start with 4 byte indexes until 32 byte aligned,
+	// followed by 2 byte indexes when enabled and then 4 byte indexes
+	initial     int
+	compacted2B int
+}
+
+// lcluster is a decoded logical cluster index
+type lcluster struct {
+	typ         uint8
+	clusterOfs  int64 // offset of the head within the lcluster
+	pblk        int64 // physical block of head and plain lclusters
+	delta0      int   // distance to the head for non-head lclusters
+	cblks       int64 // compressed blocks of a big pcluster, set on the first non-head
+	nextpackoff int64 // address following the index or pack of indexes
+}
+
+// loadZmap reads the map header and all logical cluster indexes of a
+// compressed inode
+func (img *Image) loadZmap(fi *fileInfo) (*zmap, error) {
+	hpos := (img.inodeAddr(fi.inode) + int64(fi.isize) + int64(fi.xsize) + 7) &^ 7
+	var hbuf [disk.SizeMapHeader]byte
+	if _, err := img.readMeta(hbuf[:], hpos); err != nil {
+		return nil, fmt.Errorf("failed to read map header for nid %d: %w", fi.inode, err)
+	}
+	z := &zmap{
+		compact: fi.inodeLayout == disk.LayoutCompressedCompact,
+	}
+	if _, err := binary.Decode(hbuf[:], binary.LittleEndian, &z.header); err != nil {
+		return nil, err
+	}
+	if z.header.ClusterBits&disk.FragmentInodeBit != 0 {
+		// Whole file is stored in a fragment, there are no indexes
+		return z, nil
+	}
+	z.bits = img.sb.BlkSizeBits + z.header.ClusterBits&0x0F
+	if z.bits > 30 {
+		return nil, fmt.Errorf("invalid logical cluster bits %d for nid %d: %w", z.bits, fi.inode, ErrInvalid)
+	}
+	z.total = int((fi.size-1)>>z.bits) + 1
+
+	var size int64
+	if z.compact {
+		if z.bits > 14 || (z.header.Advise&disk.AdviseCompacted2B != 0 && z.bits > 12) {
+			return nil, fmt.Errorf("compact indexes with logical cluster bits %d for nid %d: %w", z.bits, fi.inode, ErrNotImplemented)
+		}
+		z.ebase = hpos + disk.SizeMapHeader
+		z.initial = int((32-z.ebase%32)/4) & 7
+		if z.header.Advise&disk.AdviseCompacted2B != 0 && z.initial < z.total {
+			z.compacted2B = (z.total - z.initial) &^ 15
+		}
+		pos, shift := z.compactPos(z.total - 1)
+		size = packEnd(pos, shift) - z.ebase
+	} else {
+		// Full indexes follow the map header and 8 reserved bytes
+		z.ebase = hpos + disk.SizeMapHeader + 8
+		size = int64(z.total) * disk.SizeLclusterIdx
+	}
+	z.buf = make([]byte, size)
+	if _, err := img.readMeta(z.buf, z.ebase); err != nil {
+		return nil, fmt.Errorf("failed to read lcluster indexes for nid %d: %w", fi.inode, err)
+	}
+	return z, nil
+}
+
+// compactPos returns the address of the compact index for lcn and the
+// amortized size shift of its pack
+func (z *zmap) compactPos(lcn int) (int64, uint) {
+	pos := z.ebase
+	shift := uint(2)
+	if lcn >= z.initial {
+		pos += int64(z.initial) * 4
+		lcn -= z.initial
+		if lcn < z.compacted2B {
+			shift = 1
+		} else {
+			pos += int64(z.compacted2B) * 2
+			lcn -= z.compacted2B
+		}
+	}
+	return pos + int64(lcn)<<shift, shift
+}
+
+// packVcnt returns the number of indexes in a compact pack
+func packVcnt(shift uint) int {
+	if shift == 1 {
+		return 16
+	}
+	return 2
+}
+
+// packEnd returns the address following the compact pack containing pos
+func packEnd(pos int64, shift uint) int64 {
+	packSize := int64(packVcnt(shift)) << shift
+	return pos&^(packSize-1) + packSize
+}
+
+// lcluster decodes the index of logical cluster lcn
+func (z *zmap) lcluster(lcn int) (lcluster, error) {
+	if lcn < 0 || lcn >= z.total {
+		return lcluster{}, fmt.Errorf("lcluster %d out of range: %w", lcn, ErrInvalid)
+	}
+	if z.compact {
+		return z.compactLcluster(lcn)
+	}
+	off := lcn * disk.SizeLclusterIdx
+	var idx disk.LclusterIndex
+	if _, err := binary.Decode(z.buf[off:], binary.LittleEndian, &idx); err != nil {
+		return lcluster{}, err
+	}
+	lc := lcluster{
+		typ:         uint8(idx.Advise & 0x3),
+		nextpackoff: z.ebase + int64(off) + disk.SizeLclusterIdx,
+	}
+	if lc.typ == disk.LclusterTypeNonhead {
+		lc.delta0 = int(idx.BlkAddr & 0xFFFF)
+		if lc.delta0&disk.LclusterD0Cblkcnt != 0 {
+			lc.cblks = int64(lc.delta0 &^ disk.LclusterD0Cblkcnt)
+			lc.delta0 = 1
+		}
+		return lc, nil
+	}
+	lc.clusterOfs = int64(idx.ClusterOfs)
+	if lc.clusterOfs >= 1<<z.bits {
+		return lcluster{}, fmt.Errorf("invalid cluster offset %d: %w", lc.clusterOfs, ErrInvalid)
+	}
+	lc.pblk = int64(idx.BlkAddr)
+	return lc, nil
+}
+
+// compactLcluster decodes a compact index, the physical block of a head is
+// derived from the block address of its pack by counting the pclusters
+// preceding it within the pack
+func (z *zmap) compactLcluster(lcn int) (lcluster, error) {
+	pos, shift := z.compactPos(lcn)
+	vcnt := packVcnt(shift)
+	packSize := int64(vcnt) << shift
+	start := pos&^(packSize-1) - z.ebase
+	in := z.buf[start : start+packSize]
+
+	lobits := uint(max(z.bits, 12))
+	encodebits := uint((packSize - 4) * 8 / int64(vcnt))
+	decode := func(i int) (int, uint8) {
+		bit := encodebits * uint(i)
+		var v [4]byte
+		copy(v[:], in[bit/8:])
+		x := binary.LittleEndian.Uint32(v[:]) >> (bit & 7)
+		return int(x & (1<<lobits - 1)), uint8(x>>lobits) & 3
+	}
+	bigPcluster := z.header.Advise&disk.AdviseBigPcluster1 != 0
+
+	i := int((pos - z.ebase - start) >> shift)
+	lo, typ := decode(i)
+	lc := lcluster{
+		typ:         typ,
+		nextpackoff: z.ebase + start + packSize,
+	}
+	if typ == disk.LclusterTypeNonhead {
+		switch {
+		case lo&disk.LclusterD0Cblkcnt != 0:
+			if !bigPcluster {
+				return lcluster{}, fmt.Errorf("compressed block count without big pcluster: %w", ErrInvalid)
+			}
+			lc.cblks = int64(lo &^ disk.LclusterD0Cblkcnt)
+			lc.delta0 = 1
+		case i+1 != vcnt:
+			lc.delta0 = lo
+		default:
+			// The last index of a pack stores delta1, delta0 is derived
+			// from the previous index
+			plo, ptyp := decode(i - 1)
+			if ptyp != disk.LclusterTypeNonhead {
+				plo = 0
+			} else if plo&disk.LclusterD0Cblkcnt != 0 {
+				plo = 1
+			}
+			lc.delta0 = plo + 1
+		}
+		return lc, nil
+	}
+	lc.clusterOfs = int64(lo)
+
+	var nblk int
+	if !bigPcluster {
+		nblk = 1
+		for i > 0 {
+			i--
+			lo, typ := decode(i)
+			if typ == disk.LclusterTypeNonhead {
+				i -= lo
+			}
+			if i >= 0 {
+				nblk++
+			}
+		}
+	} else {
+		for i > 0 {
+			i--
+			lo, typ := decode(i)
+			if typ == disk.LclusterTypeNonhead {
+				if lo&disk.LclusterD0Cblkcnt != 0 {
+					i--
+					nblk += lo &^ disk.LclusterD0Cblkcnt
+					continue
+				}
+				if lo <= 1 {
+					return lcluster{}, fmt.Errorf("invalid delta in big pcluster: %w", ErrInvalid)
+				}
+				i -= lo - 2
+				continue
+			}
+			nblk++
+		}
+	}
+	lc.pblk = int64(binary.LittleEndian.Uint32(in[packSize-4:])) + int64(nblk)
+	return lc, nil
+}
+
+// compressedExtents returns the extents of a compressed inode, one for
+// each pcluster
+func (img *Image) compressedExtents(fi *fileInfo) ([]Extent, error) {
+	if fi.size == 0 {
+		return nil, nil
+	}
+	z, err := img.loadZmap(fi)
+	if err != nil {
+		return nil, err
+	}
+	if z.header.ClusterBits&disk.FragmentInodeBit != 0 {
+		return []Extent{{
+			Physical: -1,
+			Length:   fi.size,
+			Flags:    ExtentFragment,
+		}}, nil
+	}
+
+	bits := img.sb.BlkSizeBits
+	var exts []Extent
+	for lcn := range z.total {
+		lc, err := z.lcluster(lcn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode lcluster %d for nid %d: %w", lcn, fi.inode, err)
+		}
+		if lc.typ == disk.LclusterTypeNonhead {
+			if lcn == 0 {
+				return nil, fmt.Errorf("first lcluster is not a head for nid %d: %w", fi.inode, ErrInvalid)
+			}
+			continue
+		}
+		la := int64(lcn)<<z.bits + lc.clusterOfs
+		if la >= fi.size {
+			break
+		}
+
+		// Big pclusters store the compressed block count in the first
+		// non-head lcluster following the head
+		cblks := int64(1)
+		big := z.header.Advise&disk.AdviseBigPcluster1 != 0
+		if lc.typ != disk.LclusterTypeHead1 {
+			big = z.header.Advise&disk.AdviseBigPcluster2 != 0
+		}
+		if big && lcn+1 < z.total {
+			next, err := z.lcluster(lcn + 1)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode lcluster %d for nid %d: %w", lcn+1, fi.inode, err)
+			}
+			if next.typ == disk.LclusterTypeNonhead {
+				if next.cblks == 0 {
+					return nil, fmt.Errorf("missing compressed block count for nid %d: %w", fi.inode, ErrInvalid)
+				}
+				cblks = next.cblks
+			}
+		}
+
+		if n := len(exts); n > 0 {
+			exts[n-1].Length = la - exts[n-1].Logical
+		}
+		ext := Extent{
+			Logical:        la,
+			Physical:       lc.pblk << bits,
+			Length:         fi.size - la,
+			PhysicalLength: cblks << bits,
+		}
+		if lc.typ != disk.LclusterTypePlain {
+			ext.Flags |= ExtentCompressed
+		}
+		exts = append(exts, ext)
+	}
+	if len(exts) == 0 {
+		return nil, fmt.Errorf("no pclusters for nid %d: %w", fi.inode, ErrInvalid)
+	}
+
+	// The tail pcluster may be stored inline after the indexes or in a
+	// fragment of the packed inode
+	tail := &exts[len(exts)-1]
+	switch {
+	case z.header.Advise&disk.AdviseInlinePcluster != 0:
+		last, err := z.lcluster(z.total - 1)
+		if err != nil {
+			return nil, err
+		}
+		tail.Physical = last.nextpackoff
+		tail.PhysicalLength = int64(z.header.FragmentOff >> 16)
+		tail.Flags |= ExtentInline
+	case z.header.Advise&disk.AdviseFragmentPcluster != 0:
+		tail.Physical = -1
+		tail.PhysicalLength = 0
+		tail.Flags = ExtentFragment
+	}
+	return exts, nil
+}
@@ -0,0 +1,102 @@
+package erofs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyRange copies n bytes at off from r to w within the kernel when r is an
+// *os.File and w is an *os.File or a socket. When nothing could be copied
+// this way, either because it is not supported or because the kernel copied
+// nothing without an error, handled is false and the caller must fall back
+// to copying through a buffer.
+func copyRange(w io.Writer, r io.ReaderAt, off, n int64) (written int64, handled bool, err error) {
+	src, ok := r.(*os.File)
+	if !ok {
+		return 0, false, nil
+	}
+	dst, ok := w.(syscall.Conn)
+	if !ok {
+		return 0, false, nil
+	}
+	srcConn, err := src.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	dstConn, err := dst.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	_, isFile := w.(*os.File)
+
+	var serr error
+	cerr := srcConn.Control(func(srcFd uintptr) {
+		if isFile {
+			written, serr = copyLoop(dstConn, n, func(dstFd uintptr, remain int64) (int, error) {
+				return unix.CopyFileRange(int(srcFd), &off, int(dstFd), nil, int(min(remain, 1<<30)), 0)
+			})
+			// Some filesystems copy nothing without an error, try
+			// sendfile before falling back to a buffered copy
+			if !unsupported(serr) && (serr != nil || written > 0) {
+				return
+			}
+		}
+		// Continue with sendfile from wherever copy_file_range stopped
+		var sent int64
+		sent, serr = copyLoop(dstConn, n-written, func(dstFd uintptr, remain int64) (int, error) {
+			return syscall.Sendfile(int(dstFd), int(srcFd), &off, int(min(remain, 1<<30)))
+		})
+		written += sent
+	})
+	if cerr != nil {
+		return written, written > 0, cerr
+	}
+	if written == 0 && (serr == nil || unsupported(serr)) {
+		return 0, false, nil
+	}
+	if serr == nil && written < n {
+		serr = io.ErrUnexpectedEOF
+	}
+	return written, true, serr
+}
+
+// copyLoop calls copyFn with the destination file descriptor until n bytes
+// are copied, waiting for the destination to be writable when non-blocking
+func copyLoop(dst syscall.RawConn, n int64, copyFn func(fd uintptr, remain int64) (int, error)) (int64, error) {
+	var (
+		written int64
+		err     error
+	)
+	werr := dst.Write(func(fd uintptr) bool {
+		for written < n {
+			var c int
+			c, err = copyFn(fd, n-written)
+			if err == syscall.EAGAIN {
+				err = nil
+				return false
+			} else if err == syscall.EINTR {
+				continue
+			} else if err != nil || c == 0 {
+				return true
+			}
+			written += int64(c)
+		}
+		return true
+	})
+	if err == nil {
+		err = werr
+	}
+	return written, err
+}
+
+// unsupported returns whether the error indicates the kernel copy is not
+// supported for the file descriptors and a buffered copy should be used
+func unsupported(err error) bool {
+	return errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EXDEV) ||
+		errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.EOPNOTSUPP) ||
+		errors.Is(err, syscall.EBADF) || errors.Is(err, syscall.EPERM)
+}
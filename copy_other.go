@@ -0,0 +1,11 @@
+//go:build !linux
+
+package erofs
+
+import "io"
+
+// copyRange is not supported on this platform, data is always
+// copied through a buffer
+func copyRange(w io.Writer, r io.ReaderAt, off, n int64) (int64, bool, error) {
+	return 0, false, nil
+}
@@ -0,0 +1,89 @@
+package erofs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+// WithExtraDevices provides the readers for the extra devices listed in the
+// device table of the image, in device table order. Reading data stored on
+// an extra device which was not provided returns an error.
+func WithExtraDevices(devs ...io.ReaderAt) Option {
+	return func(img *Image) error {
+		if len(devs) > len(img.devices) {
+			return fmt.Errorf("%d extra devices provided but image has %d: %w", len(devs), len(img.devices), ErrInvalid)
+		}
+		for i, r := range devs {
+			img.devices[i].r = r
+		}
+		return nil
+	}
+}
+
+// device is an extra device from the device table
+type device struct {
+	slot disk.DeviceSlot
+	r    io.ReaderAt
+}
+
+// loadDevices reads the device table from the image
+func (img *Image) loadDevices() error {
+	n := int(img.sb.ExtraDevices)
+	if n == 0 {
+		return nil
+	}
+	buf := make([]byte, n*disk.SizeDeviceSlot)
+	if _, err := img.meta.ReadAt(buf, int64(img.sb.DevtSlotOff)*disk.SizeDeviceSlot); err != nil {
+		return fmt.Errorf("failed to read device table: %w", err)
+	}
+	img.devices = make([]device, n)
+	img.flatDevices = true
+	for i := range img.devices {
+		if _, err := binary.Decode(buf[i*disk.SizeDeviceSlot:], binary.LittleEndian, &img.devices[i].slot); err != nil {
+			return err
+		}
+		if img.devices[i].slot.MappedBlkAddr == 0 {
+			img.flatDevices = false
+		}
+	}
+	return nil
+}
+
+// mapDevice resolves the device for an extent read from a chunk index.
+// When all devices are mapped into a unified address space, the address is
+// translated to the primary device.
+func (img *Image) mapDevice(ext *extent) error {
+	if ext.device == 0 || ext.physical == -1 {
+		return nil
+	}
+	// Only the bits needed to address the devices are used
+	mask := uint16(1<<bits.Len16(uint16(len(img.devices))) - 1)
+	ext.device &= mask
+	if ext.device == 0 {
+		return nil
+	}
+	if int(ext.device) > len(img.devices) {
+		return fmt.Errorf("device %d not in device table: %w", ext.device, ErrInvalid)
+	}
+	if img.flatDevices {
+		ext.physical += int64(img.devices[ext.device-1].slot.MappedBlkAddr) << img.sb.BlkSizeBits
+		ext.device = 0
+	}
+	return nil
+}
+
+// readDevice reads from the primary image for device 0 or the extra device
+func (img *Image) readDevice(dev uint16, p []byte, off int64) (int, error) {
+	if dev == 0 {
+		return img.readData(p, off)
+	}
+	r := img.devices[dev-1].r
+	if r == nil {
+		return 0, fmt.Errorf("extra device %d not provided", dev)
+	}
+	return r.ReadAt(p, off)
+}
@@ -0,0 +1,361 @@
+package erofs
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+// dumpInlineLimit is the size up to which the content of regular files is
+// written to dumpfiles, larger files are referenced by their object
+const dumpInlineLimit = 64
+
+// WriteDumpfile writes the contents of the image to w in the composefs
+// dumpfile format, with one line per entry in lexical order starting with
+// the root:
+//
+//	PATH SIZE MODE NLINK UID GID RDEV MTIME PAYLOAD CONTENT DIGEST XATTRS...
+//
+// The mode is written in octal including the file type, the modification
+// time as seconds and nanoseconds separated by a dot and xattrs as
+// name=value. Fields are escaped as done by composefs and "-" marks an
+// empty field.
+//
+// Regular files referencing a composefs object have the object path as
+// payload and the fs-verity digest from the metacopy xattr, the overlay
+// xattrs referencing the object are not listed. Other regular files up to
+// 64 bytes have their content inline, larger files are listed with the
+// fs-verity digest of their content and the object path it would be stored
+// at. Symlinks have their target as payload. Additional links to an inode
+// are written as hardlinks to the first path, which have a mode of @120000
+// and the target as payload.
+func WriteDumpfile(img *Image, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	links := map[uint64]string{}
+	for e, err := range Walk(img, "/") {
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", e.Path, err)
+		}
+		if err := writeDumpEntry(bw, e.DirEntry.(*direntry), e.Path, links); err != nil {
+			return fmt.Errorf("failed to write %s: %w", e.Path, err)
+		}
+	}
+	return bw.Flush()
+}
+
+func writeDumpEntry(w *bufio.Writer, de *direntry, name string, links map[uint64]string) error {
+	fi, err := de.Info()
+	if err != nil {
+		return err
+	}
+	st := fi.Sys().(*Stat)
+	if !fi.IsDir() && st.Nlink > 1 {
+		if link, ok := links[de.Nid()]; ok {
+			_, err := fmt.Fprintf(w, "%s 0 @120000 - - - - 0.0 %s - -\n", escapeDump(name, false), escapeDump(link, false))
+			return err
+		}
+		links[de.Nid()] = name
+	}
+
+	var (
+		size                     int64
+		payload, content, digest string
+		xattrs                   = st.Xattrs
+	)
+	switch st.Mode.Type() {
+	case 0:
+		size = st.Size
+		if obj, sum, rest, ok := objectReference(xattrs); ok {
+			payload, digest, xattrs = obj, sum, rest
+			break
+		}
+		f := de.File
+		if size <= dumpInlineLimit {
+			b, err := io.ReadAll(&f)
+			if err != nil {
+				return err
+			}
+			content = string(b)
+			break
+		}
+		sum, err := verityDigest(&f)
+		if err != nil {
+			return err
+		}
+		digest = hex.EncodeToString(sum[:])
+		payload = digest[:2] + "/" + digest[2:]
+	case fs.ModeSymlink:
+		f := de.File
+		b, err := io.ReadAll(&f)
+		if err != nil {
+			return err
+		}
+		size, payload = int64(len(b)), string(b)
+	}
+
+	fmt.Fprintf(w, "%s %d %o %d %d %d %d %d.%d %s %s %s", escapeDump(name, false), size,
+		disk.GoFileModeToEroFSMode(st.Mode), st.Nlink, st.UID, st.GID, st.Rdev, st.Mtime, st.MtimeNs,
+		dumpField(payload), dumpField(content), dumpField(digest))
+	for _, k := range slices.Sorted(maps.Keys(xattrs)) {
+		fmt.Fprintf(w, " %s=%s", escapeDump(k, true), escapeDump(xattrs[k], true))
+	}
+	return w.WriteByte('\n')
+}
+
+// objectReference returns the composefs object path and hex encoded
+// fs-verity digest referenced by the overlay xattrs of a regular file and
+// the remaining xattrs. The digest is empty when the metacopy xattr does
+// not hold a SHA-256 digest.
+func objectReference(xattrs map[string]string) (obj, digest string, rest map[string]string, ok bool) {
+	for _, prefix := range []string{"trusted.overlay.", "user.overlay."} {
+		redirect, ok := xattrs[prefix+redirectXattr]
+		metacopy, mok := xattrs[prefix+metacopyXattr]
+		if !ok || !mok {
+			continue
+		}
+		if len(metacopy) == 4+sha256.Size && metacopy[0] == 0 && int(metacopy[1]) == len(metacopy) && metacopy[3] == metacopyDigestSHA256 {
+			digest = hex.EncodeToString([]byte(metacopy[4:]))
+		}
+		rest = maps.Clone(xattrs)
+		delete(rest, prefix+redirectXattr)
+		delete(rest, prefix+metacopyXattr)
+		return strings.TrimPrefix(redirect, "/"), digest, rest, true
+	}
+	return "", "", xattrs, false
+}
+
+// dumpField returns the escaped field, "-" when empty
+func dumpField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return escapeDump(s, false)
+}
+
+// escapeDump escapes a dumpfile field. Backslashes and control characters
+// are escaped as in C, other bytes which are not printable or are spaces
+// are hex escaped. A lone dash is escaped to distinguish it from an empty
+// field and equal signs are escaped in xattr names and values.
+func escapeDump(s string, equal bool) string {
+	if s == "-" {
+		return `\x2d`
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			b.WriteString(`\\`)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c <= ' ' || c >= 0x7f || c == '=' && equal:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unescapeDump reverses escapeDump
+func unescapeDump(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i++; i == len(s) {
+			return "", fmt.Errorf("trailing backslash in %q: %w", s, ErrInvalid)
+		}
+		switch s[i] {
+		case '\\':
+			b.WriteByte('\\')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'x':
+			if i+2 >= len(s) {
+				return "", fmt.Errorf("short hex escape in %q: %w", s, ErrInvalid)
+			}
+			c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid hex escape in %q: %w", s, ErrInvalid)
+			}
+			b.WriteByte(byte(c))
+			i += 2
+		default:
+			return "", fmt.Errorf("unknown escape \\%c in %q: %w", s[i], s, ErrInvalid)
+		}
+	}
+	return b.String(), nil
+}
+
+// FromDumpfile writes an erofs image from the composefs dumpfile read from
+// r, such as written by WriteDumpfile. Regular files are stored with their
+// inline content, files with a payload reference the composefs object at
+// that path with the trusted.overlay.redirect and trusted.overlay.metacopy
+// xattrs, holding the digest when given, and are stored as holes. The link
+// counts and the sizes of directories are derived from the tree, the fields
+// of hardlinks other than the path and target are ignored and hardlink
+// targets must be listed before their hardlinks.
+func FromDumpfile(r io.Reader, w io.WriterAt, opts WriterOptions) error {
+	ew, err := NewWriter(w, opts)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(r)
+	for lineNo := 1; ; lineNo++ {
+		line, err := br.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if line = strings.TrimSuffix(line, "\n"); line != "" {
+			if err := addDumpEntry(ew, line); err != nil {
+				return fmt.Errorf("dumpfile line %d: %w", lineNo, err)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return ew.Close()
+}
+
+// addDumpEntry adds the entry for a dumpfile line to the writer
+func addDumpEntry(w *Writer, line string) error {
+	fields := strings.Fields(line)
+	if len(fields) < 11 {
+		return fmt.Errorf("%d fields, expected at least 11: %w", len(fields), ErrInvalid)
+	}
+	var err error
+	unescaped := make([]string, len(fields))
+	for i, f := range fields {
+		if f == "-" && i >= 8 && i <= 10 {
+			continue
+		}
+		if unescaped[i], err = unescapeDump(f); err != nil {
+			return err
+		}
+	}
+	name, ok := strings.CutPrefix(unescaped[0], "/")
+	if !ok {
+		return fmt.Errorf("path %q not absolute: %w", unescaped[0], ErrInvalid)
+	}
+	e := &Entry{Path: path.Clean("./" + name)}
+	payload, content, digest := unescaped[8], unescaped[9], unescaped[10]
+	if strings.HasPrefix(fields[2], "@") {
+		if payload == "" {
+			return fmt.Errorf("hardlink %s without target: %w", unescaped[0], ErrInvalid)
+		}
+		e.Hardlink = path.Clean("./" + strings.TrimPrefix(payload, "/"))
+		return w.Add(e)
+	}
+
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid size %q: %w", fields[1], ErrInvalid)
+	}
+	mode, err := strconv.ParseUint(fields[2], 8, 16)
+	if err != nil {
+		return fmt.Errorf("invalid mode %q: %w", fields[2], ErrInvalid)
+	}
+	if _, err := strconv.ParseUint(fields[3], 10, 32); err != nil {
+		return fmt.Errorf("invalid nlink %q: %w", fields[3], ErrInvalid)
+	}
+	var ids [3]uint64
+	for i, f := range fields[4:7] {
+		if ids[i], err = strconv.ParseUint(f, 10, 32); err != nil {
+			return fmt.Errorf("invalid uid, gid or rdev %q: %w", f, ErrInvalid)
+		}
+	}
+	sec, nsec, _ := strings.Cut(fields[7], ".")
+	mtime, err := strconv.ParseUint(sec, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid mtime %q: %w", fields[7], ErrInvalid)
+	}
+	var mtimeNs uint64
+	if nsec != "" {
+		if mtimeNs, err = strconv.ParseUint(nsec, 10, 32); err != nil || mtimeNs >= 1e9 {
+			return fmt.Errorf("invalid mtime %q: %w", fields[7], ErrInvalid)
+		}
+	}
+	e.Stat = Stat{
+		Mode:    disk.EroFSModeToGoFileMode(uint16(mode)),
+		UID:     uint32(ids[0]),
+		GID:     uint32(ids[1]),
+		Rdev:    uint32(ids[2]),
+		Mtime:   mtime,
+		MtimeNs: uint32(mtimeNs),
+	}
+	if len(fields) > 11 {
+		e.Stat.Xattrs = map[string]string{}
+	}
+	for _, f := range fields[11:] {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			return fmt.Errorf("invalid xattr %q: %w", f, ErrInvalid)
+		}
+		if k, err = unescapeDump(k); err != nil {
+			return err
+		}
+		if v, err = unescapeDump(v); err != nil {
+			return err
+		}
+		e.Stat.Xattrs[k] = v
+	}
+
+	switch e.Stat.Mode.Type() {
+	case 0:
+		e.Stat.Size = size
+		if payload != "" {
+			return addDumpObject(w, e, payload, digest)
+		}
+		if int64(len(content)) != size {
+			return fmt.Errorf("content of %s is %d bytes, expected %d: %w", unescaped[0], len(content), size, ErrInvalid)
+		}
+		e.Open = func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(content)), nil
+		}
+	case fs.ModeSymlink:
+		if payload == "" {
+			return fmt.Errorf("symlink %s without target: %w", unescaped[0], ErrInvalid)
+		}
+		e.Link = payload
+	}
+	return w.Add(e)
+}
+
+// addDumpObject adds the regular file e with the content in the composefs
+// object at path obj, with the hex encoded fs-verity digest when not empty
+func addDumpObject(w *Writer, e *Entry, obj, digest string) error {
+	var metacopy []byte
+	if digest != "" {
+		sum, err := hex.DecodeString(digest)
+		if err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("invalid digest %q: %w", digest, ErrInvalid)
+		}
+		metacopy = append([]byte{0, 4 + sha256.Size, 0, metacopyDigestSHA256}, sum...)
+	}
+	return w.addObjectFile(e, obj, string(metacopy))
+}
@@ -0,0 +1,101 @@
+package erofs
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+func TestDumpfile(t *testing.T) {
+	const digest = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	dump := strings.Join([]string{
+		`/ 0 40755 3 0 0 0 1700000000.0 - - - user.root=\x3d\x20value`,
+		`/dash 1 100644 1 0 0 0 1700000000.0 - \x2d -`,
+		`/dev 0 40700 2 0 0 0 1700000000.0 - - -`,
+		`/dev/fifo 0 10644 1 0 0 0 1700000000.0 - - -`,
+		`/dev/null 0 20666 1 0 0 259 1700000000.0 - - -`,
+		`/dev/sda 0 60660 1 0 6 2048 1700000000.0 - - -`,
+		`/empty 0 100644 1 0 0 0 1700000000.0 - - -`,
+		`/file\x20name 11 104755 2 1000 100 0 1700000001.5 - line\tone\\\n\x00 - security.capability=\x01\x00 user.empty=`,
+		`/hardlink 0 @120000 - - - - 0.0 /file\x20name - -`,
+		`/link 9 120777 1 0 0 0 1700000000.0 file\x20name - -`,
+		`/nodigest 100 100600 1 0 0 0 1700000000.0 ab/cdef - -`,
+		`/object 8192 100644 1 0 0 0 1700000000.0 01/23456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef - ` + digest + ` user.keep=1`,
+	}, "\n") + "\n"
+
+	var buf writerAtBuffer
+	if err := FromDumpfile(strings.NewReader(dump), &buf, WriterOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Open(bytes.NewReader(buf.b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := WriteDumpfile(img, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != dump {
+		t.Errorf("unexpected dumpfile\n%s\nexpected\n%s", out.String(), dump)
+	}
+
+	if b, err := fs.ReadFile(img, "file name"); err != nil || string(b) != "line\tone\\\n\x00" {
+		t.Errorf("unexpected content %q: %v", b, err)
+	}
+	st := statOf(t, img, "/object")
+	if st.Xattrs["trusted.overlay.redirect"] != "/01/23456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef" {
+		t.Errorf("unexpected xattrs %q", st.Xattrs)
+	}
+	if exts, err := img.Extents("/object"); err != nil || len(exts) != 1 || exts[0].Flags&ExtentHole == 0 {
+		t.Errorf("expected object to be a hole, got %+v: %v", exts, err)
+	}
+}
+
+func TestDumpfileImage(t *testing.T) {
+	img, err := Open(loadTestFile(t, "basic-default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dump bytes.Buffer
+	if err := WriteDumpfile(img, &dump); err != nil {
+		t.Fatal(err)
+	}
+	var buf writerAtBuffer
+	if err := FromDumpfile(bytes.NewReader(dump.Bytes()), &buf, WriterOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := Open(bytes.NewReader(buf.b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again bytes.Buffer
+	if err := WriteDumpfile(imported, &again); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dump.Bytes(), again.Bytes()) {
+		t.Errorf("dumpfile of imported image differs\n%s\nexpected\n%s", again.String(), dump.String())
+	}
+}
+
+func TestDumpfileErrors(t *testing.T) {
+	for _, line := range []string{
+		`/ 0 40755 2 0 0 0 0.0 - -`,
+		`relative 0 100644 1 0 0 0 0.0 - - -`,
+		`/f 3 100644 1 0 0 0 0.0 - ab -`,
+		`/f 1 100644 1 0 0 0 0.0 - \q -`,
+		`/f 1 100644 1 0 0 0 0.0 - \x4 -`,
+		`/f 0 100644 1 0 0 0 -1.0 - - -`,
+		`/f 0 100644 1 0 0 0 1.1000000000 - - -`,
+		`/f 0 108644 1 0 0 0 0.0 - - -`,
+		`/f 0 100644 1 0 0 0 0.0 - - - novalue`,
+		`/f 8 100644 1 0 0 0 0.0 ab/cd - 0123`,
+		`/l 0 120777 1 0 0 0 0.0 - - -`,
+		`/h 0 @120000 - - - - 0.0 /missing - -`,
+	} {
+		if err := FromDumpfile(strings.NewReader(line), &writerAtBuffer{}, WriterOptions{}); !errors.Is(err, ErrInvalid) && !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: expected invalid dumpfile error, got %v", line, err)
+		}
+	}
+}
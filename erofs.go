@@ -1,14 +1,17 @@
 package erofs
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"iter"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/erofs/go-erofs/internal/disk"
@@ -30,6 +33,16 @@ var (
 	// ErrNotImplemented is returned when a feature is known but not implemented
 	// yet by this library
 	ErrNotImplemented = errors.New("not implemented")
+
+	// ErrNotMapped is returned when file data is requested directly from
+	// the image memory but the image is not memory mapped or the data
+	// is not stored contiguously and uncompressed
+	ErrNotMapped = errors.New("not memory mapped")
+
+	// ErrNoData is returned when seeking with SeekData or SeekHole to an
+	// offset at or beyond the end of the file, or with SeekData when there
+	// is no data following the offset. It corresponds to ENXIO from lseek.
+	ErrNoData = errors.New("no data at offset")
 )
 
 // Stat is the erofs specific stat data returned by Stat and FileInfo requests
@@ -47,11 +60,45 @@ type Stat struct {
 	Xattrs      map[string]string
 }
 
+// Option is used to configure how an image is read
+type Option func(*Image) error
+
+// WithReadahead enables asynchronous readahead for open files, prefetching
+// up to max bytes ahead of sequential reads in the background. The window
+// starts small, grows while reads remain sequential and shrinks on random
+// access. Readahead is disabled by default.
+//
+// When the image has a data block cache, see WithBlockCache, prefetched
+// blocks are added to the cache and shared with all files. Otherwise each
+// open file holds up to two windows of prefetched data in private buffers.
+func WithReadahead(max int) Option {
+	return func(img *Image) error {
+		if max < 0 {
+			return fmt.Errorf("invalid readahead size %d: %w", max, ErrInvalid)
+		}
+		img.readahead = int64(max)
+		return nil
+	}
+}
+
 // EroFS returns a FileSystem reading from the given readerat.
 // The readerat must be a valid erofs block file.
 // No additional memory mapping is done and must be handled by
 // the caller.
-func EroFS(r io.ReaderAt) (fs.FS, error) {
+//
+// Use Open to get an Image which can release its caches when closed.
+func EroFS(r io.ReaderAt, opts ...Option) (fs.FS, error) {
+	img, err := Open(r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// Open opens an erofs image from the given readerat configured with the
+// given options. The returned Image implements fs.FS and holds the caches
+// enabled by the options until it is closed.
+func Open(r io.ReaderAt, opts ...Option) (*Image, error) {
 	var superBlock [disk.SizeSuperBlock]byte
 	n, err := r.ReadAt(superBlock[:], disk.SuperBlockOffset)
 	if err != nil {
@@ -62,7 +109,7 @@ func EroFS(r io.ReaderAt) (fs.FS, error) {
 		return nil, fmt.Errorf("invalid super block: read %d bytes", n)
 	}
 
-	i := image{
+	i := Image{
 		meta: r,
 	}
 	if err = decodeSuperBlock(superBlock, &i.sb); err != nil {
@@ -77,29 +124,112 @@ func EroFS(r io.ReaderAt) (fs.FS, error) {
 			buf: make([]byte, 1<<i.sb.BlkSizeBits),
 		}
 	}
+	if err := i.loadDevices(); err != nil {
+		return nil, err
+	}
+	i.dentries = newLRU[dentryKey, dentry](DefaultDentryCacheSize)
+	i.inodes = newLRU[uint64, *fileInfo](DefaultInodeCacheSize)
+	for _, opt := range opts {
+		if err := opt(&i); err != nil {
+			return nil, err
+		}
+	}
+	if err := i.loadXattrPrefixes(); err != nil {
+		return nil, err
+	}
 
 	return &i, nil
 }
 
-type image struct {
+// Image is an opened erofs image, it implements fs.FS
+type Image struct {
 	sb disk.SuperBlock
 
 	meta    io.ReaderAt
 	blkPool sync.Pool
+	closed  atomic.Bool
+
+	// devices are the extra devices from the device table, flatDevices
+	// is set when all devices are mapped into the primary address space
+	devices     []device
+	flatDevices bool
+
+	// mapped is the memory mapped image when opened with OpenFile
+	mapped *mapping
+	// release is called on close to release resources owned by the image
+	release func() error
+
+	// readahead is the maximum readahead window for open files
+	readahead int64
+
+	// objects is the composefs object store file content is read from,
+	// verifyObjects checks objects against their fs-verity digest
+	objects       fs.FS
+	verifyObjects bool
+
+	// xattrPrefixes are the long xattr name prefixes, including the short
+	// prefix they extend
+	xattrPrefixes []string
+
+	// metaCache and dataCache hold recently read blocks by block number,
+	// nil when caching is disabled
+	metaCache *lru[int64, []byte]
+	dataCache *lru[int64, []byte]
+
+	// dentries and inodes cache path lookups and decoded inodes,
+	// nil when caching is disabled
+	dentries *lru[dentryKey, dentry]
+	inodes   *lru[uint64, *fileInfo]
 }
 
-func (img *image) blkOffset() int64 {
+// Close releases the pooled and cached blocks held by the image. The
+// readerat the image was opened with is not closed. Files may no longer
+// be opened after Close and reads from open files return fs.ErrClosed.
+func (img *Image) Close() error {
+	if img.closed.Swap(true) {
+		return nil
+	}
+	if img.metaCache != nil {
+		img.metaCache.purge()
+	}
+	if img.dataCache != nil {
+		img.dataCache.purge()
+	}
+	if img.dentries != nil {
+		img.dentries.purge()
+	}
+	if img.inodes != nil {
+		img.inodes.purge()
+	}
+	// Drain the pool so pooled blocks can be collected
+	newBlock := img.blkPool.New
+	img.blkPool.New = nil
+	for img.blkPool.Get() != nil {
+	}
+	img.blkPool.New = newBlock
+	if img.release != nil {
+		return img.release()
+	}
+	return nil
+}
+
+func (img *Image) blkOffset() int64 {
 	return int64(img.sb.MetaBlkAddr) << int64(img.sb.BlkSizeBits)
 }
 
-func (img *image) loadAt(addr, size int64) (*block, error) {
+// inodeAddr returns the byte address of the inode with the given nid
+func (img *Image) inodeAddr(nid uint64) int64 {
+	return img.blkOffset() + int64(nid*disk.SizeInodeCompact)
+}
+
+func (img *Image) loadAt(addr, size int64) (*block, error) {
 	blkSize := int64(1 << img.sb.BlkSizeBits)
 	if size > blkSize {
 		size = blkSize
 	}
 
 	b := img.getBlock()
-	if n, err := img.meta.ReadAt(b.buf[:size], addr); err != nil {
+	if n, err := img.readMeta(b.buf[:size], addr); err != nil {
 		img.putBlock(b)
 		return nil, fmt.Errorf("failed to read %d bytes at %d: %w", size, addr, err)
 	} else {
@@ -110,131 +240,312 @@ func (img *image) loadAt(addr, size int64) (*block, error) {
 	return b, nil
 }
 
-// loadBlock loads the block with the given data
-func (img *image) loadBlock(fi *fileInfo, pos int64) (*block, error) {
-	nblocks := calculateBlocks(img.sb.BlkSizeBits, fi.size)
-	bn := int(pos >> int(img.sb.BlkSizeBits))
-	if bn >= nblocks {
-		return nil, fmt.Errorf("block position larger than number of blocks for inode: %w", io.EOF)
+// maxExtentChunks limits how many physically contiguous chunks are merged
+// into a single extent when mapping chunk based inodes
+const maxExtentChunks = 1024
+
+// extent is a range of file data which is contiguous on disk
+type extent struct {
+	logical  int64  // offset of the extent within the file
+	physical int64  // byte address of the extent on the device, -1 for holes
+	length   int64  // number of bytes in the extent
+	device   uint16 // 0 for the primary image, otherwise the extra device
+}
+
+// mapExtent returns the extent containing the file position
+func (img *Image) mapExtent(fi *fileInfo, pos int64) (extent, error) {
+	if pos < 0 || pos >= fi.size {
+		return extent{}, fmt.Errorf("position %d outside of inode for nid %d: %w", pos, fi.inode, io.EOF)
 	}
-	var addr int64
-	blockSize := int(1 << img.sb.BlkSizeBits)
-	blockOffset := 0
-	blockEnd := blockSize
+	bits := img.sb.BlkSizeBits
+	blockSize := int64(1) << bits
 	switch fi.inodeLayout {
 	case disk.LayoutFlatPlain:
 		// flat plain has no holes
-		addr = int64(int(fi.inodeData)+bn) << img.sb.BlkSizeBits
-		if bn == nblocks-1 {
-			blockEnd = int(fi.size - int64(bn)*int64(1<<img.sb.BlkSizeBits))
-		}
+		return extent{
+			physical: int64(fi.inodeData) << bits,
+			length:   fi.size,
+		}, nil
 	case disk.LayoutFlatInline:
-		// If on the last block, validate
-		if bn == nblocks-1 {
-			addr = img.blkOffset() + int64(fi.inode*disk.SizeInodeCompact)
-			// Move to the data offset from the start of the inode
-			addr += fi.dataOffset()
-
-			// Get the ooffset from the start of the block
-			blockOffset = int(addr & int64(blockSize-1))
-			// Calculate end of block using data offset + tail data size
-			blockEnd = int(fi.size-int64(bn*blockSize)) + blockOffset
-
-			// Ensure the last block is not exceeded
-			if blockEnd > blockSize {
-				return nil, fmt.Errorf("inline data cross block boundary for nid %d: %w", fi.inode, ErrInvalid)
-			}
-			// Move the offset within the block based on position within file
-			blockOffset += int(pos - int64(bn<<int(img.sb.BlkSizeBits)))
-		} else {
-			addr = int64(int(fi.inodeData)+bn) << img.sb.BlkSizeBits
+		tailStart := int64(calculateBlocks(bits, fi.size)-1) << bits
+		if pos < tailStart {
+			return extent{
+				physical: int64(fi.inodeData) << bits,
+				length:   tailStart,
+			}, nil
+		}
+		addr := img.inodeAddr(fi.inode) + fi.dataOffset()
+		// Ensure the tail data does not cross the block boundary
+		if addr&(blockSize-1)+fi.size-tailStart > blockSize {
+			return extent{}, fmt.Errorf("inline data cross block boundary for nid %d: %w", fi.inode, ErrInvalid)
 		}
+		return extent{
+			logical:  tailStart,
+			physical: addr,
+			length:   fi.size - tailStart,
+		}, nil
 	case disk.LayoutChunkBased:
 		// first 2 le bytes for format, second 2 bytes are reserved
 		format := uint16(fi.inodeData)
 		if format&^(disk.LayoutChunkFormatBits|disk.LayoutChunkFormatIndexes) != 0 {
-			return nil, fmt.Errorf("unsupported chunk format %x for nid %d: %w", format, fi.inode, ErrInvalid)
-		}
-		if format&disk.LayoutChunkFormatIndexes == disk.LayoutChunkFormatIndexes {
-			return nil, fmt.Errorf("chunk format with indexes for nid %d: %w", fi.inode, ErrNotImplemented)
+			return extent{}, fmt.Errorf("unsupported chunk format %x for nid %d: %w", format, fi.inode, ErrInvalid)
 		}
-		chunkbits := img.sb.BlkSizeBits + uint8(format&disk.LayoutChunkFormatBits)
+		chunkbits := bits + uint8(format&disk.LayoutChunkFormatBits)
+		chunkSize := int64(1) << chunkbits
 		chunkn := int((fi.size-1)>>chunkbits) + 1
 		cn := int(pos >> chunkbits)
 
-		if cn >= chunkn {
-			return nil, fmt.Errorf("chunk format does not fit into allocated bytes for nid %d: %w", fi.inode, ErrInvalid)
-		}
-
-		if fi.cached == nil {
-			// TODO: actually load it, why would it not be here though
-			return nil, errors.New("inode block not cached")
+		t := img.newChunkTable(fi, min(chunkn, cn+maxExtentChunks))
+		defer t.close()
+		ext, err := t.extent(cn)
+		if err != nil {
+			return extent{}, err
 		}
-		buf := fi.cached.bytes()
-		// TODO: Or support indexes
-		dataOffset := fi.dataOffset() + int64(cn*4)
-		if len(buf) < int(dataOffset)+4 {
-			return nil, fmt.Errorf("invalid chunk data for nid %d: %w", fi.inode, ErrInvalid)
+		ext.logical = int64(cn) << chunkbits
+		ext.length = min(chunkSize, fi.size-ext.logical)
+
+		// Merge following chunks which are contiguous on disk
+		for next := cn + 1; next < t.end; next++ {
+			chunk, err := t.extent(next)
+			if err != nil {
+				return extent{}, err
+			}
+			if chunk.device != ext.device {
+				break
+			}
+			if ext.physical == -1 {
+				if chunk.physical != -1 {
+					break
+				}
+			} else if chunk.physical != ext.physical+ext.length {
+				break
+			}
+			ext.length += min(chunkSize, fi.size-ext.logical-ext.length)
 		}
-		var rawAddr int32
-		if _, err := binary.Decode(buf[dataOffset:dataOffset+4], binary.LittleEndian, &rawAddr); err != nil {
-			return nil, err
+		return ext, nil
+	case disk.LayoutCompressedFull, disk.LayoutCompressedCompact:
+		return extent{}, fmt.Errorf("inode layout (%d) for %d: %w", fi.inodeLayout, fi.inode, ErrNotImplemented)
+	default:
+		return extent{}, fmt.Errorf("inode layout (%d) for %d: %w", fi.inodeLayout, fi.inode, ErrInvalid)
+	}
+}
+
+// chunkTable reads the chunk table of a chunk based inode. Entries are
+// taken from the cached inode block when possible, otherwise they are read
+// up to the end of the metadata block holding the requested entry.
+type chunkTable struct {
+	img     *Image
+	fi      *fileInfo
+	indexes bool
+	unit    int64
+	start   int64 // byte address of the first table entry
+	end     int   // number of chunks which may be read
+
+	first   int    // chunk number of the first entry in entries
+	entries []byte // table entries loaded from first
+	blk     *block // block holding entries read from the image
+}
+
+func (img *Image) newChunkTable(fi *fileInfo, end int) *chunkTable {
+	t := &chunkTable{
+		img:     img,
+		fi:      fi,
+		indexes: uint16(fi.inodeData)&disk.LayoutChunkFormatIndexes != 0,
+		unit:    disk.SizeChunkAddr,
+		end:     end,
+	}
+	if t.indexes {
+		t.unit = disk.SizeChunkIndex
+	}
+	// The table is aligned to the entry size from the start of the inode
+	t.start = (img.inodeAddr(fi.inode) + fi.dataOffset() + t.unit - 1) / t.unit * t.unit
+	return t
+}
+
+// load reads the table entries starting at chunk cn
+func (t *chunkTable) load(cn int) error {
+	pos := t.start + int64(cn)*t.unit
+	size := int64(t.end-cn) * t.unit
+
+	dataOffset := pos - t.img.inodeAddr(t.fi.inode)
+	if t.fi.cached != nil {
+		if buf := t.fi.cached.bytes(); int64(len(buf)) >= dataOffset+t.unit {
+			buf = buf[dataOffset:]
+			t.first = cn
+			t.entries = buf[:min(int64(len(buf))/t.unit*t.unit, size)]
+			return nil
 		}
+	}
 
-		if bn == nblocks-1 {
-			blockEnd = int(fi.size - int64(bn)*int64(1<<img.sb.BlkSizeBits))
+	blkSize := int64(1) << t.img.sb.BlkSizeBits
+	size = min(size, blkSize-pos&(blkSize-1))
+	if t.blk == nil {
+		t.blk = t.img.getBlock()
+	}
+	n, err := t.img.readMeta(t.blk.buf[:size], pos)
+	if n < int(t.unit) {
+		if err == nil || errors.Is(err, io.EOF) {
+			err = fmt.Errorf("short read of %d bytes: %w", n, ErrInvalid)
 		}
+		return fmt.Errorf("failed to read chunk table for nid %d: %w", t.fi.inode, err)
+	}
+	t.first = cn
+	t.entries = t.blk.buf[:int64(n)/t.unit*t.unit]
+	return nil
+}
 
-		if rawAddr == -1 {
-			// Null address, return new zero filled block
-			return &block{
-				buf: make([]byte, 1<<img.sb.BlkSizeBits),
-				end: int32(blockEnd),
-			}, nil
+// extent returns the physical location of chunk cn, the physical address
+// is -1 for chunks which are not allocated
+func (t *chunkTable) extent(cn int) (extent, error) {
+	i := int64(cn-t.first) * t.unit
+	if cn < t.first || i+t.unit > int64(len(t.entries)) {
+		if err := t.load(cn); err != nil {
+			return extent{}, err
 		}
+		i = 0
+	}
+	buf := t.entries[i : i+t.unit]
 
-		// Add block offset within chunk
-		if pos > 0 {
-			rawAddr += int32((pos - int64(cn<<chunkbits)) >> img.sb.BlkSizeBits)
+	ext := extent{physical: -1}
+	if t.indexes {
+		var idx disk.ChunkIndex
+		if _, err := binary.Decode(buf, binary.LittleEndian, &idx); err != nil {
+			return extent{}, err
+		}
+		if idx.BlkAddr != disk.NullAddr {
+			ext.physical = int64(idx.BlkAddr) << t.img.sb.BlkSizeBits
+			ext.device = idx.DeviceID
 		}
+		return ext, t.img.mapDevice(&ext)
+	}
+	if rawAddr := binary.LittleEndian.Uint32(buf); rawAddr != disk.NullAddr {
+		ext.physical = int64(rawAddr) << t.img.sb.BlkSizeBits
+	}
+	return ext, nil
+}
 
-		addr = int64(rawAddr) << int64(img.sb.BlkSizeBits)
-	case disk.LayoutCompressedFull, disk.LayoutCompressedCompact:
-		return nil, fmt.Errorf("inode layout (%d) for %d: %w", fi.inodeLayout, fi.inode, ErrNotImplemented)
-	default:
-		return nil, fmt.Errorf("inode layout (%d) for %d: %w", fi.inodeLayout, fi.inode, ErrInvalid)
+// close returns the block used to read the table
+func (t *chunkTable) close() {
+	if t.blk != nil {
+		t.img.putBlock(t.blk)
+		t.blk = nil
+	}
+}
+
+// mapCached returns the extent containing the file position like
+// mapExtent, reusing last when it contains the position. The mapped extent
+// is stored in last so sequential reads map each extent once.
+func (img *Image) mapCached(fi *fileInfo, pos int64, last *extent) (extent, error) {
+	if last == nil {
+		return img.mapExtent(fi, pos)
+	}
+	if pos >= last.logical && pos < last.logical+last.length {
+		return *last, nil
+	}
+	ext, err := img.mapExtent(fi, pos)
+	if err != nil {
+		return extent{}, err
+	}
+	*last = ext
+	return ext, nil
+}
+
+// loadBlock loads the block containing the given file position, the
+// returned block starts at the position
+func (img *Image) loadBlock(fi *fileInfo, pos int64) (*block, error) {
+	nblocks := calculateBlocks(img.sb.BlkSizeBits, fi.size)
+	bn := int(pos >> int(img.sb.BlkSizeBits))
+	if bn >= nblocks {
+		return nil, fmt.Errorf("block position larger than number of blocks for inode: %w", io.EOF)
 	}
-	if blockOffset >= blockEnd {
-		return nil, fmt.Errorf("no remaining items in block: %w", io.EOF)
+	ext, err := img.mapExtent(fi, pos)
+	if err != nil {
+		return nil, err
 	}
 
+	blockStart := int64(bn) << img.sb.BlkSizeBits
+	blockEnd := int(min(fi.size-blockStart, int64(1)<<img.sb.BlkSizeBits))
+
 	b := img.getBlock()
-	if n, err := img.meta.ReadAt(b.buf[blockOffset:blockEnd], addr); err != nil {
+	if ext.physical == -1 {
+		// Null address, return zero filled block
+		clear(b.buf[:blockEnd])
+	} else if n, err := img.readBlock(ext, b.buf[:blockEnd], ext.physical+blockStart-ext.logical); n != blockEnd {
+		img.putBlock(b)
+		if err == nil {
+			err = ErrInvalid
+		}
 		return nil, fmt.Errorf("failed to read block for nid %d: %w", fi.inode, err)
-	} else if n != (blockEnd - blockOffset) {
-		return nil, fmt.Errorf("failed to read full block for nid %d: %w", fi.inode, ErrInvalid)
 	}
-	b.offset = int32(blockOffset)
+	b.offset = int32(pos - blockStart)
 	b.end = int32(blockEnd)
 
 	return b, nil
 }
 
-func (img *image) getBlock() *block {
+// readBlock reads directory data through the metadata cache
+func (img *Image) readBlock(ext extent, p []byte, off int64) (int, error) {
+	if ext.device != 0 {
+		return img.readDevice(ext.device, p, off)
+	}
+	return img.readMeta(p, off)
+}
+
+// readAt reads file data at off into p. Each range of the file which is
+// contiguous on disk is read directly into p with a single read. When last
+// is not nil it holds the last extent mapped for the file.
+func (img *Image) readAt(fi *fileInfo, p []byte, off int64, last *extent) (int, error) {
+	if off >= fi.size {
+		return 0, io.EOF
+	}
+	var eof bool
+	if remaining := fi.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		eof = true
+	}
+
+	var n int
+	for n < len(p) {
+		ext, err := img.mapCached(fi, off, last)
+		if err != nil {
+			return n, err
+		}
+		l := int(min(int64(len(p)-n), ext.logical+ext.length-off))
+		if ext.physical == -1 {
+			clear(p[n : n+l])
+		} else if rn, err := img.readDevice(ext.device, p[n:n+l], ext.physical+off-ext.logical); rn != l {
+			if err == nil || errors.Is(err, io.EOF) {
+				err = fmt.Errorf("short read of %d bytes: %w", rn, ErrInvalid)
+			}
+			return n + rn, fmt.Errorf("failed to read data for nid %d: %w", fi.inode, err)
+		}
+		n += l
+		off += int64(l)
+	}
+	if eof {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (img *Image) getBlock() *block {
 	return img.blkPool.Get().(*block)
 }
 
 // putBlock returns a block after complete so its
 // buffer can be put back into the buffer pool
-func (img *image) putBlock(b *block) {
+func (img *Image) putBlock(b *block) {
 	img.blkPool.Put(b)
 }
 
-func (i *image) dirEntry(nid uint64, name string) (uint64, fs.FileMode, error) {
+func (i *Image) dirEntry(nid uint64, name string) (uint64, fs.FileMode, error) {
 	return 0, 0, errors.New("direntry: not implemented")
 }
 
-func (i *image) Open(name string) (fs.File, error) {
+func (i *Image) Open(name string) (fs.File, error) {
+	if i.closed.Load() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrClosed}
+	}
 	var err error
 	original := name
 	if filepath.IsAbs(name) {
@@ -271,25 +582,32 @@ func (i *image) Open(name string) (fs.File, error) {
 			// TODO: Path error
 			return nil, errors.New("not a directory")
 		}
-		dir := &dir{
-			file: file{
+		if de, ok := i.lookupDentry(nid, basename); ok {
+			nid = de.nid
+			ftype = de.ftype
+			parent = basename
+			continue
+		}
+		d := &Dir{
+			File: File{
 				img:   i,
 				name:  parent,
 				inode: nid,
 				ftype: ftype,
 			},
 		}
-		// TODO: Lookup in directory instead of reading all
-		entries, err := dir.ReadDir(-1)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read dir: %w", err)
-		}
+		// TODO: Binary search directory blocks instead of scanning
 		var found bool
-		for _, e := range entries {
+		for e, err := range d.Entries() {
+			if err != nil {
+				return nil, fmt.Errorf("failed to read dir: %w", err)
+			}
 			if e.Name() == basename {
-				nid = uint64(e.(*direntry).file.inode)
-				ftype = e.(*direntry).file.ftype & fs.ModeType
+				i.cacheDentry(nid, basename, e.Nid(), e.Type()&fs.ModeType)
+				nid = e.Nid()
+				ftype = e.Type() & fs.ModeType
 				found = true
+				break
 			}
 		}
 		if !found {
@@ -302,36 +620,52 @@ func (i *image) Open(name string) (fs.File, error) {
 		basename = original
 	}
 
-	b := file{
+	b := File{
 		img:   i,
 		name:  basename,
 		inode: nid,
 		ftype: ftype,
 	}
 	if ftype.IsDir() {
-		return &dir{file: b}, nil
+		return &Dir{File: b}, nil
 	}
 
 	return &b, nil
 }
 
-type file struct {
-	img   *image
+// File is an open file in an erofs image, it implements fs.File
+type File struct {
+	img   *Image
 	name  string
 	inode uint64
 	ftype fs.FileMode
 
 	// Mutable fields, open file should not be accessed concurrently
-	offset int64     // current offset for read operations
-	info   *fileInfo // cached fileInfo
+	offset int64      // current offset for read operations
+	info   *fileInfo  // cached fileInfo
+	ra     *readahead // readahead state, nil until first read when enabled
+	ext    extent     // last extent mapped for reads, empty until read
+
+	// object holds the content of composefs files, objectChecked is set
+	// once the file was checked for an object
+	object        *object
+	objectChecked bool
+
+	// mapRef is set when the file holds a reference on the memory
+	// mapped image for slices returned by Bytes
+	mapRef bool
 }
 
-func (b *file) readInfo(infoOnly bool) (fi *fileInfo, err error) {
-	if b.info != nil {
+func (b *File) readInfo(infoOnly bool) (fi *fileInfo, err error) {
+	if b.info != nil && (!infoOnly || b.info.stat != nil) {
 		return b.info, nil
 	}
+	if fi := b.img.cachedInfo(b.inode, b.name, infoOnly); fi != nil {
+		b.info = fi
+		return fi, nil
+	}
 
-	addr := b.img.blkOffset() + int64(b.inode*disk.SizeInodeCompact)
+	addr := b.img.inodeAddr(b.inode)
 	blkSize := int32(1 << b.img.sb.BlkSizeBits)
 	blk := b.img.getBlock()
 	blk.offset = int32(addr & int64(blkSize-1))
@@ -342,12 +676,22 @@ func (b *file) readInfo(infoOnly bool) (fi *fileInfo, err error) {
 		blk.offset = 0
 		blk.end = disk.SizeInodeExtended
 	}
-	ino := blk.bytes()
-	_, err = b.img.meta.ReadAt(ino, addr)
+	_, err = b.img.readMeta(blk.bytes(), addr)
 	if err != nil {
+		b.img.putBlock(blk)
 		return nil, err
 	}
 
+	return b.decodeInfo(addr, blk, infoOnly)
+}
+
+// decodeInfo decodes the inode at addr from blk and caches the result.
+// The block must either hold the block containing the inode at the same
+// offset as on disk or hold the inode starting at offset 0.
+func (b *File) decodeInfo(addr int64, blk *block, infoOnly bool) (fi *fileInfo, err error) {
+	blkSize := int32(1 << b.img.sb.BlkSizeBits)
+	ino := blk.bytes()
+
 	defer func() {
 		v := recover()
 		if v != nil {
@@ -374,9 +718,10 @@ func (b *file) readInfo(infoOnly bool) (fi *fileInfo, err error) {
 			inodeLayout: layout,
 			inodeData:   inode.InodeData,
 			size:        int64(inode.Size),
-			mode:        (fs.FileMode(inode.Mode) & ^fs.ModeType) | b.ftype,
-			//modTime: time.Unix(int64(inode.Mtime), int64(inode.MtimeNs)),
-			// TODO: Set mtime to zero value?
+			mode:        disk.EroFSModeToGoFileMode(inode.Mode),
+			// Compact inodes do not store a modification time, the
+			// build time from the super block is used instead
+			modTime: time.Unix(int64(b.img.sb.BuildTime), int64(b.img.sb.BuildTimeNs)),
 		}
 		if inode.XattrCount > 0 {
 			b.info.xsize = int(inode.XattrCount-1)*disk.SizeXattrEntry + disk.SizeXattrBodyHeader
@@ -391,8 +736,8 @@ func (b *file) readInfo(infoOnly bool) (fi *fileInfo, err error) {
 				UID:         uint32(inode.UID),
 				GID:         uint32(inode.GID),
 				Nlink:       int(inode.Nlink),
-				//Mtime        uint64
-				//MtimeNs      uint32
+				Mtime:       b.img.sb.BuildTime,
+				MtimeNs:     b.img.sb.BuildTimeNs,
 			}
 		}
 		addr += disk.SizeInodeCompact
@@ -408,7 +753,7 @@ func (b *file) readInfo(infoOnly bool) (fi *fileInfo, err error) {
 			inodeLayout: layout,
 			inodeData:   inode.InodeData,
 			size:        int64(inode.Size),
-			mode:        (fs.FileMode(inode.Mode) & ^fs.ModeType) | b.ftype,
+			mode:        disk.EroFSModeToGoFileMode(inode.Mode),
 			modTime:     time.Unix(int64(inode.Mtime), int64(inode.MtimeNs)),
 		}
 		if inode.XattrCount > 0 {
@@ -441,50 +786,81 @@ func (b *file) readInfo(infoOnly bool) (fi *fileInfo, err error) {
 		// If the inode has trailing data used later, cache it
 		b.info.cached = blk
 	}
+	b.img.cacheInfo(b.info)
 	return b.info, nil
 }
 
-func (b *file) Stat() (fs.FileInfo, error) {
+func (b *File) Stat() (fs.FileInfo, error) {
 	return b.readInfo(true)
 }
 
-func (b *file) Read(p []byte) (int, error) {
+func (b *File) Read(p []byte) (int, error) {
+	if b.img.closed.Load() {
+		return 0, &fs.PathError{Op: "read", Path: b.name, Err: fs.ErrClosed}
+	}
 	fi, err := b.readInfo(false)
 	if err != nil {
 		return 0, err
 	}
+	if obj, err := b.openObject(); err != nil {
+		return 0, err
+	} else if obj != nil {
+		return b.readObject(obj, fi, p)
+	}
+
+	if b.img.readahead > 0 && b.ra == nil {
+		b.ra = newReadahead(b.img, fi, &b.ext)
+	}
 
 	var n int
-	for len(p) > 0 {
-		if b.offset >= fi.size {
-			return n, io.EOF
-		}
-		blk, err := b.img.loadBlock(fi, b.offset)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				err = io.EOF
-				b.offset += int64(n)
-			}
-			return n, err
-		}
-		buf := blk.bytes()
-		copied := copy(p, buf)
-		n += copied
-		p = p[copied:]
-		b.offset += int64(copied)
+	if b.ra != nil {
+		n, err = b.ra.readAt(p, b.offset)
+	} else {
+		n, err = b.img.readAt(fi, p, b.offset, &b.ext)
+	}
+	b.offset += int64(n)
+	return n, err
+}
 
-		b.img.putBlock(blk)
+func (b *File) Close() error {
+	if b.ra != nil {
+		b.ra.close()
+		b.ra = nil
 	}
-	return n, nil
+	if b.info != nil {
+		b.info.cached = nil
+	}
+	// Every resource is released, the first error is returned
+	var err error
+	if b.mapRef {
+		b.mapRef = false
+		err = b.img.mapped.release()
+	}
+	if b.object != nil {
+		if cerr := b.object.f.Close(); err == nil {
+			err = cerr
+		}
+		b.object, b.objectChecked = nil, false
+	}
+	return err
 }
 
-func (b *file) Close() error {
-	b.info.cached = nil
-	return nil
+// DirEntry is a directory entry read from an erofs image. In addition to
+// the fs.DirEntry methods, it exposes the node id of the referenced inode.
+type DirEntry interface {
+	fs.DirEntry
+
+	// Nid returns the node id of the inode the entry refers to. Entries
+	// with the same node id are hardlinks to the same inode.
+	Nid() uint64
 }
 
 type direntry struct {
-	file
+	File
+}
+
+func (d *direntry) Nid() uint64 {
+	return d.inode
 }
 
 func (d *direntry) Name() string {
@@ -503,8 +879,10 @@ func (d *direntry) Info() (fs.FileInfo, error) {
 	return d.readInfo(true)
 }
 
-type dir struct {
-	file
+// Dir is an open directory in an erofs image. In addition to
+// fs.ReadDirFile, it provides streaming iteration over its entries.
+type Dir struct {
+	File
 
 	//bn is the current block to read from (relative to file start)
 	bn int
@@ -513,7 +891,7 @@ type dir struct {
 	consumed uint16
 }
 
-func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+func (d *Dir) ReadDir(n int) ([]fs.DirEntry, error) {
 	fi, err := d.readInfo(false)
 	if err != nil {
 		return nil, fmt.Errorf("readInfo failed: %w", err)
@@ -525,72 +903,138 @@ func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
 		b, err := d.img.loadBlock(fi, pos)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				return ents, nil
+				break
+			}
+			return nil, err
+		}
+		entryN, err := readDirents(b.bytes(), func(i uint16, de *disk.Dirent, name string) bool {
+			if i < d.consumed || name == "." || name == ".." {
+				return true
 			}
+			ents = append(ents, d.entry(de, name))
+			d.consumed = i + 1
+			return n <= 0 || len(ents) < n
+		})
+		d.img.putBlock(b)
+		if err != nil {
 			return nil, err
 		}
-		buf := b.bytes()
-		if len(buf) < 12 {
+
+		if d.consumed < entryN && n > 0 && len(ents) == n {
+			return ents, nil
+		}
+		d.consumed = 0
+		d.bn++
+		if n > 0 && len(ents) == n {
 			return ents, nil
 		}
+		pos = int64(d.bn << d.img.sb.BlkSizeBits)
+	}
 
-		var dirents [2]disk.Dirent
+	if n > 0 && len(ents) == 0 {
+		return nil, io.EOF
+	}
+	return ents, nil
+}
 
-		readN, err := binary.Decode(buf[:12], binary.LittleEndian, &dirents[0])
+// Entries returns an iterator over the entries in the directory, excluding
+// "." and "..". Directory blocks are decoded one at a time in on-disk order,
+// which is sorted by name, without collecting the entries into a slice.
+// Iteration always starts from the beginning of the directory and does not
+// change the position used by ReadDir.
+func (d *Dir) Entries() iter.Seq2[DirEntry, error] {
+	return func(yield func(DirEntry, error) bool) {
+		fi, err := d.readInfo(false)
 		if err != nil {
-			return nil, fmt.Errorf("decode failed: %w", err)
-		}
-		if readN != 12 {
-			return nil, errors.New("invalid dirent: not fully decoded")
+			yield(nil, fmt.Errorf("readInfo failed: %w", err))
+			return
 		}
 
-		entryN := dirents[0].NameOff / disk.SizeDirent
-
-		for i := uint16(0); i < entryN; i++ {
-			var name string
-			if i < entryN-1 {
-				start := 12 * (i + 1)
-				readN, err := binary.Decode(buf[start:start+12], binary.LittleEndian, &dirents[1])
-				if err != nil {
-					return nil, fmt.Errorf("decode failed: %w", err)
+		blkSize := int64(1 << d.img.sb.BlkSizeBits)
+		for pos := int64(0); pos < fi.size; pos += blkSize {
+			b, err := d.img.loadBlock(fi, pos)
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					yield(nil, err)
 				}
-				if readN != 12 {
-					return nil, errors.New("invalid dirent: not fully decoded")
-				}
-				name = string(buf[dirents[0].NameOff:dirents[1].NameOff])
-			} else {
-				name = string(buf[dirents[0].NameOff:])
+				return
 			}
-
-			if i >= d.consumed && name != "." && name != ".." {
-				b := file{
-					img:   d.file.img,
-					name:  name,
-					inode: dirents[0].Nid,
-					ftype: disk.EroFSFtypeToFileMode(dirents[0].FileType),
-				}
-				ents = append(ents, &direntry{b})
-				d.consumed = i + 1
-
-				if n > 0 && len(ents) == n {
-					if i == entryN-1 {
-						d.consumed = 0
-						d.bn++
-					}
-					return ents, nil
+			more := true
+			_, err = readDirents(b.bytes(), func(_ uint16, de *disk.Dirent, name string) bool {
+				if name == "." || name == ".." {
+					return true
 				}
+				more = yield(d.entry(de, name), nil)
+				return more
+			})
+			d.img.putBlock(b)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !more {
+				return
 			}
-
-			// Rotate next to current
-			dirents[0] = dirents[1]
 		}
+	}
+}
 
-		d.consumed = 0
-		d.bn++
-		pos = int64(d.bn << d.img.sb.BlkSizeBits)
+func (d *Dir) entry(de *disk.Dirent, name string) *direntry {
+	return &direntry{
+		File: File{
+			img:   d.img,
+			name:  name,
+			inode: de.Nid,
+			ftype: disk.EroFSFtypeToFileMode(de.FileType),
+		},
 	}
+}
 
-	return ents, nil
+// readDirents decodes the entries of a single directory block, calling fn
+// with the index, dirent and name of each entry until fn returns false.
+// The total number of entries in the block is returned.
+func readDirents(buf []byte, fn func(i uint16, de *disk.Dirent, name string) bool) (uint16, error) {
+	if len(buf) < disk.SizeDirent {
+		return 0, nil
+	}
+
+	var dirents [2]disk.Dirent
+	if _, err := binary.Decode(buf[:disk.SizeDirent], binary.LittleEndian, &dirents[0]); err != nil {
+		return 0, fmt.Errorf("decode failed: %w", err)
+	}
+
+	entryN := dirents[0].NameOff / disk.SizeDirent
+	if entryN == 0 || int(dirents[0].NameOff) > len(buf) {
+		return 0, fmt.Errorf("invalid dirent name offset %d: %w", dirents[0].NameOff, ErrInvalid)
+	}
+
+	for i := uint16(0); i < entryN; i++ {
+		end := len(buf)
+		if i < entryN-1 {
+			start := disk.SizeDirent * (i + 1)
+			if _, err := binary.Decode(buf[start:start+disk.SizeDirent], binary.LittleEndian, &dirents[1]); err != nil {
+				return 0, fmt.Errorf("decode failed: %w", err)
+			}
+			end = int(dirents[1].NameOff)
+		}
+		if int(dirents[0].NameOff) > end || end > len(buf) {
+			return 0, fmt.Errorf("invalid dirent name offset %d: %w", dirents[0].NameOff, ErrInvalid)
+		}
+		name := buf[dirents[0].NameOff:end]
+		if i == entryN-1 {
+			// The last name in a block may be padded with zeros
+			if nul := bytes.IndexByte(name, 0); nul >= 0 {
+				name = name[:nul]
+			}
+		}
+		if !fn(i, &dirents[0], string(name)) {
+			return entryN, nil
+		}
+
+		// Rotate next to current
+		dirents[0] = dirents[1]
+	}
+	return entryN, nil
 }
 
 type fileInfo struct {
@@ -605,6 +1049,10 @@ type fileInfo struct {
 	modTime     time.Time
 	stat        *Stat
 	cached      *block
+
+	// overlay holds the trusted overlay xattrs of composefs files without
+	// the prefix, moved out of the stat when reading with an object store
+	overlay map[string]string
 }
 
 func (fi *fileInfo) Name() string {
@@ -2,11 +2,19 @@ package erofs
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"io"
 	"io/fs"
+	"maps"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
 	"testing"
+	"testing/iotest"
+
+	"github.com/erofs/go-erofs/internal/disk"
 )
 
 func TestBasic(t *testing.T) {
@@ -210,3 +218,351 @@ func checkXattrs(t testing.TB, fsys fs.FS, name string, expected map[string]stri
 		}
 	}
 }
+
+func TestRead(t *testing.T) {
+	for _, name := range []string{
+		"default",
+		"chunk-4096",
+		"chunk-8192",
+	} {
+		t.Run(name, func(t *testing.T) {
+			efs, err := EroFS(loadTestFile(t, "basic-"+name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for fname, content := range map[string][]byte{
+				"/in-root.txt":                      []byte("root file content\n"),
+				"/usr/lib/testdir/13k-zeros.raw":    bytes.Repeat([]byte{0}, 1024*13),
+				"/usr/lib/testdir/5k-sequence.raw":  bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 128*5),
+				"/usr/lib/testdir/16k-sequence.raw": bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 128*16),
+				"/usr/lib/testdir/CASE/file.txt":    []byte("upper case dir\n"),
+			} {
+				f, err := efs.Open(fname)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := iotest.TestReader(f, content); err != nil {
+					t.Errorf("%s: %v", fname, err)
+				}
+				f.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkReadSequential(b *testing.B) {
+	const size = 1 << 30
+	efs, err := EroFS(flatFileImage(b, size))
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]byte, 1<<20)
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := efs.Open("/file")
+		if err != nil {
+			b.Fatal(err)
+		}
+		var n int64
+		for {
+			rn, err := f.Read(buf)
+			n += int64(rn)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+		if n != size {
+			b.Fatalf("unexpected read size %d", n)
+		}
+		f.Close()
+	}
+}
+
+func BenchmarkReadChunked(b *testing.B) {
+	const size = 64 << 20
+	r := &countingReaderAt{ReaderAt: chunkFileImage(b, size)}
+	efs, err := EroFS(r)
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]byte, 32<<10)
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := efs.Open("/file")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.CopyBuffer(struct{ io.Writer }{io.Discard}, struct{ io.Reader }{f}, buf); err != nil {
+			b.Fatal(err)
+		}
+		f.Close()
+	}
+	b.ReportMetric(float64(r.reads.Load())/float64(b.N), "reads/op")
+}
+
+func TestReadChunkedReads(t *testing.T) {
+	const size = 64 << 20
+	r := &countingReaderAt{ReaderAt: chunkFileImage(t, size)}
+	efs, err := EroFS(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := efs.Open("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r.reads.Store(0)
+
+	// Each read is a single data read, the chunk table is read once per
+	// merged extent
+	const bufSize = 32 << 10
+	n, err := io.CopyBuffer(struct{ io.Writer }{io.Discard}, struct{ io.Reader }{f}, make([]byte, bufSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != size {
+		t.Fatalf("unexpected read size %d", n)
+	}
+	if reads, limit := r.reads.Load(), int64(size/bufSize+64); reads > limit {
+		t.Errorf("expected at most %d reads, got %d", limit, reads)
+	}
+}
+
+// chunkFileImage creates a sparse image file containing a single chunk
+// based file named "file" of the given size with 4k chunks which are
+// contiguous on disk
+func chunkFileImage(t testing.TB, size int64) io.ReaderAt {
+	t.Helper()
+
+	const blkBits = 12
+	chunks := calculateBlocks(blkBits, size)
+	// The chunk table follows the inode in the metadata blocks, data
+	// starts in the block after it
+	start := uint32(calculateBlocks(blkBits, 5*disk.SizeInodeCompact+disk.SizeInodeExtended+int64(chunks)*disk.SizeChunkAddr)) + 2
+	ibody := make([]byte, chunks*disk.SizeChunkAddr)
+	for i := range chunks {
+		binary.LittleEndian.PutUint32(ibody[i*disk.SizeChunkAddr:], start+uint32(i))
+	}
+	return fileImage(t, disk.InodeExtended{
+		Format: disk.LayoutChunkBased<<1 | 1,
+		Mode:   disk.StatTypeReg | 0644,
+		Size:   uint64(size),
+		Inode:  1,
+		Nlink:  1,
+	}, ibody, nil, int64(start)<<blkBits+size)
+}
+
+// flatFileImage creates a sparse image file containing a single flat plain
+// file named "file" of the given size in the root directory
+func flatFileImage(t testing.TB, size int64) io.ReaderAt {
+	t.Helper()
+
+	return fileImage(t, disk.InodeExtended{
+		Format:    disk.LayoutFlatPlain<<1 | 1,
+		Mode:      disk.StatTypeReg | 0644,
+		Size:      uint64(size),
+		InodeData: 2,
+		Inode:     1,
+		Nlink:     1,
+	}, nil, nil, 2<<12+size)
+}
+
+// fileImage creates an image with 4k blocks holding a root directory at nid 0
+// and a file named "file" at nid 4 with the given inode, followed by ibody.
+// The metadata is in block 1 and the image is extended to size bytes.
+func fileImage(t testing.TB, ino disk.InodeExtended, ibody []byte, devs []disk.DeviceSlot, size int64) io.ReaderAt {
+	t.Helper()
+
+	const blkBits = 12
+	var (
+		meta [1 << blkBits]byte
+		w    = bytes.NewBuffer(meta[:0])
+	)
+	// Root directory at nid 0 with inline dirents
+	dirents := []disk.Dirent{
+		{Nid: 0, NameOff: 36, FileType: disk.FileTypeDir},
+		{Nid: 0, NameOff: 37, FileType: disk.FileTypeDir},
+		{Nid: 4, NameOff: 39, FileType: disk.FileTypeReg},
+	}
+	names := "...file"
+	binary.Write(w, binary.LittleEndian, disk.InodeExtended{
+		Format: disk.LayoutFlatInline<<1 | 1,
+		Mode:   disk.StatTypeDir | 0755,
+		Size:   uint64(len(dirents)*disk.SizeDirent + len(names)),
+		Nlink:  2,
+	})
+	binary.Write(w, binary.LittleEndian, dirents)
+	w.WriteString(names)
+	w.Write(make([]byte, 4*disk.SizeInodeCompact-w.Len()))
+	binary.Write(w, binary.LittleEndian, ino)
+	w.Write(ibody)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "file.erofs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.Close()
+	})
+	sb := disk.SuperBlock{
+		MagicNumber:  disk.MagicNumber,
+		BlkSizeBits:  blkBits,
+		Inos:         2,
+		Blocks:       uint32(calculateBlocks(blkBits, size)),
+		MetaBlkAddr:  1,
+		ExtraDevices: uint16(len(devs)),
+	}
+	var sbuf bytes.Buffer
+	binary.Write(&sbuf, binary.LittleEndian, sb)
+	if len(devs) > 0 {
+		// Device table directly follows the super block
+		sb.DevtSlotOff = uint16((disk.SuperBlockOffset + sbuf.Len()) / disk.SizeDeviceSlot)
+		sbuf.Reset()
+		binary.Write(&sbuf, binary.LittleEndian, sb)
+		binary.Write(&sbuf, binary.LittleEndian, devs)
+	}
+	if _, err := f.WriteAt(sbuf.Bytes(), disk.SuperBlockOffset); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(w.Bytes(), 1<<blkBits); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// testEntry is a file in an image created by testImage
+type testEntry struct {
+	path string
+	mode uint16 // file type and permission bits as stored in the inode
+	data string // content of regular files and the target of symlinks
+	link string // path of an earlier entry this entry is a hardlink to
+}
+
+// testImage creates an image with 4k blocks holding the given entries in
+// compact inodes, with all directory entries and file data stored inline.
+// Parent directories must be listed before their entries.
+func testImage(t testing.TB, entries []testEntry) io.ReaderAt {
+	t.Helper()
+
+	const blkSize = 4096
+	type node struct {
+		testEntry
+		nid      uint64
+		nlink    int
+		inline   []byte
+		children map[string]*node
+	}
+	root := &node{testEntry: testEntry{mode: disk.StatTypeDir | 0o755}, nlink: 2, children: map[string]*node{}}
+	nodes := []*node{root}
+	paths := map[string]*node{".": root}
+	for _, e := range entries {
+		parent := paths[path.Dir(e.path)]
+		if parent == nil || parent.children == nil {
+			t.Fatalf("no parent directory for %s", e.path)
+		}
+		name := path.Base(e.path)
+		if e.link != "" {
+			target := paths[e.link]
+			target.nlink++
+			parent.children[name] = target
+			continue
+		}
+		n := &node{testEntry: e, nlink: 1}
+		if e.mode&disk.StatTypeMask == disk.StatTypeDir {
+			n.nlink = 2
+			n.children = map[string]*node{".": n, "..": parent}
+			parent.nlink++
+		}
+		parent.children[name] = n
+		paths[e.path] = n
+		nodes = append(nodes, n)
+	}
+	root.children[".."] = root
+
+	// Directory sizes only depend on the names, place all inodes first
+	var pos int64
+	for _, n := range nodes {
+		size := int64(len(n.data))
+		if n.children != nil {
+			size = 0
+			for name := range n.children {
+				size += disk.SizeDirent + int64(len(name))
+			}
+		}
+		if size > blkSize-disk.SizeInodeCompact {
+			t.Fatalf("inline data of %s does not fit in a block", n.path)
+		}
+		if pos%blkSize+disk.SizeInodeCompact+size > blkSize {
+			pos = (pos + blkSize - 1) / blkSize * blkSize
+		}
+		n.nid = uint64(pos / disk.SizeInodeCompact)
+		n.inline = make([]byte, size)
+		pos = (pos + disk.SizeInodeCompact + size + disk.SizeInodeCompact - 1) / disk.SizeInodeCompact * disk.SizeInodeCompact
+	}
+
+	ftypes := map[uint16]uint8{
+		disk.StatTypeReg:     disk.FileTypeReg,
+		disk.StatTypeDir:     disk.FileTypeDir,
+		disk.StatTypeChrdev:  disk.FileTypeChrdev,
+		disk.StatTypeBlkdev:  disk.FileTypeBlkdev,
+		disk.StatTypeFifo:    disk.FileTypeFifo,
+		disk.StatTypeSock:    disk.FileTypeSock,
+		disk.StatTypeSymlink: disk.FileTypeSymlink,
+	}
+	meta := make([]byte, (pos+blkSize-1)/blkSize*blkSize)
+	for i, n := range nodes {
+		if n.children != nil {
+			names := slices.Sorted(maps.Keys(n.children))
+			nameOff := len(names) * disk.SizeDirent
+			w := bytes.NewBuffer(n.inline[:0])
+			for _, name := range names {
+				c := n.children[name]
+				binary.Write(w, binary.LittleEndian, disk.Dirent{
+					Nid:      c.nid,
+					NameOff:  uint16(nameOff),
+					FileType: ftypes[c.mode&disk.StatTypeMask],
+				})
+				nameOff += len(name)
+			}
+			for _, name := range names {
+				w.WriteString(name)
+			}
+		} else {
+			copy(n.inline, n.data)
+		}
+		layout := uint16(disk.LayoutFlatPlain)
+		if len(n.inline) > 0 {
+			layout = disk.LayoutFlatInline
+		}
+		w := bytes.NewBuffer(meta[n.nid*disk.SizeInodeCompact:][:0])
+		binary.Write(w, binary.LittleEndian, disk.InodeCompact{
+			Format: layout << 1,
+			Mode:   n.mode,
+			Nlink:  uint16(n.nlink),
+			Size:   uint32(len(n.inline)),
+			Inode:  uint32(i + 1),
+		})
+		w.Write(n.inline)
+	}
+
+	img := make([]byte, blkSize, blkSize+len(meta))
+	sb := bytes.NewBuffer(img[disk.SuperBlockOffset:][:0])
+	binary.Write(sb, binary.LittleEndian, disk.SuperBlock{
+		MagicNumber: disk.MagicNumber,
+		BlkSizeBits: 12,
+		RootNid:     uint16(root.nid),
+		Inos:        uint64(len(nodes)),
+		BuildTime:   1000,
+		Blocks:      uint32(1 + len(meta)/blkSize),
+		MetaBlkAddr: 1,
+	})
+	return bytes.NewReader(append(img, meta...))
+}
@@ -0,0 +1,183 @@
+package erofs
+
+import (
+	"cmp"
+	"fmt"
+	"io/fs"
+	"slices"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+// ExtentFlags describe how the data of an extent is stored
+type ExtentFlags uint32
+
+const (
+	// ExtentHole is a range of the file with no data stored, it reads as zeros
+	ExtentHole ExtentFlags = 1 << iota
+	// ExtentInline is data stored in the metadata area following the inode
+	ExtentInline
+	// ExtentCompressed is data which must be decompressed to be read
+	ExtentCompressed
+	// ExtentFragment is data stored in a fragment of the packed inode, the
+	// physical location is not known
+	ExtentFragment
+	// ExtentShared is data whose physical range is also used by another
+	// extent of the same file, such as deduplicated chunks
+	ExtentShared
+)
+
+// Extent maps a range of a file to where its data is stored
+type Extent struct {
+	Logical  int64 // offset of the extent within the file
+	Physical int64 // byte address on the device, -1 for holes and fragments
+	Length   int64 // number of bytes of file data
+
+	// PhysicalLength is the number of bytes stored on the device, it only
+	// differs from Length for compressed extents
+	PhysicalLength int64
+
+	Device uint16 // 0 for the primary image, otherwise the extra device
+	Flags  ExtentFlags
+}
+
+// Extents returns the extents of the file with the given name in file order,
+// covering the whole file. Extents which are contiguous on disk are merged.
+func (img *Image) Extents(name string) ([]Extent, error) {
+	f, err := img.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var b *File
+	switch f := f.(type) {
+	case *File:
+		b = f
+	case *Dir:
+		b = &f.File
+	}
+	fi, err := b.readInfo(false)
+	if err != nil {
+		return nil, err
+	}
+	exts, err := img.extents(fi)
+	if err != nil {
+		return nil, &fs.PathError{Op: "extents", Path: name, Err: err}
+	}
+	return exts, nil
+}
+
+func (img *Image) extents(fi *fileInfo) ([]Extent, error) {
+	switch fi.inodeLayout {
+	case disk.LayoutCompressedFull, disk.LayoutCompressedCompact:
+		exts, err := img.compressedExtents(fi)
+		if err != nil {
+			return nil, err
+		}
+		markShared(exts)
+		return exts, nil
+	}
+
+	tailStart := int64(-1)
+	if fi.inodeLayout == disk.LayoutFlatInline {
+		tailStart = int64(calculateBlocks(img.sb.BlkSizeBits, fi.size)-1) << img.sb.BlkSizeBits
+	}
+
+	var exts []Extent
+	for pos := int64(0); pos < fi.size; {
+		ext, err := img.mapExtent(fi, pos)
+		if err != nil {
+			return nil, err
+		}
+		e := Extent{
+			Logical:        ext.logical,
+			Physical:       ext.physical,
+			Length:         ext.length,
+			PhysicalLength: ext.length,
+			Device:         ext.device,
+		}
+		switch {
+		case ext.physical == -1:
+			e.PhysicalLength = 0
+			e.Flags = ExtentHole
+		case ext.logical == tailStart:
+			e.Flags = ExtentInline
+		}
+		pos = ext.logical + ext.length
+
+		if n := len(exts); n > 0 {
+			last := &exts[n-1]
+			if last.Flags == e.Flags && last.Device == e.Device &&
+				(e.Flags == ExtentHole || last.Physical+last.PhysicalLength == e.Physical) {
+				last.Length += e.Length
+				last.PhysicalLength += e.PhysicalLength
+				continue
+			}
+		}
+		exts = append(exts, e)
+	}
+	markShared(exts)
+	return exts, nil
+}
+
+// markShared flags extents whose physical range overlaps another extent
+func markShared(exts []Extent) {
+	var stored []*Extent
+	for i := range exts {
+		if exts[i].Physical != -1 && exts[i].PhysicalLength > 0 {
+			stored = append(stored, &exts[i])
+		}
+	}
+	slices.SortFunc(stored, func(a, b *Extent) int {
+		if c := cmp.Compare(a.Device, b.Device); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Physical, b.Physical)
+	})
+
+	// Sorted by start, an extent overlaps a later extent only if it
+	// overlaps the next one
+	var end int64
+	for i, e := range stored {
+		if i > 0 && stored[i-1].Device != e.Device {
+			end = 0
+		}
+		eEnd := e.Physical + e.PhysicalLength
+		if e.Physical < end {
+			e.Flags |= ExtentShared
+		}
+		if next := i + 1; next < len(stored) && stored[next].Device == e.Device && stored[next].Physical < eEnd {
+			e.Flags |= ExtentShared
+		}
+		end = max(end, eEnd)
+	}
+}
+
+func (f ExtentFlags) String() string {
+	if f == 0 {
+		return "none"
+	}
+	var s string
+	for _, v := range []struct {
+		flag ExtentFlags
+		name string
+	}{
+		{ExtentHole, "hole"},
+		{ExtentInline, "inline"},
+		{ExtentCompressed, "compressed"},
+		{ExtentFragment, "fragment"},
+		{ExtentShared, "shared"},
+	} {
+		if f&v.flag != 0 {
+			if s != "" {
+				s += ","
+			}
+			s += v.name
+		}
+	}
+	if s == "" {
+		return fmt.Sprintf("ExtentFlags(%#x)", uint32(f))
+	}
+	return s
+}
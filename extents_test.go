@@ -0,0 +1,264 @@
+package erofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+func TestExtents(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		file     string
+		expected []Extent
+	}{
+		{
+			name: "default",
+			file: "/usr/lib/testdir/5k-sequence.raw",
+			expected: []Extent{
+				{Logical: 0, Physical: 49152, Length: 4096, PhysicalLength: 4096},
+				{Logical: 4096, Physical: 53376, Length: 1024, PhysicalLength: 1024, Flags: ExtentInline},
+			},
+		},
+		{
+			name: "default",
+			file: "/usr/lib/testdir/16k-sequence.raw",
+			expected: []Extent{
+				{Logical: 0, Physical: 16384, Length: 16384, PhysicalLength: 16384},
+			},
+		},
+		{
+			// Identical chunks are deduplicated
+			name: "chunk-4096",
+			file: "/usr/lib/testdir/16k-sequence.raw",
+			expected: []Extent{
+				{Logical: 0, Physical: 507904, Length: 4096, PhysicalLength: 4096, Flags: ExtentShared},
+				{Logical: 4096, Physical: 507904, Length: 4096, PhysicalLength: 4096, Flags: ExtentShared},
+				{Logical: 8192, Physical: 507904, Length: 4096, PhysicalLength: 4096, Flags: ExtentShared},
+				{Logical: 12288, Physical: 507904, Length: 4096, PhysicalLength: 4096, Flags: ExtentShared},
+			},
+		},
+		{
+			name: "chunk-8192",
+			file: "/usr/lib/testdir/13k-zeros.raw",
+			expected: []Extent{
+				{Logical: 0, Physical: -1, Length: 8192, Flags: ExtentHole},
+				{Logical: 8192, Physical: 503808, Length: 5120, PhysicalLength: 5120},
+			},
+		},
+	} {
+		t.Run(tc.name+tc.file, func(t *testing.T) {
+			img, err := Open(loadTestFile(t, "basic-"+tc.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			exts, err := img.Extents(tc.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(exts, tc.expected) {
+				t.Errorf("unexpected extents:\n%+v\nexpected:\n%+v", exts, tc.expected)
+			}
+		})
+	}
+}
+
+func TestExtentsChunkIndexes(t *testing.T) {
+	const blkSize = 4096
+	indexes := []disk.ChunkIndex{
+		{BlkAddr: 2},
+		{BlkAddr: 3},
+		{BlkAddr: disk.NullAddr},
+		{DeviceID: 1, BlkAddr: 5},
+	}
+	var ibody bytes.Buffer
+	binary.Write(&ibody, binary.LittleEndian, indexes)
+
+	content := make([]byte, 4*blkSize)
+	for i := range content {
+		content[i] = byte(i / blkSize)
+	}
+	clear(content[2*blkSize : 3*blkSize])
+	dev := make([]byte, 8*blkSize)
+	copy(dev[5*blkSize:], content[3*blkSize:])
+
+	for _, tc := range []struct {
+		name     string
+		mapped   uint32
+		expected Extent
+	}{
+		{
+			name:     "device",
+			expected: Extent{Logical: 3 * blkSize, Physical: 5 * blkSize, Length: blkSize, PhysicalLength: blkSize, Device: 1},
+		},
+		{
+			// Devices mapped into a unified address space are read from the
+			// primary image
+			name:     "flat",
+			mapped:   8,
+			expected: Extent{Logical: 3 * blkSize, Physical: 13 * blkSize, Length: blkSize, PhysicalLength: blkSize},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := fileImage(t, disk.InodeExtended{
+				Format:    disk.LayoutChunkBased<<1 | 1,
+				Mode:      disk.StatTypeReg | 0644,
+				Size:      uint64(len(content)),
+				InodeData: disk.LayoutChunkFormatIndexes,
+				Inode:     1,
+				Nlink:     1,
+			}, ibody.Bytes(), []disk.DeviceSlot{{Blocks: 8, MappedBlkAddr: tc.mapped}}, 16*blkSize)
+			f := r.(*os.File)
+			if _, err := f.WriteAt(content[:2*blkSize], 2*blkSize); err != nil {
+				t.Fatal(err)
+			}
+			if tc.mapped != 0 {
+				if _, err := f.WriteAt(dev, int64(tc.mapped)*blkSize); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			img, err := Open(r, WithExtraDevices(bytes.NewReader(dev)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			exts, err := img.Extents("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []Extent{
+				{Logical: 0, Physical: 2 * blkSize, Length: 2 * blkSize, PhysicalLength: 2 * blkSize},
+				{Logical: 2 * blkSize, Physical: -1, Length: blkSize, Flags: ExtentHole},
+				tc.expected,
+			}
+			if !reflect.DeepEqual(exts, expected) {
+				t.Errorf("unexpected extents:\n%+v\nexpected:\n%+v", exts, expected)
+			}
+
+			checkFileBytes(t, img, "/file", content)
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		r := fileImage(t, disk.InodeExtended{
+			Format:    disk.LayoutChunkBased<<1 | 1,
+			Mode:      disk.StatTypeReg | 0644,
+			Size:      uint64(len(content)),
+			InodeData: disk.LayoutChunkFormatIndexes,
+			Inode:     1,
+			Nlink:     1,
+		}, ibody.Bytes(), []disk.DeviceSlot{{Blocks: 8}}, 16*blkSize)
+		img, err := Open(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := img.Open("/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := io.ReadAll(f); err == nil {
+			t.Fatal("expected error reading from extra device which was not provided")
+		}
+	})
+}
+
+func TestExtentsCompressed(t *testing.T) {
+	const (
+		blkSize = 4096
+		size    = 3*blkSize + 100
+		// Map header of the file at nid 4 in block 1
+		hpos = blkSize + 4*disk.SizeInodeCompact + disk.SizeInodeExtended
+	)
+	// compactPack encodes two 4 byte compact indexes with the block address
+	compactPack := func(v0, v1 uint16, blkaddr uint32) []byte {
+		return binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, uint32(v0)|uint32(v1)<<16), blkaddr)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		layout   uint16
+		header   disk.MapHeader
+		indexes  []byte
+		expected []Extent
+	}{
+		{
+			name:   "full",
+			layout: disk.LayoutCompressedFull,
+			header: disk.MapHeader{
+				FragmentOff: 50 << 16,
+				Advise:      disk.AdviseBigPcluster1 | disk.AdviseInlinePcluster,
+			},
+			indexes: func() []byte {
+				var b bytes.Buffer
+				b.Write(make([]byte, 8))
+				binary.Write(&b, binary.LittleEndian, []disk.LclusterIndex{
+					{Advise: disk.LclusterTypeHead1, BlkAddr: 10},
+					{Advise: disk.LclusterTypeNonhead, BlkAddr: disk.LclusterD0Cblkcnt | 2},
+					{Advise: disk.LclusterTypePlain, ClusterOfs: 100, BlkAddr: 12},
+					{Advise: disk.LclusterTypeHead1, ClusterOfs: 50},
+				})
+				return b.Bytes()
+			}(),
+			expected: []Extent{
+				{Logical: 0, Physical: 10 * blkSize, Length: 2*blkSize + 100, PhysicalLength: 2 * blkSize, Flags: ExtentCompressed},
+				{Logical: 2*blkSize + 100, Physical: 12 * blkSize, Length: blkSize - 50, PhysicalLength: blkSize},
+				{Logical: size - 50, Physical: hpos + 16 + 4*disk.SizeLclusterIdx, Length: 50, PhysicalLength: 50, Flags: ExtentCompressed | ExtentInline},
+			},
+		},
+		{
+			name:   "compact",
+			layout: disk.LayoutCompressedCompact,
+			indexes: append(
+				compactPack(disk.LclusterTypeHead1<<12, disk.LclusterTypeNonhead<<12|1, 9),
+				compactPack(disk.LclusterTypeHead1<<12|100, disk.LclusterTypePlain<<12|50, 10)...,
+			),
+			expected: []Extent{
+				{Logical: 0, Physical: 10 * blkSize, Length: 2*blkSize + 100, PhysicalLength: blkSize, Flags: ExtentCompressed},
+				{Logical: 2*blkSize + 100, Physical: 11 * blkSize, Length: blkSize - 50, PhysicalLength: blkSize, Flags: ExtentCompressed},
+				{Logical: size - 50, Physical: 12 * blkSize, Length: 50, PhysicalLength: blkSize},
+			},
+		},
+		{
+			name:   "fragment",
+			layout: disk.LayoutCompressedFull,
+			header: disk.MapHeader{
+				Advise:      disk.AdviseFragmentPcluster,
+				ClusterBits: disk.FragmentInodeBit,
+			},
+			expected: []Extent{
+				{Logical: 0, Physical: -1, Length: size, Flags: ExtentFragment},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var ibody bytes.Buffer
+			binary.Write(&ibody, binary.LittleEndian, tc.header)
+			ibody.Write(tc.indexes)
+			r := fileImage(t, disk.InodeExtended{
+				Format: tc.layout<<1 | 1,
+				Mode:   disk.StatTypeReg | 0644,
+				Size:   size,
+				Inode:  1,
+				Nlink:  1,
+			}, ibody.Bytes(), nil, 16*blkSize)
+
+			img, err := Open(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exts, err := img.Extents("/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(exts, tc.expected) {
+				t.Errorf("unexpected extents:\n%+v\nexpected:\n%+v", exts, tc.expected)
+			}
+		})
+	}
+}
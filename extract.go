@@ -0,0 +1,144 @@
+package erofs
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+// ExtractOptions configures Extract
+type ExtractOptions struct {
+	// Paths limits extraction to the given paths in the image, along with
+	// the contents of directories. Parent directories of the paths are
+	// created with their metadata from the image. Only the selected
+	// subtrees are read and an error wrapping fs.ErrNotExist is returned
+	// when a path is not in the image. When empty, the whole image is
+	// extracted.
+	Paths []string
+
+	// Rootless extracts without privileges. Files are owned by the invoking
+	// user and the ownership, mode and file type from the image are recorded
+	// in the OverrideStatXattr xattr of each entry, as used by fuse-overlayfs
+	// and containers/storage. Device nodes are created as empty regular files
+	// carrying the override. Symlinks, FIFOs and sockets cannot hold user
+	// xattrs and are created without the override.
+	Rootless bool
+}
+
+// OverrideStatXattr is the xattr holding the ownership, mode and file type
+// of entries extracted in rootless mode, formatted as "uid:gid:mode:type"
+// with an octal mode and a type of file, dir, symlink, pipe, socket,
+// block-major-minor or char-major-minor.
+const OverrideStatXattr = "user.containers.override_stat"
+
+// Extract writes the contents of the image to the dest directory, which is
+// created if it does not exist. File data, modes, ownership, modification
+// times, xattrs, device nodes, FIFOs, sockets, symlinks and hardlinks are
+// restored. Holes in sparse files are preserved. The metadata of the image
+// root is applied to dest.
+//
+// Ownership and xattrs in the trusted and security namespaces are only
+// restored when running as root. Creating device nodes requires privileges
+// and fails otherwise, unless extracting with Rootless.
+//
+// Paths are resolved one component at a time beneath dest without following
+// symlinks, so entries in the image or existing files in dest cannot cause
+// files to be written outside of dest. Existing files are replaced, existing
+// directories are reused.
+//
+// Extract is only supported on Linux, ErrNotImplemented is returned on other
+// platforms.
+func Extract(img *Image, dest string, opts ExtractOptions) error {
+	var sel extractPaths
+	if len(opts.Paths) > 0 {
+		sel = extractPaths{}
+	}
+	for _, p := range opts.Paths {
+		p = path.Clean("/" + p)
+		f, err := img.Open(p)
+		if err != nil {
+			return fmt.Errorf("extract %s: %w", p, err)
+		}
+		f.Close()
+		if p == "/" {
+			sel = nil
+		} else if sel != nil {
+			sel.add(strings.Split(p[1:], "/"))
+		}
+	}
+	return extract(img, dest, opts, sel)
+}
+
+// extractPaths is the tree of names selected for extraction beneath a
+// directory, a nil tree selects all entries
+type extractPaths map[string]extractPaths
+
+// add selects the path with the given components
+func (t extractPaths) add(names []string) {
+	child, ok := t[names[0]]
+	if len(names) == 1 {
+		t[names[0]] = nil
+		return
+	}
+	if ok && child == nil {
+		// A parent is already selected
+		return
+	}
+	if !ok {
+		child = extractPaths{}
+		t[names[0]] = child
+	}
+	child.add(names[1:])
+}
+
+// overrideStat formats the OverrideStatXattr value for st
+func overrideStat(st *Stat) string {
+	var typ string
+	switch st.Mode.Type() {
+	case 0:
+		typ = "file"
+	case fs.ModeDir:
+		typ = "dir"
+	case fs.ModeSymlink:
+		typ = "symlink"
+	case fs.ModeNamedPipe:
+		typ = "pipe"
+	case fs.ModeSocket:
+		typ = "socket"
+	case fs.ModeDevice:
+		typ = fmt.Sprintf("block-%d-%d", disk.RdevMajor(st.Rdev), disk.RdevMinor(st.Rdev))
+	case fs.ModeCharDevice, fs.ModeDevice | fs.ModeCharDevice:
+		typ = fmt.Sprintf("char-%d-%d", disk.RdevMajor(st.Rdev), disk.RdevMinor(st.Rdev))
+	default:
+		typ = "unknown"
+	}
+	return fmt.Sprintf("%d:%d:0%o:%s", st.UID, st.GID, unixMode(st.Mode), typ)
+}
+
+// validName returns an error for directory entry names which are not a
+// single path component
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("invalid entry name %q: %w", name, ErrInvalid)
+	}
+	return nil
+}
+
+// unixMode returns the permission and special bits of mode as used by
+// chmod and mknod
+func unixMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 0o1000
+	}
+	return m
+}
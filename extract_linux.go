@@ -0,0 +1,403 @@
+package erofs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// extractor holds the state of an extraction to a destination directory
+type extractor struct {
+	img        *Image
+	root       int // directory fd of the destination
+	privileged bool
+	rootless   bool
+
+	// links holds the first extracted path of inodes with multiple links
+	links map[uint64]string
+}
+
+func extract(img *Image, dest string, opts ExtractOptions, sel extractPaths) error {
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		return err
+	}
+	root, err := syscall.Open(dest, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return &fs.PathError{Op: "open", Path: dest, Err: err}
+	}
+	defer syscall.Close(root)
+
+	x := &extractor{
+		img:        img,
+		root:       root,
+		privileged: os.Geteuid() == 0 && !opts.Rootless,
+		rootless:   opts.Rootless,
+		links:      map[uint64]string{},
+	}
+	f, err := img.Open("/")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d, ok := f.(*Dir)
+	if !ok {
+		return fmt.Errorf("root is not a directory: %w", ErrInvalid)
+	}
+	fi, err := d.Stat()
+	if err != nil {
+		return err
+	}
+	if err := x.extractDir(root, "", d, sel); err != nil {
+		return err
+	}
+	if err := x.setMeta(root, "", root, fi.Sys().(*Stat)); err != nil {
+		return fmt.Errorf("failed to set metadata for /: %w", err)
+	}
+	return nil
+}
+
+// extractDir extracts the entries of d selected by sel into the directory
+// fd, all entries are extracted when sel is nil
+func (x *extractor) extractDir(fd int, rel string, d *Dir, sel extractPaths) error {
+	if sel != nil {
+		// Only look up the selected names instead of reading the directory
+		for _, name := range slices.Sorted(maps.Keys(sel)) {
+			crel := path.Join(rel, name)
+			f, err := x.img.Open("/" + crel)
+			if err != nil {
+				return fmt.Errorf("failed to open /%s: %w", crel, err)
+			}
+			de := &direntry{}
+			switch f := f.(type) {
+			case *File:
+				de.File = *f
+			case *Dir:
+				de.File = f.File
+			}
+			err = x.extractEntry(fd, crel, de, sel[name])
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("failed to extract /%s: %w", crel, err)
+			}
+		}
+		return nil
+	}
+	for e, err := range d.Entries() {
+		if err != nil {
+			return fmt.Errorf("failed to read /%s: %w", rel, err)
+		}
+		name := e.Name()
+		if err := validName(name); err != nil {
+			return fmt.Errorf("in /%s: %w", rel, err)
+		}
+		crel := path.Join(rel, name)
+		if err := x.extractEntry(fd, crel, e.(*direntry), nil); err != nil {
+			return fmt.Errorf("failed to extract /%s: %w", crel, err)
+		}
+	}
+	return nil
+}
+
+func (x *extractor) extractEntry(dirfd int, rel string, de *direntry, sel extractPaths) (err error) {
+	name := path.Base(rel)
+	fi, err := de.Info()
+	if err != nil {
+		return err
+	}
+	st := fi.Sys().(*Stat)
+
+	if fi.IsDir() {
+		fd, err := x.mkdir(dirfd, name)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(fd)
+		if err := x.extractDir(fd, rel, &Dir{File: de.File}, sel); err != nil {
+			return err
+		}
+		// Metadata is set after the contents so the directory stays
+		// writable and its modification time is kept
+		return x.setMeta(dirfd, name, fd, st)
+	}
+
+	if st.Nlink > 1 {
+		if first, ok := x.links[de.inode]; ok {
+			return x.link(first, dirfd, name)
+		}
+		defer func() {
+			if err == nil {
+				x.links[de.inode] = rel
+			}
+		}()
+	}
+
+	switch mode := st.Mode; mode.Type() {
+	case 0:
+		return x.writeFile(dirfd, name, &de.File, st)
+	case fs.ModeSymlink:
+		f := de.File
+		target, err := io.ReadAll(&f)
+		if err != nil {
+			return err
+		}
+		if err := replace(dirfd, name, func() error {
+			return unix.Symlinkat(string(target), dirfd, name)
+		}); err != nil {
+			return err
+		}
+	case fs.ModeDevice, fs.ModeCharDevice, fs.ModeDevice | fs.ModeCharDevice:
+		if x.rootless {
+			// Placeholder file, the device is recorded in the override
+			return x.writeFile(dirfd, name, nil, st)
+		}
+		fallthrough
+	case fs.ModeNamedPipe, fs.ModeSocket:
+		var ftype uint32
+		switch {
+		case mode&fs.ModeCharDevice != 0:
+			ftype = syscall.S_IFCHR
+		case mode&fs.ModeDevice != 0:
+			ftype = syscall.S_IFBLK
+		case mode&fs.ModeNamedPipe != 0:
+			ftype = syscall.S_IFIFO
+		default:
+			ftype = syscall.S_IFSOCK
+		}
+		if err := replace(dirfd, name, func() error {
+			return syscall.Mknodat(dirfd, name, ftype|unixMode(mode), int(st.Rdev))
+		}); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported file type %v: %w", mode.Type(), ErrNotImplemented)
+	}
+	return x.setMeta(dirfd, name, -1, st)
+}
+
+// mkdir creates or reuses the directory name and returns an fd for it
+func (x *extractor) mkdir(dirfd int, name string) (int, error) {
+	// Only the owner can write until the final mode is set
+	if err := syscall.Mkdirat(dirfd, name, 0o700); err != nil && err != syscall.EEXIST {
+		return -1, err
+	}
+	const flags = syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+	fd, err := syscall.Openat(dirfd, name, flags, 0)
+	if err == syscall.ENOTDIR || err == syscall.ELOOP {
+		// Replace an existing file or symlink, never follow it
+		if err := syscall.Unlinkat(dirfd, name); err != nil {
+			return -1, err
+		}
+		if err := syscall.Mkdirat(dirfd, name, 0o700); err != nil {
+			return -1, err
+		}
+		fd, err = syscall.Openat(dirfd, name, flags, 0)
+	}
+	return fd, err
+}
+
+// writeFile creates the regular file name with the data of f, skipping
+// over holes. An empty file is created when f is nil.
+func (x *extractor) writeFile(dirfd int, name string, f *File, st *Stat) error {
+	var fd int
+	if err := replace(dirfd, name, func() (err error) {
+		fd, err = syscall.Openat(dirfd, name, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0o600)
+		return err
+	}); err != nil {
+		return err
+	}
+	out := os.NewFile(uintptr(fd), name)
+	defer out.Close()
+
+	if f == nil {
+		if err := x.setMeta(dirfd, name, fd, st); err != nil {
+			return err
+		}
+		return out.Close()
+	}
+
+	src := *f
+	defer src.Close()
+	for off := int64(0); off < st.Size; {
+		data, err := src.Seek(off, SeekData)
+		if errors.Is(err, ErrNoData) {
+			break
+		} else if err != nil {
+			return err
+		}
+		hole, err := src.Seek(data, SeekHole)
+		if err != nil {
+			return err
+		}
+		if _, err := src.Seek(data, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := out.Seek(data, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(out, &src, hole-data); err != nil {
+			return err
+		}
+		off = hole
+	}
+	if err := out.Truncate(st.Size); err != nil {
+		return err
+	}
+	if err := x.setMeta(dirfd, name, fd, st); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// link creates name as a hardlink to the previously extracted path first
+func (x *extractor) link(first string, dirfd int, name string) error {
+	pfd, err := x.openBeneath(path.Dir(first))
+	if err != nil {
+		return err
+	}
+	if pfd != x.root {
+		defer syscall.Close(pfd)
+	}
+	return replace(dirfd, name, func() error {
+		return unix.Linkat(pfd, path.Base(first), dirfd, name, 0)
+	})
+}
+
+// openBeneath opens the directory at rel beneath the destination, one
+// component at a time without following symlinks
+func (x *extractor) openBeneath(rel string) (int, error) {
+	fd := x.root
+	if rel == "." || rel == "" {
+		return fd, nil
+	}
+	for _, name := range strings.Split(rel, "/") {
+		next, err := syscall.Openat(fd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		if fd != x.root {
+			syscall.Close(fd)
+		}
+		if err != nil {
+			return -1, &fs.PathError{Op: "openat", Path: rel, Err: err}
+		}
+		fd = next
+	}
+	return fd, nil
+}
+
+// setMeta applies ownership, xattrs, mode and times to name in dirfd, fd is
+// used instead when it refers to the file
+func (x *extractor) setMeta(dirfd int, name string, fd int, st *Stat) error {
+	// The entry is changed through its /proc/self/fd link when there is no
+	// fd, resolving the name through the directory fd without following the
+	// final component
+	proc := "/proc/self/fd/" + strconv.Itoa(dirfd) + "/" + name
+	if fd >= 0 {
+		proc = "/proc/self/fd/" + strconv.Itoa(fd)
+	}
+
+	if x.privileged {
+		var err error
+		if fd >= 0 {
+			err = syscall.Fchown(fd, int(st.UID), int(st.GID))
+		} else {
+			err = syscall.Fchownat(dirfd, name, int(st.UID), int(st.GID), unix.AT_SYMLINK_NOFOLLOW)
+		}
+		if err != nil {
+			return fmt.Errorf("chown: %w", err)
+		}
+	}
+
+	// Xattrs are set before the mode, which may remove write permission
+	// needed to set them without privileges
+	xattrs := make(map[string]string, len(st.Xattrs)+1)
+	for k, v := range st.Xattrs {
+		if !x.privileged && (strings.HasPrefix(k, "trusted.") || strings.HasPrefix(k, "security.")) {
+			continue
+		}
+		xattrs[k] = v
+	}
+	// User xattrs can only be set on regular files, including device
+	// placeholders, and directories
+	if x.rootless && st.Mode.Type()&(fs.ModeSymlink|fs.ModeNamedPipe|fs.ModeSocket) == 0 {
+		xattrs[OverrideStatXattr] = overrideStat(st)
+	}
+	for _, k := range slices.Sorted(maps.Keys(xattrs)) {
+		var err error
+		if fd >= 0 {
+			err = unix.Fsetxattr(fd, k, []byte(xattrs[k]), 0)
+		} else {
+			err = unix.Lsetxattr(proc, k, []byte(xattrs[k]), 0)
+		}
+		if err != nil {
+			return fmt.Errorf("setxattr %s: %w", k, err)
+		}
+	}
+
+	// Mode is set after ownership since chown clears setuid and setgid
+	if st.Mode.Type() != fs.ModeSymlink {
+		mode := unixMode(st.Mode)
+		if x.rootless {
+			// The mode is recorded in the override, the owner keeps
+			// access to the file so it can be changed or removed later
+			mode = mode&0o777 | 0o600
+			if st.Mode.IsDir() {
+				mode |= 0o100
+			}
+		}
+		var err error
+		if fd >= 0 {
+			err = syscall.Fchmod(fd, mode)
+		} else {
+			err = fchmodNofollow(dirfd, name, mode)
+		}
+		if err != nil {
+			return fmt.Errorf("chmod: %w", err)
+		}
+	}
+
+	ts := unix.NsecToTimespec(int64(st.Mtime)*1e9 + int64(st.MtimeNs))
+	times := []unix.Timespec{ts, ts}
+	var err error
+	if fd >= 0 {
+		err = unix.UtimesNanoAt(unix.AT_FDCWD, proc, times, 0)
+	} else {
+		err = unix.UtimesNanoAt(dirfd, name, times, unix.AT_SYMLINK_NOFOLLOW)
+	}
+	if err != nil {
+		return fmt.Errorf("utimensat: %w", err)
+	}
+	return nil
+}
+
+// replace calls create, removing an existing non-directory entry and
+// retrying when it already exists
+func replace(dirfd int, name string, create func() error) error {
+	err := create()
+	if err != syscall.EEXIST {
+		return err
+	}
+	if err := syscall.Unlinkat(dirfd, name); err != nil {
+		return fmt.Errorf("failed to remove existing %s: %w", name, err)
+	}
+	return create()
+}
+
+// fchmodNofollow changes the mode of name in dirfd without following a
+// symlink, which fchmodat does not support. The entry is opened with O_PATH
+// and changed through its /proc/self/fd link, chmod fails on symlinks.
+func fchmodNofollow(dirfd int, name string, mode uint32) error {
+	fd, err := syscall.Openat(dirfd, name, unix.O_PATH|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	return syscall.Chmod("/proc/self/fd/"+strconv.Itoa(fd), mode)
+}
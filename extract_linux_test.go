@@ -0,0 +1,411 @@
+package erofs
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+func TestExtract(t *testing.T) {
+	for _, name := range []string{
+		"default",
+		"chunk-4096",
+	} {
+		t.Run(name, func(t *testing.T) {
+			img, err := Open(loadTestFile(t, "basic-"+name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dest := t.TempDir()
+			if err := Extract(img, dest, ExtractOptions{Paths: []string{"/usr", "in-root.txt"}}); err != nil {
+				t.Fatal(err)
+			}
+
+			checkExtracted(t, img, dest, "/")
+			for _, p := range []string{
+				"/in-root.txt",
+				"/usr/lib/testdir/13k-zeros.raw",
+				"/usr/lib/testdir/16k-sequence.raw",
+				"/usr/lib/testdir/5k-sequence.raw",
+				"/usr/lib/testdir/emptydir",
+				"/usr/lib/testdir/emptyfile",
+				"/usr/lib/testdir/lotsoffiles/lotsoffiles-100.empty",
+				"/usr/lib/withxattr",
+				"/usr/lib/withxattr/f1",
+			} {
+				checkExtracted(t, img, dest, p)
+			}
+			if _, err := os.Lstat(filepath.Join(dest, "in-usr.txt")); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("expected unselected file to not be extracted: %v", err)
+			}
+			ents, err := os.ReadDir(filepath.Join(dest, "usr/lib/testdir/lotsoffiles"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ents) != 5000 {
+				t.Errorf("unexpected number of extracted entries: %d", len(ents))
+			}
+
+			if name != "default" {
+				// Holes are not written
+				var st syscall.Stat_t
+				if err := syscall.Stat(filepath.Join(dest, "usr/lib/testdir/13k-zeros.raw"), &st); err != nil {
+					t.Fatal(err)
+				}
+				if st.Blocks*512 >= 13*1024 {
+					t.Errorf("expected sparse file, %d blocks allocated", st.Blocks)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractDevices(t *testing.T) {
+	img, err := Open(loadTestFile(t, "basic-default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	if err := Extract(img, dest, ExtractOptions{Paths: []string{"/dev"}}); err != nil {
+		if errors.Is(err, syscall.EPERM) {
+			t.Skip("creating device nodes not permitted")
+		}
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/dev/block0", "/dev/char0", "/dev/char1", "/dev/fifo0"} {
+		checkExtracted(t, img, dest, p)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(filepath.Join(dest, "dev/char1"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Rdev != 771 {
+		t.Errorf("unexpected device number %d", st.Rdev)
+	}
+}
+
+func TestExtractBeneath(t *testing.T) {
+	img, err := Open(loadTestFile(t, "basic-default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	outside := t.TempDir()
+	// Existing symlinks in the destination must not be followed
+	if err := os.Symlink(outside, filepath.Join(dest, "usr")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "target"), filepath.Join(dest, "in-root.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Extract(img, dest, ExtractOptions{Paths: []string{"/usr/lib/testdir/case", "/in-root.txt"}}); err != nil {
+		t.Fatal(err)
+	}
+	ents, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 0 {
+		t.Errorf("expected nothing written outside of destination, found %d entries", len(ents))
+	}
+	checkExtracted(t, img, dest, "/usr")
+	checkExtracted(t, img, dest, "/usr/lib/testdir/case/file.txt")
+	checkExtracted(t, img, dest, "/in-root.txt")
+
+	if err := validName("../x"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected invalid name error, got %v", err)
+	}
+}
+
+func TestExtractMissingPath(t *testing.T) {
+	img, err := Open(loadTestFile(t, "basic-default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	err = Extract(img, dest, ExtractOptions{Paths: []string{"/in-root.txt", "/usr/missing"}})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+	ents, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 0 {
+		t.Errorf("expected nothing extracted, found %d entries", len(ents))
+	}
+}
+
+func TestExtractHardlinks(t *testing.T) {
+	img := hardlinkImage(t)
+	for _, tc := range []struct {
+		name  string
+		paths []string
+		nlink uint64
+	}{
+		{"all", nil, 2},
+		{"both", []string{"/b/link", "/a/file"}, 2},
+		// The first path of the inode is not selected, the link is
+		// extracted as a file
+		{"first-unselected", []string{"/b"}, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dest := t.TempDir()
+			if err := Extract(img, dest, ExtractOptions{Paths: tc.paths}); err != nil {
+				t.Fatal(err)
+			}
+			var link syscall.Stat_t
+			if err := syscall.Lstat(filepath.Join(dest, "b/link"), &link); err != nil {
+				t.Fatal(err)
+			}
+			if link.Nlink != tc.nlink {
+				t.Errorf("unexpected link count %d, expected %d", link.Nlink, tc.nlink)
+			}
+			checkExtracted(t, img, dest, "/b/link")
+			if tc.nlink == 1 {
+				if _, err := os.Lstat(filepath.Join(dest, "a")); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("expected unselected directory to not be extracted: %v", err)
+				}
+				return
+			}
+			var file syscall.Stat_t
+			if err := syscall.Lstat(filepath.Join(dest, "a/file"), &file); err != nil {
+				t.Fatal(err)
+			}
+			if file.Ino != link.Ino {
+				t.Errorf("expected hardlinks to share inode %d, got %d", file.Ino, link.Ino)
+			}
+			checkExtracted(t, img, dest, "/a/file")
+		})
+	}
+}
+
+func TestFchmodNofollow(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	if err := os.WriteFile(target, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+
+	if err := fchmodNofollow(fd, "link", 0o4777); err == nil {
+		t.Error("expected error changing the mode of a symlink")
+	}
+	if fi, err := os.Stat(target); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode() != 0o600 {
+		t.Errorf("symlink target mode changed to %v", fi.Mode())
+	}
+	if err := fchmodNofollow(fd, "target", 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(target); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode() != 0o640 {
+		t.Errorf("unexpected mode %v", fi.Mode())
+	}
+}
+
+// checkExtracted compares the extracted file at p with the image
+func checkExtracted(t testing.TB, img *Image, dest, p string) {
+	t.Helper()
+
+	f, err := img.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fi.Sys().(*Stat)
+
+	target := filepath.Join(dest, p)
+	var st syscall.Stat_t
+	if err := syscall.Lstat(target, &st); err != nil {
+		t.Fatal(err)
+	}
+	if mode := st.Mode & 0o7777; mode != unixMode(expected.Mode) {
+		t.Errorf("%s: unexpected mode %o, expected %o", p, mode, unixMode(expected.Mode))
+	}
+	if os.Geteuid() == 0 && (st.Uid != expected.UID || st.Gid != expected.GID) {
+		t.Errorf("%s: unexpected owner %d:%d, expected %d:%d", p, st.Uid, st.Gid, expected.UID, expected.GID)
+	}
+	if sec, nsec := st.Mtim.Unix(); sec != int64(expected.Mtime) || nsec != int64(expected.MtimeNs) {
+		t.Errorf("%s: unexpected mtime %d.%d, expected %d.%d", p, sec, nsec, expected.Mtime, expected.MtimeNs)
+	}
+	for k, v := range expected.Xattrs {
+		buf := make([]byte, 256)
+		n, err := syscall.Getxattr(target, k, buf)
+		if err != nil {
+			t.Errorf("%s: failed to get xattr %s: %v", p, k, err)
+		} else if string(buf[:n]) != v {
+			t.Errorf("%s: unexpected xattr %s %q, expected %q", p, k, buf[:n], v)
+		}
+	}
+	if fi.Mode().IsRegular() {
+		b, err := os.ReadFile(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content := make([]byte, fi.Size())
+		if _, err := f.Read(content); err != nil && len(content) > 0 {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, content) {
+			t.Errorf("%s: unexpected content", p)
+		}
+	}
+}
+
+func TestExtractRootless(t *testing.T) {
+	img, err := Open(loadTestFile(t, "basic-default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	if err := Extract(img, dest, ExtractOptions{Paths: []string{"/dev", "/in-root.txt"}, Rootless: true}); err != nil {
+		t.Fatal(err)
+	}
+	for p, expected := range map[string]string{
+		"/":            "1000:1000:0755:dir",
+		"/dev":         "1000:1000:0755:dir",
+		"/dev/block0":  "0:0:0644:block-1-1",
+		"/dev/char1":   "0:0:0644:char-3-3",
+		"/in-root.txt": "1000:1000:0644:file",
+	} {
+		target := filepath.Join(dest, p)
+		buf := make([]byte, 64)
+		n, err := syscall.Getxattr(target, OverrideStatXattr, buf)
+		if err != nil {
+			t.Errorf("%s: failed to get override xattr: %v", p, err)
+			continue
+		}
+		if string(buf[:n]) != expected {
+			t.Errorf("%s: unexpected override %q, expected %q", p, buf[:n], expected)
+		}
+		var st syscall.Stat_t
+		if err := syscall.Lstat(target, &st); err != nil {
+			t.Fatal(err)
+		}
+		if int(st.Uid) != os.Geteuid() {
+			t.Errorf("%s: expected owner to be the invoking user, got %d", p, st.Uid)
+		}
+	}
+	for _, p := range []string{"/dev/block0", "/dev/char1"} {
+		fi, err := os.Lstat(filepath.Join(dest, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.Mode().IsRegular() {
+			t.Errorf("%s: expected placeholder regular file, got %v", p, fi.Mode())
+		}
+	}
+}
+
+// TestExtractRootlessUnprivileged extracts read-only files and directories
+// as a user without privileges. The test is run as nobody when invoked as
+// root.
+func TestExtractRootlessUnprivileged(t *testing.T) {
+	if os.Geteuid() == 0 {
+		runAsNobody(t)
+		return
+	}
+	img, err := Open(testImage(t, []testEntry{
+		{path: "ro", mode: disk.StatTypeDir | 0o555},
+		{path: "ro/file", mode: disk.StatTypeReg | 0o444, data: "read-only\n"},
+		{path: "ro/none", mode: disk.StatTypeReg},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := t.TempDir()
+	if err := Extract(img, dest, ExtractOptions{Rootless: true}); err != nil {
+		t.Fatal(err)
+	}
+	for p, expected := range map[string]struct {
+		override string
+		mode     fs.FileMode
+	}{
+		"/ro":      {"0:0:0555:dir", fs.ModeDir | 0o755},
+		"/ro/file": {"0:0:0444:file", 0o644},
+		"/ro/none": {"0:0:00:file", 0o600},
+	} {
+		target := filepath.Join(dest, p)
+		buf := make([]byte, 64)
+		n, err := syscall.Getxattr(target, OverrideStatXattr, buf)
+		if err != nil {
+			t.Errorf("%s: failed to get override xattr: %v", p, err)
+			continue
+		}
+		if string(buf[:n]) != expected.override {
+			t.Errorf("%s: unexpected override %q, expected %q", p, buf[:n], expected.override)
+		}
+		fi, err := os.Lstat(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != expected.mode {
+			t.Errorf("%s: unexpected mode %v, expected %v", p, fi.Mode(), expected.mode)
+		}
+	}
+}
+
+// runAsNobody runs the current test in a copy of the test binary as the
+// nobody user, skipping when the test binary cannot be run
+func runAsNobody(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skipf("test binary not found: %v", err)
+	}
+	data, err := os.ReadFile(exe)
+	if err != nil {
+		t.Skipf("failed to read test binary: %v", err)
+	}
+	// The copy and the temporary directory of the test must be accessible
+	// to nobody, unlike the parent of t.TempDir
+	dir, err := os.MkdirTemp("", "erofs-nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.Chown(dir, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "erofs.test")
+	if err := os.WriteFile(bin, data, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(bin, "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "TMPDIR="+dir)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: 65534, Gid: 65534},
+	}
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		t.Fatalf("failed as nobody: %v\n%s", err, out)
+	} else if err != nil {
+		t.Skipf("failed to run as nobody: %v", err)
+	}
+	if bytes.Contains(out, []byte("--- SKIP")) {
+		t.Skipf("skipped as nobody:\n%s", out)
+	}
+}
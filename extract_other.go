@@ -0,0 +1,9 @@
+//go:build !linux
+
+package erofs
+
+import "fmt"
+
+func extract(img *Image, dest string, opts ExtractOptions, sel extractPaths) error {
+	return fmt.Errorf("extract: %w", ErrNotImplemented)
+}
@@ -0,0 +1,557 @@
+package erofs
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+// ConvertOptions configures FromTar and FromLayers
+type ConvertOptions struct {
+	WriterOptions
+
+	// TempDir is the directory for the temporary file holding file data
+	// until the image is written, the default directory for temporary files
+	// is used when empty
+	TempDir string
+
+	// TarIndex creates a metadata only image referencing the file data in
+	// the tar, as done by mkfs.erofs --tar=i. The tar is the first extra
+	// device of the image and must not be compressed. The block size is
+	// 512 bytes, matching the alignment of data in the tar, and sparse
+	// files are still stored in the image.
+	TarIndex bool
+
+	// Whiteouts selects how OCI whiteout files are converted
+	Whiteouts WhiteoutFormat
+}
+
+// WhiteoutFormat selects the representation of deleted files and opaque
+// directories of OCI image layers, which are marked by ".wh.<name>" and
+// ".wh..wh..opq" files in the layer tar
+type WhiteoutFormat int
+
+const (
+	// WhiteoutKeep stores the whiteout files as they are in the tar
+	WhiteoutKeep WhiteoutFormat = iota
+
+	// WhiteoutOverlay converts whiteout files to character devices with
+	// device number 0/0 and opaque markers to the trusted.overlay.opaque
+	// xattr of the directory, as used by overlayfs
+	WhiteoutOverlay
+
+	// WhiteoutOverlayUser is WhiteoutOverlay with the user.overlay.opaque
+	// xattr, as used by overlayfs mounted with the userxattr option
+	WhiteoutOverlayUser
+)
+
+// OCI whiteout file names
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutMeta   = ".wh..wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// FromTar converts the tar stream read from r to an erofs image written to
+// w. Gzip compressed streams are detected and decompressed. Xattrs from
+// SCHILY.xattr PAX records, hardlinks, symlinks, devices and FIFOs are
+// preserved and holes in sparse entries are not stored in the image. When
+// the stream holds the same path more than once, the later entry replaces
+// the earlier one, a directory replacing a directory keeps its entries.
+//
+// File data is spooled to a temporary file while reading the stream so
+// memory use only depends on the number of entries. In TarIndex mode the
+// image only references the data, the image must be opened with the tar
+// as extra device using WithExtraDevices.
+func FromTar(r io.Reader, w io.WriterAt, opts ConvertOptions) error {
+	if opts.TarIndex {
+		if opts.ObjectDir != "" {
+			return fmt.Errorf("tar index with object directory: %w", ErrInvalid)
+		}
+		if opts.BlockSize == 0 {
+			opts.BlockSize = tarBlockSize
+		} else if opts.BlockSize != tarBlockSize {
+			return fmt.Errorf("block size %d not supported for tar index: %w", opts.BlockSize, ErrInvalid)
+		}
+	}
+	c, err := newTarConverter(w, opts)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	if opts.TarIndex {
+		err = c.addIndex(r)
+	} else {
+		err = c.addTar(r)
+	}
+	if err != nil {
+		return err
+	}
+	return c.w.Close()
+}
+
+// FromLayers writes an erofs image holding the merged contents of the OCI
+// image layer tars, applied in order from the lowest layer. Whiteout files
+// delete the files of lower layers and opaque directory markers hide the
+// contents of lower layers, neither is stored in the image. Layers are
+// read one at a time as done by FromTar and may be gzip compressed.
+// The TarIndex and Whiteouts options are not used.
+func FromLayers(layers []io.Reader, w io.WriterAt, opts ConvertOptions) error {
+	if opts.TarIndex {
+		return fmt.Errorf("tar index for multiple layers: %w", ErrNotImplemented)
+	}
+	c, err := newTarConverter(w, opts)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	c.flatten = true
+	for i, r := range layers {
+		if err := c.addTar(r); err != nil {
+			return fmt.Errorf("layer %d: %w", i, err)
+		}
+	}
+	return c.w.Close()
+}
+
+// tarConverter adds the entries of tar streams to a writer
+type tarConverter struct {
+	w     *Writer
+	opts  ConvertOptions
+	spool *spool
+
+	// flatten applies whiteouts to the entries of earlier layers, layer
+	// holds the paths added by the current layer
+	flatten bool
+	layer   map[string]bool
+	opaque  []string
+}
+
+func newTarConverter(w io.WriterAt, opts ConvertOptions) (*tarConverter, error) {
+	ew, err := NewWriter(w, opts.WriterOptions)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(opts.TempDir, "erofs-tar-")
+	if err != nil {
+		return nil, err
+	}
+	return &tarConverter{
+		w:     ew,
+		opts:  opts,
+		spool: &spool{f: f, unit: max(int64(1)<<ew.bits, 4096)},
+	}, nil
+}
+
+// close removes the spool file
+func (c *tarConverter) close() {
+	c.spool.f.Close()
+	os.Remove(c.spool.f.Name())
+}
+
+// addTar adds the entries of the tar stream read from r, which may be gzip
+// compressed
+func (c *tarConverter) addTar(r io.Reader) error {
+	src, closeFn, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+	tr := tar.NewReader(src)
+	if err := c.addEntries(tr, nil); err != nil {
+		return err
+	}
+	// Read to the end to detect trailing errors of compressed streams
+	if _, err := io.Copy(io.Discard, src); err != nil {
+		return fmt.Errorf("failed to read tar: %w", err)
+	}
+	return nil
+}
+
+// addIndex adds the entries of the uncompressed tar stream read from r,
+// referencing the data of regular files on the first extra device
+func (c *tarConverter) addIndex(r io.Reader) error {
+	magic := make([]byte, 2)
+	n, err := io.ReadFull(r, magic)
+	if n == 2 && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return fmt.Errorf("compressed tar cannot be indexed: %w", ErrInvalid)
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("failed to read tar: %w", err)
+	}
+	// The tar is read without buffering to track the offset of the data
+	cr := &countingReader{r: io.MultiReader(bytes.NewReader(magic[:n]), r)}
+	if err := c.addEntries(tar.NewReader(cr), cr); err != nil {
+		return err
+	}
+	// The device covers the padding after the end of the archive
+	if _, err := io.Copy(io.Discard, cr); err != nil {
+		return fmt.Errorf("failed to read tar: %w", err)
+	}
+	c.w.devices = append(c.w.devices, disk.DeviceSlot{
+		Blocks: uint32(alignUp(cr.n, tarBlockSize) / tarBlockSize),
+	})
+	return nil
+}
+
+// addEntries adds the entries from tr. When cr is set, the data of regular
+// files is referenced at the offset in the tar counted by cr.
+func (c *tarConverter) addEntries(tr *tar.Reader, cr *countingReader) error {
+	c.layer = map[string]bool{}
+	c.opaque = nil
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read tar: %w", err)
+		}
+		if ok, err := c.whiteout(hdr); ok || err != nil {
+			if err != nil {
+				return fmt.Errorf("%s: %w", hdr.Name, err)
+			}
+			continue
+		}
+
+		var e *Entry
+		if cr != nil && hdr.Typeflag == tar.TypeReg && !isSparse(hdr) {
+			e, err = c.spool.tarEntry(hdr, nil)
+			if err == nil {
+				err = c.w.addDeviceFile(e, 1, cr.n)
+			}
+		} else if e, err = c.spool.tarEntry(hdr, tr); err == nil && e != nil {
+			err = c.w.Add(e)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		if e != nil {
+			c.layer[path.Clean(e.Path)] = true
+		}
+	}
+
+	if !c.flatten {
+		return setOpaque(c.w, c.opaque, c.opts.Whiteouts)
+	}
+	for _, dir := range c.opaque {
+		n, err := c.w.lookup(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = c.w.Add(&Entry{Path: dir, Stat: Stat{Mode: fs.ModeDir | 0o755}})
+		} else if err == nil && n.mode.IsDir() {
+			c.prune(dir, n)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// whiteout handles OCI whiteout files, reporting whether hdr is a whiteout
+func (c *tarConverter) whiteout(hdr *tar.Header) (bool, error) {
+	if !c.flatten && c.opts.Whiteouts == WhiteoutKeep {
+		return false, nil
+	}
+	dir, name := path.Split(tarPath(hdr.Name))
+	switch {
+	case name == whiteoutOpaque:
+		c.opaque = append(c.opaque, path.Clean(dir))
+		return true, nil
+	case strings.HasPrefix(name, whiteoutMeta):
+		// Other metadata of the layer, such as aufs hardlinks
+		return true, nil
+	case !strings.HasPrefix(name, whiteoutPrefix) || len(name) == len(whiteoutPrefix):
+		return false, nil
+	}
+
+	p := dir + name[len(whiteoutPrefix):]
+	if c.flatten {
+		// Whiteouts only apply to lower layers
+		if !c.layer[p] {
+			c.w.remove(p)
+		}
+		return true, nil
+	}
+	e := &Entry{
+		Path: p,
+		Stat: Stat{
+			Mode: fs.ModeDevice | fs.ModeCharDevice,
+			UID:  uint32(hdr.Uid),
+			GID:  uint32(hdr.Gid),
+		},
+	}
+	if hdr.ModTime.Unix() > 0 {
+		e.Stat.Mtime = uint64(hdr.ModTime.Unix())
+		e.Stat.MtimeNs = uint32(hdr.ModTime.Nanosecond())
+	}
+	return true, c.w.Add(e)
+}
+
+// prune removes the entries below the opaque directory dir which were not
+// added by the current layer, keeping the parents of entries which were.
+// It reports whether any entries are left.
+func (c *tarConverter) prune(dir string, n *node) bool {
+	for name, child := range n.children {
+		p := path.Join(dir, name)
+		kept := c.layer[p]
+		if child.mode.IsDir() && c.prune(p, child) {
+			kept = true
+		}
+		if !kept {
+			delete(n.children, name)
+		}
+	}
+	return len(n.children) > 0
+}
+
+// setOpaque marks the directories as opaque for overlayfs, creating
+// directories which are not in the image
+func setOpaque(w *Writer, dirs []string, format WhiteoutFormat) error {
+	name := "trusted.overlay.opaque"
+	if format == WhiteoutOverlayUser {
+		name = "user.overlay.opaque"
+	}
+	for _, dir := range dirs {
+		n, err := w.lookup(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			if err := w.Add(&Entry{Path: dir, Stat: Stat{Mode: fs.ModeDir | 0o755}}); err != nil {
+				return err
+			}
+			n, err = w.lookup(dir)
+		}
+		if err != nil {
+			return err
+		}
+		if !n.mode.IsDir() {
+			return fmt.Errorf("opaque marker in %s, which is not a directory: %w", dir, ErrInvalid)
+		}
+		xattrs := maps.Clone(n.xattrs)
+		if xattrs == nil {
+			xattrs = map[string]string{}
+		}
+		xattrs[name] = "y"
+		n.xattrs = xattrs
+	}
+	return nil
+}
+
+// tarBlockSize is the size of blocks in tar files, all headers and data
+// start at a multiple of the block size
+const tarBlockSize = 512
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// isSparse reports whether the tar entry is a GNU sparse file
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// decompress returns the stream read from r, decompressing gzip streams
+func decompress(r io.Reader) (io.Reader, func() error, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gz, gz.Close, nil
+	}
+	return br, func() error { return nil }, nil
+}
+
+// tarPath returns the path in the image for a tar entry name
+func tarPath(name string) string {
+	p := path.Clean("/" + name)
+	if p == "/" {
+		return "."
+	}
+	return p[1:]
+}
+
+// tarEntry returns the entry for a tar header, spooling the content of
+// regular files from r unless r is nil. No entry is returned for headers
+// which are skipped.
+func (s *spool) tarEntry(hdr *tar.Header, r io.Reader) (*Entry, error) {
+	p := tarPath(hdr.Name)
+	switch hdr.Typeflag {
+	case tar.TypeXGlobalHeader:
+		return nil, nil
+	case tar.TypeLink:
+		return &Entry{Path: p, Hardlink: tarPath(hdr.Linkname)}, nil
+	}
+
+	e := &Entry{
+		Path: p,
+		Stat: Stat{
+			Mode: hdr.FileInfo().Mode(),
+			UID:  uint32(hdr.Uid),
+			GID:  uint32(hdr.Gid),
+		},
+	}
+	if hdr.ModTime.Unix() > 0 {
+		e.Stat.Mtime = uint64(hdr.ModTime.Unix())
+		e.Stat.MtimeNs = uint32(hdr.ModTime.Nanosecond())
+	}
+	for k, v := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(k, "SCHILY.xattr."); ok {
+			if e.Stat.Xattrs == nil {
+				e.Stat.Xattrs = map[string]string{}
+			}
+			e.Stat.Xattrs[name] = v
+		}
+	}
+
+	switch mode := e.Stat.Mode; mode.Type() {
+	case 0:
+		e.Stat.Size = hdr.Size
+		if r == nil {
+			break
+		}
+		base, err := s.add(r, hdr.Size, isSparse(hdr))
+		if err != nil {
+			return nil, err
+		}
+		e.Open = func() (io.ReadCloser, error) {
+			return &spoolReader{f: s.f, base: base, size: hdr.Size}, nil
+		}
+	case fs.ModeSymlink:
+		e.Link = hdr.Linkname
+	case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice:
+		e.Stat.Rdev = disk.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+	case fs.ModeDir, fs.ModeNamedPipe:
+	default:
+		return nil, fmt.Errorf("unsupported tar entry type %q: %w", hdr.Typeflag, ErrNotImplemented)
+	}
+	return e, nil
+}
+
+// spool holds file data in a temporary file until the image is written
+type spool struct {
+	f    *os.File
+	end  int64
+	unit int64 // size of the zero ranges skipped in sparse files
+}
+
+// add appends size bytes from r to the spool, returning their offset.
+// Zero filled units of sparse files are skipped to leave holes in the
+// spool file.
+func (s *spool) add(r io.Reader, size int64, sparse bool) (int64, error) {
+	if !sparse {
+		base := s.end
+		if _, err := io.CopyN(io.NewOffsetWriter(s.f, base), r, size); err != nil {
+			return 0, err
+		}
+		s.end += size
+		return base, nil
+	}
+
+	base := alignUp(s.end, s.unit)
+	buf := make([]byte, s.unit)
+	zero := make([]byte, s.unit)
+	for off := int64(0); off < size; off += s.unit {
+		b := buf[:min(s.unit, size-off)]
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, err
+		}
+		if bytes.Equal(b, zero[:len(b)]) {
+			continue
+		}
+		if _, err := s.f.WriteAt(b, base+off); err != nil {
+			return 0, err
+		}
+	}
+	s.end = base + size
+	return base, nil
+}
+
+// spoolReader reads a file from the spool, SeekData and SeekHole report
+// the holes of the spool file within the file
+type spoolReader struct {
+	f          *os.File
+	base, size int64
+	off        int64
+}
+
+func (r *spoolReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	p = p[:min(int64(len(p)), r.size-r.off)]
+	n, err := r.f.ReadAt(p, r.base+r.off)
+	r.off += int64(n)
+	if err == io.EOF && n == len(p) {
+		// Holes at the end of the spool file
+		err = nil
+	} else if err == io.EOF {
+		clear(p[n:])
+		r.off += int64(len(p) - n)
+		n, err = len(p), nil
+	}
+	return n, err
+}
+
+func (r *spoolReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	case SeekData, SeekHole:
+		if offset < 0 || offset >= r.size {
+			return 0, ErrNoData
+		}
+		pos, err := r.f.Seek(r.base+offset, whence)
+		pos -= r.base
+		switch {
+		case whence == SeekData && (errors.Is(err, syscall.ENXIO) || err == nil && pos >= r.size):
+			return 0, ErrNoData
+		case whence == SeekHole && (errors.Is(err, syscall.ENXIO) || err == nil && pos > r.size):
+			pos, err = r.size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		offset = pos
+	default:
+		return 0, fmt.Errorf("seek whence %d: %w", whence, ErrInvalid)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek to negative position: %w", ErrInvalid)
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *spoolReader) Close() error {
+	return nil
+}
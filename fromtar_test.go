@@ -0,0 +1,368 @@
+package erofs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+func TestFromTar(t *testing.T) {
+	for _, name := range []string{"basic-default", "basic-chunk-4096"} {
+		t.Run(name, func(t *testing.T) {
+			src, err := Open(loadTestFile(t, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := imageTar(t, src)
+			for _, blkSize := range []int{512, 4096} {
+				t.Run(strconv.Itoa(blkSize), func(t *testing.T) {
+					img := convertTar(t, bytes.NewReader(b), ConvertOptions{WriterOptions: WriterOptions{BlockSize: blkSize}})
+					compareImages(t, src, img)
+					compareStats(t, src, img)
+				})
+			}
+		})
+	}
+}
+
+func TestFromTarSparse(t *testing.T) {
+	src, err := Open(loadTestFile(t, "basic-chunk-4096"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteTar(src, &buf, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	img := convertTar(t, &buf, ConvertOptions{})
+	st := statOf(t, img, "/usr/lib/testdir/13k-zeros.raw")
+	if st.InodeLayout != disk.LayoutChunkBased {
+		t.Errorf("expected chunk based layout, got %d", st.InodeLayout)
+	}
+	exts, err := img.Extents("/usr/lib/testdir/13k-zeros.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exts) == 0 || exts[0].Flags&ExtentHole == 0 {
+		t.Errorf("expected hole, got %+v", exts)
+	}
+}
+
+func TestFromTarEntries(t *testing.T) {
+	mtime := time.Unix(1700000000, 500)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range []struct {
+		hdr  tar.Header
+		data string
+	}{
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0o755}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hosts", Mode: 0o644}, data: "first\n"},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./etc/hosts", Mode: 0o600, Uid: 1000}, data: "second\n"},
+		{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "etc/hosts.link", Linkname: "etc/hosts"}},
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "etc/link", Linkname: "hosts", Mode: 0o777}},
+		{hdr: tar.Header{Typeflag: tar.TypeChar, Name: "dev/null", Mode: 0o666, Devmajor: 1, Devminor: 3}},
+		{hdr: tar.Header{Typeflag: tar.TypeFifo, Name: "run/fifo", Mode: 0o600}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "xattr", Mode: 0o644, PAXRecords: map[string]string{
+			"SCHILY.xattr.user.comment":     "value",
+			"SCHILY.xattr.security.selinux": "system_u:object_r:etc_t:s0",
+		}}},
+	} {
+		hdr := e.hdr
+		hdr.ModTime = mtime
+		hdr.Size = int64(len(e.data))
+		hdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	img := convertTar(t, &buf, ConvertOptions{})
+	b, err := fs.ReadFile(img, "etc/hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "second\n" {
+		t.Errorf("expected later entry to replace content, got %q", b)
+	}
+	st := statOf(t, img, "etc/hosts")
+	if st.Mode != 0o600 || st.UID != 1000 || st.Nlink != 2 {
+		t.Errorf("unexpected stat %+v", st)
+	}
+	if st.Mtime != uint64(mtime.Unix()) || st.MtimeNs != uint32(mtime.Nanosecond()) {
+		t.Errorf("unexpected mtime %d.%d", st.Mtime, st.MtimeNs)
+	}
+	if st := statOf(t, img, "etc"); !st.Mode.IsDir() {
+		t.Errorf("expected parent directory, got %v", st.Mode)
+	}
+	// Symlinks are read as their target
+	if target, err := fs.ReadFile(img, "etc/link"); err != nil || string(target) != "hosts" {
+		t.Errorf("unexpected symlink target %q: %v", target, err)
+	}
+	checkDevice(t, img, "/dev/null", fs.ModeCharDevice, disk.Mkdev(1, 3))
+	if st := statOf(t, img, "run/fifo"); st.Mode.Type() != fs.ModeNamedPipe {
+		t.Errorf("expected fifo, got %v", st.Mode)
+	}
+	checkXattrs(t, img, "/xattr", map[string]string{
+		"user.comment":     "value",
+		"security.selinux": "system_u:object_r:etc_t:s0",
+	})
+}
+
+func TestFromTarIndex(t *testing.T) {
+	for _, name := range []string{"basic-default", "basic-chunk-4096"} {
+		t.Run(name, func(t *testing.T) {
+			src, err := Open(loadTestFile(t, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := imageTar(t, src)
+			img := convertTar(t, bytes.NewReader(b), ConvertOptions{TarIndex: true}, WithExtraDevices(bytes.NewReader(b)))
+			compareImages(t, src, img)
+			compareStats(t, src, img)
+
+			if img.sb.BlkSizeBits != 9 {
+				t.Errorf("expected 512 byte blocks, got %d bits", img.sb.BlkSizeBits)
+			}
+			if img.sb.FeatureIncompat&disk.FeatureIncompatDeviceTable == 0 || len(img.devices) != 1 {
+				t.Fatalf("expected device table with one device, got %d", len(img.devices))
+			}
+			if blocks := img.devices[0].slot.Blocks; blocks != uint32(len(b)/512) {
+				t.Errorf("expected %d device blocks, got %d", len(b)/512, blocks)
+			}
+			if size := int64(img.sb.Blocks) << img.sb.BlkSizeBits; size >= int64(len(b))/2 {
+				t.Errorf("expected metadata only image, got %d bytes for %d byte tar", size, len(b))
+			}
+			st := statOf(t, img, "/usr/lib/testdir/16k-sequence.raw")
+			if st.InodeLayout != disk.LayoutChunkBased {
+				t.Errorf("expected chunk based layout, got %d", st.InodeLayout)
+			}
+			exts, err := img.Extents("/usr/lib/testdir/16k-sequence.raw")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(exts) != 1 || exts[0].Device != 1 {
+				t.Errorf("expected single extent on the tar device, got %+v", exts)
+			}
+		})
+	}
+}
+
+func TestFromTarIndexErrors(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.Close()
+	gz.Close()
+	if err := FromTar(&buf, &writerAtBuffer{}, ConvertOptions{TarIndex: true}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected error for compressed tar, got %v", err)
+	}
+	opts := ConvertOptions{WriterOptions: WriterOptions{BlockSize: 4096}, TarIndex: true}
+	if err := FromTar(&buf, &writerAtBuffer{}, opts); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected error for block size, got %v", err)
+	}
+}
+
+// imageTar returns the image as tar written by WriteTar with the root
+// directory, which is not included by WriteTar, prepended
+func imageTar(t testing.TB, img *Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	root := statOf(t, img, ".")
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     "./",
+		Mode:     int64(root.Mode.Perm()),
+		Uid:      int(root.UID),
+		Gid:      int(root.GID),
+		ModTime:  time.Unix(int64(root.Mtime), int64(root.MtimeNs)),
+		Format:   tar.FormatPAX,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTar(img, &buf, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// convertTar converts the tar stream from r to an image in a temporary file
+// and opens it with the options
+func convertTar(t testing.TB, r io.Reader, opts ConvertOptions, imgOpts ...Option) *Image {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "test.erofs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	opts.TempDir = t.TempDir()
+	if err := FromTar(r, f, opts); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Open(f, imgOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestFromTarWhiteouts(t *testing.T) {
+	b := tarOf(t,
+		tar.Header{Typeflag: tar.TypeDir, Name: "a/", Mode: 0o750, PAXRecords: map[string]string{"SCHILY.xattr.user.x": "1"}},
+		tar.Header{Typeflag: tar.TypeReg, Name: "a/.wh..wh..opq"},
+		tar.Header{Typeflag: tar.TypeReg, Name: "a/keep", Mode: 0o644},
+		tar.Header{Typeflag: tar.TypeReg, Name: ".wh.gone", Uid: 1000},
+		tar.Header{Typeflag: tar.TypeReg, Name: "b/.wh.x"},
+		tar.Header{Typeflag: tar.TypeReg, Name: "c/.wh..wh..opq"},
+		tar.Header{Typeflag: tar.TypeReg, Name: ".wh..wh.plnk"},
+	)
+	for _, tc := range []struct {
+		format WhiteoutFormat
+		xattr  string
+	}{
+		{WhiteoutOverlay, "trusted.overlay.opaque"},
+		{WhiteoutOverlayUser, "user.overlay.opaque"},
+	} {
+		t.Run(tc.xattr, func(t *testing.T) {
+			img := convertTar(t, bytes.NewReader(b), ConvertOptions{Whiteouts: tc.format})
+			checkXattrs(t, img, "/a", map[string]string{"user.x": "1", tc.xattr: "y"})
+			checkXattrs(t, img, "/c", map[string]string{tc.xattr: "y"})
+			if st := statOf(t, img, "a"); st.Mode != fs.ModeDir|0o750 {
+				t.Errorf("unexpected mode %v for opaque directory", st.Mode)
+			}
+			for _, p := range []string{"gone", "b/x"} {
+				checkDevice(t, img, "/"+p, fs.ModeCharDevice, 0)
+			}
+			if st := statOf(t, img, "gone"); st.UID != 1000 || st.Mode.Perm() != 0 {
+				t.Errorf("unexpected whiteout stat %+v", st)
+			}
+			var names []string
+			for e, err := range Walk(img, ".") {
+				if err != nil {
+					t.Fatal(err)
+				}
+				names = append(names, e.Path)
+			}
+			if expected := []string{".", "a", "a/keep", "b", "b/x", "c", "gone"}; !slices.Equal(names, expected) {
+				t.Errorf("unexpected entries %v, expected %v", names, expected)
+			}
+		})
+	}
+
+	img := convertTar(t, bytes.NewReader(b), ConvertOptions{})
+	if st := statOf(t, img, "a/.wh..wh..opq"); !st.Mode.IsRegular() {
+		t.Errorf("expected whiteout file to be kept, got %v", st.Mode)
+	}
+}
+
+// tarOf returns a tar holding the entries, regular files with content
+// are written as "name:content"
+func tarOf(t testing.TB, hdrs ...tar.Header) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		var data string
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Name, data, _ = strings.Cut(hdr.Name, ":")
+			hdr.Size = int64(len(data))
+		}
+		hdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFromLayers(t *testing.T) {
+	dir := func(name string) tar.Header {
+		return tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0o755}
+	}
+	file := func(name string) tar.Header {
+		return tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644}
+	}
+	lower := tarOf(t,
+		dir("a/"), file("a/old:old"), dir("a/sub/"), file("a/sub/x:x"),
+		file("gone:gone"), file("stay:lower"), dir("d/"), file("d/f:f"),
+		dir("w/"), file("w/f:f"), file("link:target"),
+	)
+	var upper bytes.Buffer
+	gz := gzip.NewWriter(&upper)
+	gz.Write(tarOf(t,
+		file("a/new:new"), file("a/.wh..wh..opq"), file("a/sub/y:y"),
+		file(".wh.gone"), file("stay:upper"), file("d/.wh.f"), file(".wh.w"),
+		tar.Header{Typeflag: tar.TypeLink, Name: "hardlink", Linkname: "link"},
+		file(".wh..wh.plnk"),
+	))
+	gz.Close()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "test.erofs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	layers := []io.Reader{bytes.NewReader(lower), &upper}
+	if err := FromLayers(layers, f, ConvertOptions{TempDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for e, err := range Walk(img, ".") {
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, e.Path)
+	}
+	expected := []string{".", "a", "a/new", "a/sub", "a/sub/y", "d", "hardlink", "link", "stay"}
+	if !slices.Equal(names, expected) {
+		t.Errorf("unexpected entries %v, expected %v", names, expected)
+	}
+	for name, content := range map[string]string{"stay": "upper", "a/new": "new", "hardlink": "target"} {
+		if b, err := fs.ReadFile(img, name); err != nil || string(b) != content {
+			t.Errorf("unexpected content %q for %s: %v", b, name, err)
+		}
+	}
+	if st := statOf(t, img, "a"); len(st.Xattrs) != 0 {
+		t.Errorf("unexpected xattrs %v for opaque directory", st.Xattrs)
+	}
+	if st := statOf(t, img, "link"); st.Nlink != 2 {
+		t.Errorf("expected hardlink across layers, got %d links", st.Nlink)
+	}
+}
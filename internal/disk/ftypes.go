@@ -77,6 +77,60 @@ func EroFSModeToGoFileMode(mode uint16) fs.FileMode {
 	return m
 }
 
+// GoFileModeToEroFSMode converts a Go FileMode to the mode stored in inodes
+func GoFileModeToEroFSMode(m fs.FileMode) uint16 {
+	mode := uint16(m.Perm())
+	switch m.Type() {
+	case 0:
+		mode |= StatTypeReg
+	case fs.ModeDir:
+		mode |= StatTypeDir
+	case fs.ModeCharDevice, fs.ModeDevice | fs.ModeCharDevice:
+		mode |= StatTypeChrdev
+	case fs.ModeDevice:
+		mode |= StatTypeBlkdev
+	case fs.ModeNamedPipe:
+		mode |= StatTypeFifo
+	case fs.ModeSocket:
+		mode |= StatTypeSock
+	case fs.ModeSymlink:
+		mode |= StatTypeSymlink
+	}
+	if m&fs.ModeSetuid != 0 {
+		mode |= StatTypeIsUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= StatTypeIsGID
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= StatTypeIsVTX
+	}
+	return mode
+}
+
+// GoFileModeToFtype converts the type of a Go FileMode to the file type
+// stored in directory entries
+func GoFileModeToFtype(m fs.FileMode) uint8 {
+	switch m.Type() {
+	case 0:
+		return FileTypeReg
+	case fs.ModeDir:
+		return FileTypeDir
+	case fs.ModeCharDevice, fs.ModeDevice | fs.ModeCharDevice:
+		return FileTypeChrdev
+	case fs.ModeDevice:
+		return FileTypeBlkdev
+	case fs.ModeNamedPipe:
+		return FileTypeFifo
+	case fs.ModeSocket:
+		return FileTypeSock
+	case fs.ModeSymlink:
+		return FileTypeSymlink
+	default:
+		return 0
+	}
+}
+
 func RdevFromMode(mode uint16, inodeData uint32) uint32 {
 	switch mode & StatTypeMask {
 	case StatTypeChrdev, StatTypeBlkdev, StatTypeFifo, StatTypeSock:
@@ -86,3 +140,21 @@ func RdevFromMode(mode uint16, inodeData uint32) uint32 {
 		return 0 // Not a device type
 	}
 }
+
+// RdevMajor returns the major number of a device number in the encoding
+// stored in inodes
+func RdevMajor(rdev uint32) uint32 {
+	return (rdev & 0xfff00) >> 8
+}
+
+// RdevMinor returns the minor number of a device number in the encoding
+// stored in inodes
+func RdevMinor(rdev uint32) uint32 {
+	return (rdev & 0xff) | ((rdev >> 12) & 0xfff00)
+}
+
+// Mkdev returns the device number in the encoding stored in inodes for the
+// major and minor numbers
+func Mkdev(major, minor uint32) uint32 {
+	return (minor & 0xff) | (major&0xfff)<<8 | (minor&^0xff)<<12
+}
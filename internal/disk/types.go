@@ -19,6 +19,45 @@ const (
 
 	LayoutChunkFormatBits    = 0x001F
 	LayoutChunkFormatIndexes = 0x0020
+
+	SizeDeviceSlot  = 128
+	SizeChunkIndex  = 8
+	SizeChunkAddr   = 4
+	SizeMapHeader   = 8
+	SizeLclusterIdx = 8
+
+	NullAddr = 0xFFFFFFFF
+
+	// Incompatible feature flags in the super block
+	FeatureIncompatChunkedFile   = 0x00000004
+	FeatureIncompatDeviceTable   = 0x00000008
+	FeatureIncompatXattrPrefixes = 0x00000040
+
+	// XattrEntry.NameIndex flag indicating a long prefix, the remaining
+	// bits are the index in the long prefix table
+	XattrLongPrefixBit  = 0x80
+	XattrLongPrefixMask = 0x7F
+
+	// Map header advise flags for compressed inodes
+	AdviseCompacted2B        = 0x0001
+	AdviseBigPcluster1       = 0x0002
+	AdviseBigPcluster2       = 0x0004
+	AdviseInlinePcluster     = 0x0008
+	AdviseInterlacedPcluster = 0x0010
+	AdviseFragmentPcluster   = 0x0020
+
+	// MapHeader.ClusterBits flag indicating the whole file is in a fragment
+	FragmentInodeBit = 0x80
+
+	// Logical cluster types for compressed inodes
+	LclusterTypePlain   = 0
+	LclusterTypeHead1   = 1
+	LclusterTypeNonhead = 2
+	LclusterTypeHead2   = 3
+
+	// Flag in the first delta of a non-head lcluster indicating the
+	// compressed block count of a big pcluster
+	LclusterD0Cblkcnt = 1 << 11
 )
 
 type SuperBlock struct {
@@ -49,18 +88,17 @@ type SuperBlock struct {
 }
 
 type InodeCompact struct {
-	Format       uint16
-	XattrCount   uint16
-	Mode         uint16
-	Nlink        uint16
-	Size         uint32
-	Reserved     uint32
-	InodeData    uint32
-	RawBlockSize uint16
-	Inode        uint32
-	UID          uint16
-	GID          uint16
-	Reserved2    uint32
+	Format     uint16
+	XattrCount uint16
+	Mode       uint16
+	Nlink      uint16
+	Size       uint32
+	Reserved   uint32
+	InodeData  uint32
+	Inode      uint32
+	UID        uint16
+	GID        uint16
+	Reserved2  uint32
 }
 
 type InodeExtended struct {
@@ -123,3 +161,36 @@ type XattrLongPrefix struct {
 	BaseIndex uint8 // short xattr name prefix index
 	// Infix part after short prefix
 }
+
+// DeviceSlot describes an extra device in the device table
+type DeviceSlot struct {
+	Tag           [64]uint8 // digest or other identifier of the device
+	Blocks        uint32    // total blocks of the device
+	MappedBlkAddr uint32    // start address of the device in a unified address space
+	Reserved      [56]uint8
+}
+
+// ChunkIndex is the chunk index entry used by chunk based inodes
+// with LayoutChunkFormatIndexes
+type ChunkIndex struct {
+	Advise   uint16
+	DeviceID uint16 // back-end storage id, 0 for the primary device
+	BlkAddr  uint32 // start block address of the chunk, NullAddr for holes
+}
+
+// MapHeader is the header following the inode and xattrs of compressed inodes
+type MapHeader struct {
+	FragmentOff   uint32 // fragment offset, or reserved (16) and inline data size (16)
+	Advise        uint16
+	AlgorithmType uint8
+	ClusterBits   uint8 // logical cluster bits minus block size bits in low 4 bits
+}
+
+// LclusterIndex is the full (non-compact) logical cluster index of a
+// compressed inode
+type LclusterIndex struct {
+	Advise     uint16 // lcluster type in low 2 bits
+	ClusterOfs uint16
+	// BlkAddr for head and plain lclusters, two 16 bit deltas for non-head
+	BlkAddr uint32
+}
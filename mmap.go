@@ -0,0 +1,162 @@
+package erofs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync/atomic"
+)
+
+// OpenFile opens the erofs image at the given path. On Linux the image is
+// memory mapped read-only, reads of uncompressed data are copied straight
+// from the mapping and File.Bytes can return file contents without copying.
+// Block caches are not used for mapped images. On other platforms the file
+// is read with ReadAt.
+//
+// The image must be closed to close the file, reads after Close return
+// fs.ErrClosed. The mapping is only released once the image and every file
+// which returned a slice from File.Bytes are closed.
+func OpenFile(path string, opts ...Option) (*Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := mmapFile(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to map %s: %w", path, err)
+	}
+	if data == nil {
+		// Memory mapping not supported, read from the file
+		img, err := Open(f, opts...)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		img.release = f.Close
+		return img, nil
+	}
+	// The mapping stays valid after the file is closed
+	f.Close()
+
+	m := &mapping{data: data}
+	m.refs.Store(1)
+	img, err := Open(m, opts...)
+	if err != nil {
+		munmap(data)
+		return nil, err
+	}
+	img.mapped = m
+	img.metaCache = nil
+	img.dataCache = nil
+	img.release = m.release
+	return img, nil
+}
+
+// mapping is a memory mapped image. The image holds a reference until it is
+// closed, as does every file which handed out a slice of the mapping, and
+// reads hold one while copying. The data is unmapped with the last reference.
+type mapping struct {
+	data []byte
+	refs atomic.Int64
+}
+
+// acquire takes a reference on the mapping, it returns false once the
+// mapping has been released
+func (m *mapping) acquire() bool {
+	for {
+		n := m.refs.Load()
+		if n == 0 {
+			return false
+		}
+		if m.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (m *mapping) release() error {
+	if m.refs.Add(-1) == 0 {
+		return munmap(m.data)
+	}
+	return nil
+}
+
+func (m *mapping) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d: %w", off, ErrInvalid)
+	}
+	if !m.acquire() {
+		return 0, fs.ErrClosed
+	}
+	defer m.release()
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Bytes returns the contents of the file as a slice of the memory mapped
+// image without copying. The file data must be uncompressed and stored
+// contiguously, such as flat files and chunk based files without holes whose
+// chunks are adjacent, otherwise ErrNotMapped is returned. ErrNotMapped is
+// also returned when the image was not opened with OpenFile or cannot be
+// memory mapped on the platform.
+//
+// The returned slice must not be modified and is only valid until both the
+// file and the image are closed.
+func (b *File) Bytes() ([]byte, error) {
+	if b.img.closed.Load() {
+		return nil, &fs.PathError{Op: "read", Path: b.name, Err: fs.ErrClosed}
+	}
+	if b.img.mapped == nil {
+		return nil, fmt.Errorf("image for %s: %w", b.name, ErrNotMapped)
+	}
+	fi, err := b.readInfo(false)
+	if err != nil {
+		return nil, err
+	}
+	if obj, err := b.openObject(); err != nil {
+		return nil, err
+	} else if obj != nil {
+		return nil, fmt.Errorf("data for %s is in the object store: %w", b.name, ErrNotMapped)
+	}
+	if fi.size == 0 {
+		return []byte{}, nil
+	}
+	ext, err := b.img.mapExtent(fi, 0)
+	if err != nil {
+		return nil, err
+	}
+	if ext.physical == -1 || ext.device != 0 || ext.length != fi.size {
+		return nil, fmt.Errorf("data for %s is not contiguous: %w", b.name, ErrNotMapped)
+	}
+	end := ext.physical + ext.length
+	if end > int64(len(b.img.mapped.data)) {
+		return nil, fmt.Errorf("data for %s beyond end of image: %w", b.name, ErrInvalid)
+	}
+	if !b.mapRef {
+		// Keep the data mapped until the file is closed
+		if !b.img.mapped.acquire() {
+			return nil, &fs.PathError{Op: "read", Path: b.name, Err: fs.ErrClosed}
+		}
+		b.mapRef = true
+	}
+	return b.img.mapped.data[ext.physical:end:end], nil
+}
+
+// writeTo writes n bytes of the mapping at off to w, holding a reference so
+// the data stays mapped while w reads from it
+func (m *mapping) writeTo(w io.Writer, off, n int64) (int, error) {
+	if !m.acquire() {
+		return 0, fs.ErrClosed
+	}
+	defer m.release()
+	return w.Write(m.data[off : off+n])
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package erofs
+
+import "os"
+
+// mmapFile returns no mapping, images are read from the file
+func mmapFile(f *os.File) ([]byte, error) {
+	return nil, nil
+}
+
+func munmap(b []byte) error {
+	return nil
+}
@@ -0,0 +1,116 @@
+package erofs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"runtime"
+	"testing"
+)
+
+func TestOpenFile(t *testing.T) {
+	for _, name := range []string{
+		"default",
+		"chunk-4096",
+		"chunk-8192",
+	} {
+		t.Run(name, func(t *testing.T) {
+			img, err := OpenFile("testdata/basic-"+name+".erofs", WithBlockCache(1<<20, 1<<20))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer img.Close()
+
+			checkFileString(t, img, "/in-root.txt", "root file content\n")
+			checkFileBytes(t, img, "/usr/lib/testdir/13k-zeros.raw", bytes.Repeat([]byte{0}, 1024*13))
+			checkFileBytes(t, img, "/usr/lib/testdir/5k-sequence.raw", bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 128*5))
+			checkFileBytes(t, img, "/usr/lib/testdir/16k-sequence.raw", bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 128*16))
+			checkDirectorySize(t, img, "/usr/lib/testdir/lotsoffiles", 5000)
+			checkXattrs(t, img, "/usr/lib/withxattr/f1", map[string]string{
+				"user.xdg.comment": "comment for f1",
+				"user.common":      "same-value",
+			})
+
+			for fname, content := range map[string][]byte{
+				"/in-root.txt":                      []byte("root file content\n"),
+				"/usr/lib/testdir/16k-sequence.raw": bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 128*16),
+			} {
+				f, err := img.Open(fname)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := f.(*File).Bytes()
+				if runtime.GOOS != "linux" || (name != "default" && len(content) > 4096) {
+					// Not mapped, or identical chunks are deduplicated so the data
+					// is not contiguous
+					if !errors.Is(err, ErrNotMapped) {
+						t.Errorf("expected not mapped error for %s, got %v", fname, err)
+					}
+				} else if err != nil {
+					t.Errorf("unexpected error getting bytes for %s: %v", fname, err)
+				} else if !bytes.Equal(b, content) {
+					t.Errorf("unexpected bytes for %s", fname)
+				}
+				f.Close()
+			}
+		})
+	}
+}
+
+func TestBytesNotMapped(t *testing.T) {
+	efs, err := EroFS(loadTestFile(t, "basic-default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := efs.Open("/in-root.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.(*File).Bytes(); !errors.Is(err, ErrNotMapped) {
+		t.Errorf("expected not mapped error, got %v", err)
+	}
+}
+
+func TestReadAfterClose(t *testing.T) {
+	img, err := OpenFile("testdata/basic-default.erofs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := img.Open("/usr/lib/testdir/16k-sequence.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := img.Open("/in-root.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := g.(*File).Bytes()
+	if err != nil && !errors.Is(err, ErrNotMapped) {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Read(make([]byte, 4096)); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("expected closed error from read, got %v", err)
+	}
+	if _, err := f.(*File).WriteTo(io.Discard); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("expected closed error from write to, got %v", err)
+	}
+	if _, err := f.(*File).Bytes(); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("expected closed error from bytes, got %v", err)
+	}
+	// Slices from Bytes stay mapped until the file is closed
+	if b != nil && string(b) != "root file content\n" {
+		t.Errorf("unexpected bytes after close: %q", b)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,279 @@
+package erofs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Overlay returns a read-only file system merging the layers as overlayfs
+// does, with the layers given from the lowest to the topmost. Directories
+// present in several layers are merged and other files are taken from the
+// topmost layer holding them. The returned file system implements
+// fs.StatFS and fs.ReadDirFS.
+//
+// Character devices with device number 0/0 are whiteouts hiding the entry
+// in lower layers. Directories with the trusted.overlay.opaque or
+// user.overlay.opaque xattr set to "y" hide the contents of lower layers
+// and the trusted.overlay.redirect or user.overlay.redirect xattr of a
+// directory gives the path of its contents in lower layers, either
+// relative to the parent directory or absolute. Xattrs are read from the
+// *Stat returned by the file info of the layers, as for erofs images.
+func Overlay(layers ...fs.FS) fs.FS {
+	o := &overlayFS{}
+	for _, l := range slices.Backward(layers) {
+		o.layers = append(o.layers, l)
+	}
+	return o
+}
+
+type overlayFS struct {
+	layers []fs.FS // topmost layer first
+}
+
+// layerEntry is the entry for a path in one layer of the overlay
+type layerEntry struct {
+	layer int
+	path  string
+	info  fs.FileInfo
+}
+
+// lookup returns the layer entries merged at name, topmost first. Only
+// directories are merged, for other files the topmost entry is returned.
+func (o *overlayFS) lookup(name string) ([]layerEntry, error) {
+	stack, err := o.roots(0)
+	if err != nil || name == "." {
+		return stack, err
+	}
+	for _, elem := range strings.Split(name, "/") {
+		var (
+			next     []layerEntry
+			redirect string
+		)
+		for k := 0; k < len(stack); k++ {
+			le := stack[k]
+			p := path.Join(le.path, elem)
+			if redirect != "" {
+				p = path.Join(le.path, redirect)
+			}
+			fi, err := fs.Stat(o.layers[le.layer], p)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if isWhiteout(fi) {
+				break
+			}
+			if !fi.IsDir() {
+				// Lower files are hidden by a directory above
+				if len(next) == 0 {
+					next = append(next, layerEntry{le.layer, p, fi})
+				}
+				break
+			}
+			next = append(next, layerEntry{le.layer, p, fi})
+			if v, _ := overlayXattr(fi, "opaque"); v == "y" {
+				break
+			}
+			if v, ok := overlayXattr(fi, "redirect"); ok && v != "" {
+				if target, ok := strings.CutPrefix(v, "/"); ok {
+					// Absolute redirects are looked up from the root of all
+					// lower layers
+					roots, err := o.roots(le.layer + 1)
+					if err != nil {
+						return nil, err
+					}
+					stack = append(stack[:k+1:k+1], roots...)
+					v = path.Clean(target)
+				}
+				redirect = v
+			}
+		}
+		if len(next) == 0 {
+			return nil, fs.ErrNotExist
+		}
+		stack = next
+	}
+	return stack, nil
+}
+
+// roots returns the root directories of the layers starting at layer i
+func (o *overlayFS) roots(i int) ([]layerEntry, error) {
+	var roots []layerEntry
+	for ; i < len(o.layers); i++ {
+		fi, err := fs.Stat(o.layers[i], ".")
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, layerEntry{i, ".", fi})
+	}
+	return roots, nil
+}
+
+// isWhiteout reports whether fi is an overlayfs whiteout
+func isWhiteout(fi fs.FileInfo) bool {
+	if fi.Mode()&fs.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := fi.Sys().(*Stat)
+	return ok && st.Rdev == 0
+}
+
+// overlayXattr returns the value of the trusted or user overlay xattr
+func overlayXattr(fi fs.FileInfo, name string) (string, bool) {
+	st, ok := fi.Sys().(*Stat)
+	if !ok {
+		return "", false
+	}
+	if v, ok := st.Xattrs["trusted.overlay."+name]; ok {
+		return v, true
+	}
+	v, ok := st.Xattrs["user.overlay."+name]
+	return v, ok
+}
+
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	stack, err := o.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	top := stack[0]
+	if !top.info.IsDir() {
+		return o.layers[top.layer].Open(top.path)
+	}
+	return &overlayDir{fs: o, stack: stack, info: renamed(top.info, name)}, nil
+}
+
+func (o *overlayFS) Stat(name string) (fs.FileInfo, error) {
+	stack, err := o.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return renamed(stack[0].info, name), nil
+}
+
+func (o *overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	stack, err := o.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !stack[0].info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	ents, err := o.readDir(stack)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return ents, nil
+}
+
+// resolve returns the layer entries for name, returning path errors for op
+func (o *overlayFS) resolve(op, name string) ([]layerEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	stack, err := o.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return stack, nil
+}
+
+// readDir returns the merged entries of the directory, sorted by name.
+// Entries are taken from the topmost layer holding them and whiteouts are
+// left out.
+func (o *overlayFS) readDir(stack []layerEntry) ([]fs.DirEntry, error) {
+	seen := map[string]bool{}
+	var ents []fs.DirEntry
+	for _, le := range stack {
+		layerEnts, err := fs.ReadDir(o.layers[le.layer], le.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range layerEnts {
+			if seen[e.Name()] {
+				continue
+			}
+			seen[e.Name()] = true
+			if e.Type()&fs.ModeCharDevice != 0 {
+				fi, err := e.Info()
+				if err != nil {
+					return nil, err
+				}
+				if isWhiteout(fi) {
+					continue
+				}
+			}
+			ents = append(ents, e)
+		}
+	}
+	slices.SortFunc(ents, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return ents, nil
+}
+
+// renamedInfo is file info with the name of the path in the overlay, which
+// differs from the name in the layer for redirected directories
+type renamedInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi renamedInfo) Name() string {
+	return fi.name
+}
+
+// renamed returns fi with the base name of the overlay path name
+func renamed(fi fs.FileInfo, name string) fs.FileInfo {
+	if base := path.Base(name); fi.Name() != base {
+		return renamedInfo{fi, base}
+	}
+	return fi
+}
+
+// overlayDir is a merged directory opened from an overlay
+type overlayDir struct {
+	fs    *overlayFS
+	stack []layerEntry
+	info  fs.FileInfo
+	ents  []fs.DirEntry
+	read  bool
+}
+
+func (d *overlayDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *overlayDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *overlayDir) Close() error {
+	return nil
+}
+
+func (d *overlayDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		ents, err := d.fs.readDir(d.stack)
+		if err != nil {
+			return nil, err
+		}
+		d.ents, d.read = ents, true
+	}
+	if n <= 0 {
+		ents := d.ents
+		d.ents = nil
+		return ents, nil
+	}
+	if len(d.ents) == 0 {
+		return nil, io.EOF
+	}
+	ents := d.ents[:min(n, len(d.ents))]
+	d.ents = d.ents[len(ents):]
+	return ents, nil
+}
@@ -0,0 +1,114 @@
+package erofs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestOverlay(t *testing.T) {
+	whiteout := &fstest.MapFile{Mode: fs.ModeDevice | fs.ModeCharDevice, Sys: &Stat{}}
+	dir := func(xattrs map[string]string) *fstest.MapFile {
+		return &fstest.MapFile{Mode: fs.ModeDir | 0o755, Sys: &Stat{Mode: fs.ModeDir | 0o755, Xattrs: xattrs}}
+	}
+	file := func(s string) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(s), Mode: 0o644}
+	}
+	lower := fstest.MapFS{
+		"a":            dir(nil),
+		"a/old":        file("old"),
+		"a/sub/x":      file("x"),
+		"gone":         file("gone"),
+		"stay":         file("lower"),
+		"d/f":          file("f"),
+		"dir/x":        file("x"),
+		"olddir/file":  file("o"),
+		"filedir":      file("file"),
+		"dev/null":     &fstest.MapFile{Mode: fs.ModeDevice | fs.ModeCharDevice, Sys: &Stat{Rdev: 0x103}},
+		"unstat/dev":   &fstest.MapFile{Mode: fs.ModeDevice | fs.ModeCharDevice},
+		"unstat/other": file("other"),
+	}
+
+	// The middle layer is an erofs image
+	var buf writerAtBuffer
+	w, err := NewWriter(&buf, WriterOptions{BlockSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := func(s string) func() (io.ReadCloser, error) {
+		return func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(s)), nil
+		}
+	}
+	for _, e := range []*Entry{
+		{Path: "stay", Stat: Stat{Mode: 0o644, Size: 6}, Open: content("middle")},
+		{Path: "gone", Stat: Stat{Mode: fs.ModeDevice | fs.ModeCharDevice}},
+		{Path: "d", Stat: Stat{Mode: fs.ModeDir | 0o755, Xattrs: map[string]string{"trusted.overlay.opaque": "y"}}},
+		{Path: "d/new", Stat: Stat{Mode: 0o644, Size: 3}, Open: content("new")},
+		{Path: "renamed", Stat: Stat{Mode: fs.ModeDir | 0o755, Xattrs: map[string]string{"trusted.overlay.redirect": "olddir"}}},
+		{Path: "renamed/added", Stat: Stat{Mode: 0o644, Size: 5}, Open: content("added")},
+		{Path: "olddir", Stat: Stat{Mode: fs.ModeDevice | fs.ModeCharDevice}},
+		{Path: "filedir/x", Stat: Stat{Mode: 0o644, Size: 1}, Open: content("x")},
+	} {
+		if err := w.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	middle, err := Open(bytes.NewReader(buf.b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upper := fstest.MapFS{
+		"a":     dir(map[string]string{"user.overlay.opaque": "y"}),
+		"a/new": file("new"),
+		"abs":   dir(map[string]string{"user.overlay.redirect": "/dir"}),
+		"dir":   whiteout,
+	}
+
+	o := Overlay(lower, middle, upper)
+	expected := []string{
+		"a/new", "abs/x", "d/new", "dev/null", "filedir/x", "renamed/added",
+		"renamed/file", "stay", "unstat/dev", "unstat/other",
+	}
+	if err := fstest.TestFS(o, expected...); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	if err := fs.WalkDir(o, ".", func(p string, d fs.DirEntry, err error) error {
+		names = append(names, p)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	all := []string{
+		".", "a", "a/new", "abs", "abs/x", "d", "d/new", "dev", "dev/null",
+		"filedir", "filedir/x", "renamed", "renamed/added", "renamed/file",
+		"stay", "unstat", "unstat/dev", "unstat/other",
+	}
+	if !slices.Equal(names, all) {
+		t.Errorf("unexpected entries %v, expected %v", names, all)
+	}
+	for name, data := range map[string]string{"stay": "middle", "renamed/file": "o", "abs/x": "x"} {
+		if b, err := fs.ReadFile(o, name); err != nil || string(b) != data {
+			t.Errorf("unexpected content %q for %s: %v", b, name, err)
+		}
+	}
+	for _, name := range []string{"gone", "a/old", "a/sub", "d/f", "dir", "olddir", "dir/x"} {
+		if _, err := fs.Stat(o, name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected %s to not exist, got %v", name, err)
+		}
+	}
+	if fi, err := fs.Stat(o, "renamed"); err != nil || fi.Name() != "renamed" {
+		t.Errorf("unexpected info for redirected directory: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package erofs
+
+import (
+	"sync"
+)
+
+// readaheadBuffers is the number of prefetched windows kept per file, the
+// window being consumed and the one after it
+const readaheadBuffers = 2
+
+// readahead tracks sequential access for an open file and prefetches
+// upcoming file data in the background
+type readahead struct {
+	img *Image
+	fi  *fileInfo
+	ext *extent // last extent mapped by reads of the file
+
+	max    int64 // maximum window size
+	min    int64 // minimum window size, one block
+	window int64 // current window size
+	next   int64 // offset expected for the next sequential read
+
+	// bufs are the prefetched windows in file order
+	bufs []*raBuffer
+
+	// inflight tracks all prefetches, including dropped ones
+	inflight sync.WaitGroup
+}
+
+// raBuffer is a window of file data being prefetched. The data is held in
+// buf, or in the data cache of the image when it has one, in which case
+// buf is nil and the window is read through the cache once prefetched.
+type raBuffer struct {
+	off  int64
+	size int64
+	buf  []byte
+	n    int
+	done chan struct{}
+}
+
+func newReadahead(img *Image, fi *fileInfo, ext *extent) *readahead {
+	blkSize := int64(1) << img.sb.BlkSizeBits
+	ra := &readahead{
+		img: img,
+		fi:  fi,
+		ext: ext,
+		max: max(img.readahead, blkSize),
+		min: blkSize,
+	}
+	ra.window = max(ra.max/4, ra.min)
+	return ra
+}
+
+// readAt reads file data at off, using prefetched data when available. The
+// window grows on sequential reads and is halved on random access.
+func (ra *readahead) readAt(p []byte, off int64) (int, error) {
+	sequential := off == ra.next
+	if sequential {
+		ra.window = min(ra.window*2, ra.max)
+	} else {
+		ra.window = max(ra.window/2, ra.min)
+		ra.drop(len(ra.bufs))
+	}
+
+	var n int
+	for len(ra.bufs) > 0 && n < len(p) {
+		rb := ra.bufs[0]
+		pos := off + int64(n)
+		if pos < rb.off {
+			break
+		}
+		<-rb.done
+		if pos >= rb.off+int64(rb.n) {
+			// Prefetched data is already consumed, failed to read or was
+			// added to the data cache, any read error is returned by
+			// reading the data directly
+			ra.drop(1)
+			continue
+		}
+		n += copy(p[n:], rb.buf[pos-rb.off:rb.n])
+	}
+
+	var err error
+	if n < len(p) {
+		var rn int
+		rn, err = ra.img.readAt(ra.fi, p[n:], off+int64(n), ra.ext)
+		n += rn
+	}
+	ra.next = off + int64(n)
+
+	if sequential {
+		ra.prefetch()
+	}
+	return n, err
+}
+
+// prefetch starts reading the windows following the last read
+func (ra *readahead) prefetch() {
+	start := ra.next
+	if len(ra.bufs) > 0 {
+		last := ra.bufs[len(ra.bufs)-1]
+		start = last.off + last.size
+	}
+	for len(ra.bufs) < readaheadBuffers && start < ra.fi.size {
+		rb := &raBuffer{
+			off:  start,
+			size: min(ra.window, ra.fi.size-start),
+			done: make(chan struct{}),
+		}
+		if ra.img.dataCache == nil {
+			rb.buf = make([]byte, rb.size)
+		}
+		ra.inflight.Add(1)
+		go func() {
+			defer ra.inflight.Done()
+			defer close(rb.done)
+			if rb.buf == nil {
+				// Errors are returned when the data is read
+				ra.img.cacheRange(ra.fi, rb.off, rb.size)
+				return
+			}
+			rb.n, _ = ra.img.readAt(ra.fi, rb.buf, rb.off, nil)
+		}()
+		ra.bufs = append(ra.bufs, rb)
+		start += rb.size
+	}
+}
+
+// drop discards the first n prefetched windows without waiting for them
+func (ra *readahead) drop(n int) {
+	ra.bufs = ra.bufs[n:]
+}
+
+// close waits for all prefetches so none outlive the open file
+func (ra *readahead) close() {
+	ra.bufs = nil
+	ra.inflight.Wait()
+}
+
+// cacheRange adds n bytes of file data at off to the data cache. Data on
+// extra devices is not cached and is skipped.
+func (img *Image) cacheRange(fi *fileInfo, off, n int64) error {
+	end := min(off+n, fi.size)
+	for off < end {
+		ext, err := img.mapExtent(fi, off)
+		if err != nil {
+			return err
+		}
+		l := min(end, ext.logical+ext.length) - off
+		if ext.physical != -1 && ext.device == 0 {
+			if err := img.fillCached(img.dataCache, ext.physical+off-ext.logical, l); err != nil {
+				return err
+			}
+		}
+		off += l
+	}
+	return nil
+}
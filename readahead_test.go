@@ -0,0 +1,104 @@
+package erofs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadahead(t *testing.T) {
+	efs, err := EroFS(loadTestFile(t, "basic-chunk-4096"), WithReadahead(8192))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 128*16)
+	f, err := efs.Open("/usr/lib/testdir/16k-sequence.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := iotest.TestReader(f, content); err != nil {
+		t.Fatal(err)
+	}
+
+	f2, err := efs.Open("/usr/lib/testdir/16k-sequence.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	b, err := io.ReadAll(iotest.HalfReader(f2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Fatal("unexpected content reading with readahead")
+	}
+
+	ra := f2.(*File).ra
+	if ra == nil {
+		t.Fatal("expected readahead state after reading")
+	}
+	if ra.window != ra.max {
+		t.Errorf("expected window to grow to %d on sequential reads, got %d", ra.max, ra.window)
+	}
+
+	// Random access shrinks the window and drops prefetched data
+	buf := make([]byte, 10)
+	for _, off := range []int64{8000, 100, 12000} {
+		n, err := ra.readAt(buf, off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], content[off:off+int64(n)]) {
+			t.Errorf("unexpected content at %d", off)
+		}
+	}
+	if ra.window != ra.min {
+		t.Errorf("expected window to shrink to %d on random reads, got %d", ra.min, ra.window)
+	}
+	if len(ra.bufs) != 0 {
+		t.Errorf("expected no prefetched windows after random reads, got %d", len(ra.bufs))
+	}
+}
+
+func TestReadaheadCache(t *testing.T) {
+	efs, err := EroFS(loadTestFile(t, "basic-default"), WithReadahead(8192), WithBlockCache(0, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := efs.(*Image)
+
+	content := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 128*16)
+	f, err := efs.Open("/usr/lib/testdir/16k-sequence.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 4096)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		t.Fatal(err)
+	}
+	ra := f.(*File).ra
+	if len(ra.bufs) == 0 {
+		t.Fatal("expected prefetched windows after sequential read")
+	}
+	for _, rb := range ra.bufs {
+		if rb.buf != nil {
+			t.Error("expected prefetched data to be held in the data cache")
+		}
+		<-rb.done
+	}
+	hits := img.CacheStats().DataHits
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(buf, b...), content) {
+		t.Fatal("unexpected content reading with readahead")
+	}
+	if img.CacheStats().DataHits == hits {
+		t.Error("expected reads to be served from prefetched cache blocks")
+	}
+}
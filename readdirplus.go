@@ -0,0 +1,122 @@
+package erofs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+// maxInodeRunBlocks is the maximum number of metadata blocks read with
+// a single ReadAt when loading inodes for directory entries.
+const maxInodeRunBlocks = 32
+
+// ReadDirPlus is like ReadDir but returns entries with their info already
+// loaded, so calling Info on the returned entries does not read from the
+// image. Inodes for entries in the same or adjacent metadata blocks are read
+// together, which for most directories results in a single read per batch
+// of entries rather than one read per entry.
+func (d *Dir) ReadDirPlus(n int) ([]fs.DirEntry, error) {
+	ents, err := d.ReadDir(n)
+	if len(ents) == 0 {
+		return ents, err
+	}
+
+	files := make([]*File, 0, len(ents))
+	for _, e := range ents {
+		files = append(files, &e.(*direntry).File)
+	}
+	if lerr := d.img.loadInfos(files); lerr != nil {
+		return nil, lerr
+	}
+	return ents, err
+}
+
+// loadInfos loads the inode info for the given files, grouping inodes by
+// metadata block and reading runs of adjacent blocks with a single read.
+func (img *Image) loadInfos(files []*File) error {
+	var pending []*File
+	for _, f := range files {
+		if f.info != nil {
+			continue
+		}
+		if fi := img.cachedInfo(f.inode, f.name, true); fi != nil {
+			f.info = fi
+			continue
+		}
+		pending = append(pending, f)
+	}
+	slices.SortFunc(pending, func(a, b *File) int {
+		switch {
+		case a.inode < b.inode:
+			return -1
+		case a.inode > b.inode:
+			return 1
+		}
+		return 0
+	})
+
+	bits := img.sb.BlkSizeBits
+	blkSize := int64(1) << bits
+	for len(pending) > 0 {
+		// Extend the run while the next inode is in the same or next block
+		start := img.inodeAddr(pending[0].inode) >> bits
+		end := start
+		var runN int
+		for runN < len(pending) {
+			bn := img.inodeAddr(pending[runN].inode) >> bits
+			if bn > end+1 || bn-start >= maxInodeRunBlocks {
+				break
+			}
+			end = bn
+			runN++
+		}
+		run := pending[:runN]
+		pending = pending[runN:]
+
+		// Include the following block when the last inode may cross into it
+		last := img.inodeAddr(run[len(run)-1].inode)
+		if last+disk.SizeInodeExtended > (end+1)<<bits {
+			end++
+		}
+
+		buf := make([]byte, (end-start+1)<<bits)
+		n, err := img.readMeta(buf, start<<bits)
+		if err != nil && !(errors.Is(err, io.EOF) && n > 0) {
+			return fmt.Errorf("failed to read inodes at block %d: %w", start, err)
+		}
+		buf = buf[:n]
+
+		for _, f := range run {
+			addr := img.inodeAddr(f.inode)
+			ioff := addr - start<<bits
+			if ioff+disk.SizeInodeExtended > int64(len(buf)) {
+				// Inode not fully read, fallback to loading directly
+				if _, err := f.readInfo(true); err != nil {
+					return err
+				}
+				continue
+			}
+
+			blk := img.getBlock()
+			blk.offset = int32(addr & (blkSize - 1))
+			blk.end = int32(blkSize)
+			if int64(blk.end-blk.offset) < disk.SizeInodeExtended {
+				// Inode may span into the next block, copy it to the start
+				// of the buffer as done when reading a single inode
+				blk.offset = 0
+				blk.end = disk.SizeInodeExtended
+				copy(blk.buf[:disk.SizeInodeExtended], buf[ioff:])
+			} else {
+				blk.end = int32(copy(blk.buf, buf[ioff-int64(blk.offset):]))
+			}
+			if _, err := f.decodeInfo(addr, blk, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package erofs
+
+import (
+	"io"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+type countingReaderAt struct {
+	io.ReaderAt
+	reads atomic.Int64
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.reads.Add(1)
+	return r.ReaderAt.ReadAt(p, off)
+}
+
+func TestReadDirPlus(t *testing.T) {
+	for _, name := range []string{
+		"default",
+		"chunk-4096",
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := &countingReaderAt{ReaderAt: loadTestFile(t, "basic-"+name)}
+			efs, err := EroFS(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := efs.Open("/usr/lib/testdir/lotsoffiles")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			d := f.(*Dir)
+
+			start := r.reads.Load()
+			ents, err := d.ReadDirPlus(-1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Inodes should be read in batches rather than one by one
+			if reads := r.reads.Load() - start; reads > int64(len(ents)/10) {
+				t.Errorf("too many reads for %d entries: %d", len(ents), reads)
+			}
+			if len(ents) != 5000 {
+				t.Fatalf("unexpected number of entries: got %d, expected 5000", len(ents))
+			}
+
+			before := r.reads.Load()
+			for _, e := range ents {
+				fi, err := e.Info()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Name() != e.Name() {
+					t.Errorf("unexpected name %q, expected %q", fi.Name(), e.Name())
+				}
+				if _, ok := fi.Sys().(*Stat); !ok {
+					t.Errorf("expected *Stat for %s, got %T", e.Name(), fi.Sys())
+				}
+			}
+			if after := r.reads.Load(); after != before {
+				t.Errorf("expected no reads after ReadDirPlus, got %d", after-before)
+			}
+
+			// Compare against individually loaded entries
+			expected, err := efs.Open("/usr/lib/testdir/lotsoffiles")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer expected.Close()
+			plain, err := expected.(*Dir).ReadDir(-1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, e := range plain {
+				efi, err := e.Info()
+				if err != nil {
+					t.Fatal(err)
+				}
+				afi, _ := ents[i].Info()
+				if !reflect.DeepEqual(efi.Sys(), afi.Sys()) {
+					t.Errorf("unexpected stat for %s: %+v, expected %+v", e.Name(), afi.Sys(), efi.Sys())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package erofs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"syscall"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+// Whence values for Seek in addition to io.SeekStart, io.SeekCurrent and
+// io.SeekEnd, matching the values used by lseek on Linux
+const (
+	// SeekData seeks to the next offset at or after offset containing data
+	SeekData = 3
+	// SeekHole seeks to the next hole at or after offset, the end of the
+	// file is considered a hole
+	SeekHole = 4
+)
+
+// Seek sets the offset for the next Read or WriteTo, implementing io.Seeker.
+// SeekData and SeekHole can be used to skip over unallocated chunks of sparse
+// files without reading them. Only chunk based files have holes, all other
+// files are treated as data up to the end of the file.
+func (b *File) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = b.offset + offset
+	case io.SeekEnd, SeekData, SeekHole:
+		fi, err := b.readInfo(false)
+		if err != nil {
+			return 0, err
+		}
+		if whence == io.SeekEnd {
+			pos = fi.size + offset
+			break
+		}
+		if offset < 0 || offset >= fi.size {
+			return 0, fmt.Errorf("seek %s to %d: %w", b.name, offset, ErrNoData)
+		}
+		if obj, err := b.openObject(); err != nil {
+			return 0, err
+		} else if obj != nil {
+			// Objects are treated as data up to the end of the file
+			pos = offset
+			if whence == SeekHole {
+				pos = fi.size
+			}
+			break
+		}
+		pos, err = b.img.seekHole(fi, offset, whence == SeekHole)
+		if err != nil {
+			return 0, fmt.Errorf("seek %s to %d: %w", b.name, offset, err)
+		}
+	default:
+		return 0, fmt.Errorf("seek whence %d: %w", whence, ErrInvalid)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("seek %s to negative position: %w", b.name, ErrInvalid)
+	}
+	b.offset = pos
+	return pos, nil
+}
+
+// seekHole returns the first offset at or after pos which is in a hole or,
+// when hole is false, contains data
+func (img *Image) seekHole(fi *fileInfo, pos int64, hole bool) (int64, error) {
+	if fi.inodeLayout != disk.LayoutChunkBased {
+		if hole {
+			return fi.size, nil
+		}
+		return pos, nil
+	}
+	for pos < fi.size {
+		ext, err := img.mapExtent(fi, pos)
+		if err != nil {
+			return 0, err
+		}
+		if (ext.physical == -1) == hole {
+			return pos, nil
+		}
+		pos = ext.logical + ext.length
+	}
+	if hole {
+		return fi.size, nil
+	}
+	return 0, ErrNoData
+}
+
+// sparseEntry is a range of data in a sparse file
+type sparseEntry struct {
+	offset, length int64
+}
+
+// dataSegments returns the ranges of data in the first size bytes of r
+// using SeekData and SeekHole. When r is not an io.Seeker or cannot seek to
+// data and holes, the whole file is data. Only files in erofs images are
+// probed on platforms other than Linux, which use different whence values.
+// The position of r is reset to the start.
+func dataSegments(r io.Reader, size int64) ([]sparseEntry, error) {
+	all := []sparseEntry{{0, size}}
+	s, ok := r.(io.Seeker)
+	if _, image := r.(*File); !ok || size == 0 || runtime.GOOS != "linux" && !image {
+		return all, nil
+	}
+	var data []sparseEntry
+	for off := int64(0); off < size; {
+		start, err := s.Seek(off, SeekData)
+		if errors.Is(err, ErrNoData) || errors.Is(err, syscall.ENXIO) {
+			break
+		} else if err != nil {
+			data = all
+			break
+		}
+		if start >= size {
+			break
+		}
+		// Seekers ignoring the whence values return the offset itself
+		end, err := s.Seek(start, SeekHole)
+		if err != nil || start < off || end <= start {
+			data = all
+			break
+		}
+		end = min(end, size)
+		data = append(data, sparseEntry{start, end - start})
+		off = end
+	}
+	_, err := s.Seek(0, io.SeekStart)
+	return data, err
+}
@@ -0,0 +1,94 @@
+package erofs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestSeekDataHole(t *testing.T) {
+	const size = 13 * 1024
+	for _, tc := range []struct {
+		name   string
+		whence int
+		offset int64
+		pos    int64
+		err    error
+	}{
+		{name: "default", whence: SeekData, offset: 0, pos: 0},
+		{name: "default", whence: SeekData, offset: 100, pos: 100},
+		{name: "default", whence: SeekHole, offset: 0, pos: size},
+		{name: "default", whence: SeekHole, offset: size, err: ErrNoData},
+		{name: "chunk-4096", whence: SeekData, offset: 0, pos: 12288},
+		{name: "chunk-4096", whence: SeekHole, offset: 0, pos: 0},
+		{name: "chunk-4096", whence: SeekHole, offset: 12290, pos: size},
+		{name: "chunk-8192", whence: SeekData, offset: 100, pos: 8192},
+		{name: "chunk-8192", whence: SeekData, offset: 9000, pos: 9000},
+		{name: "chunk-8192", whence: SeekHole, offset: 8191, pos: 8191},
+		{name: "chunk-8192", whence: SeekData, offset: size, err: ErrNoData},
+		{name: "chunk-8192", whence: SeekData, offset: -1, err: ErrNoData},
+	} {
+		efs, err := EroFS(loadTestFile(t, "basic-"+tc.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := efs.Open("/usr/lib/testdir/13k-zeros.raw")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pos, err := f.(io.Seeker).Seek(tc.offset, tc.whence)
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%s: seek(%d, %d): expected error %v, got %v", tc.name, tc.offset, tc.whence, tc.err, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: seek(%d, %d): %v", tc.name, tc.offset, tc.whence, err)
+		} else if pos != tc.pos {
+			t.Errorf("%s: seek(%d, %d): got %d, expected %d", tc.name, tc.offset, tc.whence, pos, tc.pos)
+		}
+		f.Close()
+	}
+}
+
+func TestSeek(t *testing.T) {
+	efs, err := EroFS(loadTestFile(t, "basic-chunk-4096"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := efs.Open("/usr/lib/testdir/5k-sequence.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	content := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 128*5)
+
+	s := f.(io.ReadSeeker)
+	for _, tc := range []struct {
+		offset int64
+		whence int
+		pos    int64
+	}{
+		{offset: 4090, whence: io.SeekStart, pos: 4090},
+		{offset: -10, whence: io.SeekCurrent, pos: 4083},
+		{offset: -3, whence: io.SeekEnd, pos: 5117},
+	} {
+		pos, err := s.Seek(tc.offset, tc.whence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos != tc.pos {
+			t.Fatalf("seek(%d, %d): got %d, expected %d", tc.offset, tc.whence, pos, tc.pos)
+		}
+		b := make([]byte, 3)
+		if _, err := io.ReadFull(s, b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, content[pos:pos+3]) {
+			t.Errorf("unexpected content after seek to %d: %v", pos, b)
+		}
+	}
+	if _, err := s.Seek(-1, io.SeekStart); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected invalid error seeking to negative offset, got %v", err)
+	}
+}
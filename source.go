@@ -0,0 +1,261 @@
+package erofs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"maps"
+	"path"
+	"strings"
+)
+
+// Entry is a file, directory or other inode added to a Writer
+type Entry struct {
+	// Path is the slash separated path of the entry relative to the root of
+	// the image, "." for the root directory
+	Path string
+
+	// Stat is the metadata of the entry. The Mode, UID, GID, Mtime, MtimeNs,
+	// Rdev and Xattrs are written, Size is the size of regular files. Other
+	// fields are ignored.
+	Stat Stat
+
+	// Link is the target of a symlink
+	Link string
+
+	// Hardlink is the path of a previously added entry which is not a
+	// directory. When set, the entry is a hardlink to the same inode and the
+	// other fields except Path are ignored.
+	Hardlink string
+
+	// Open returns the content of a regular file, which must be Stat.Size
+	// bytes long. It is called when the writer is closed.
+	Open func() (io.ReadCloser, error)
+}
+
+// Source provides the entries for a Writer
+type Source interface {
+	// Entries returns the entries in the order they are added. Entries
+	// replace earlier entries with the same path and missing parent
+	// directories are created.
+	Entries() iter.Seq2[*Entry, error]
+}
+
+// Add adds an entry to the image, replacing an existing entry at the same
+// path. A directory replacing a directory keeps its entries.
+func (w *Writer) Add(e *Entry) error {
+	p := path.Clean(e.Path)
+	n, err := w.entryNode(p, e)
+	if err != nil {
+		return err
+	}
+	return w.add(p, n)
+}
+
+// entryNode returns the inode for the entry at path p, which is an existing
+// inode for hardlinks
+func (w *Writer) entryNode(p string, e *Entry) (*node, error) {
+	if e.Hardlink != "" {
+		target, err := w.lookup(path.Clean(e.Hardlink))
+		if err != nil {
+			return nil, fmt.Errorf("hardlink %s: %w", p, err)
+		}
+		if target.mode.IsDir() {
+			return nil, fmt.Errorf("hardlink %s to directory %s: %w", p, e.Hardlink, ErrInvalid)
+		}
+		return target, nil
+	}
+
+	n := &node{
+		mode:    e.Stat.Mode,
+		uid:     e.Stat.UID,
+		gid:     e.Stat.GID,
+		mtime:   e.Stat.Mtime,
+		mtimeNs: e.Stat.MtimeNs,
+		xattrs:  e.Stat.Xattrs,
+	}
+	if w.objectDir != "" {
+		n.xattrs = escapeOverlayXattrs(n.xattrs)
+	}
+	switch e.Stat.Mode.Type() {
+	case 0:
+		n.size = e.Stat.Size
+		n.open = e.Open
+		if n.size < 0 || n.size > 0 && n.open == nil {
+			return nil, fmt.Errorf("no content for %s: %w", p, ErrInvalid)
+		}
+	case fs.ModeSymlink:
+		n.link = e.Link
+	case fs.ModeDir:
+	default:
+		n.rdev = e.Stat.Rdev
+	}
+	return n, nil
+}
+
+// addDeviceFile adds the regular file entry e with its content stored at
+// byte offset off of the extra device dev rather than in the image
+func (w *Writer) addDeviceFile(e *Entry, dev uint16, off int64) error {
+	p := path.Clean(e.Path)
+	st := e.Stat
+	st.Size = 0
+	n, err := w.entryNode(p, &Entry{Path: p, Stat: st})
+	if err != nil {
+		return err
+	}
+	n.size = e.Stat.Size
+	n.device = dev
+	n.devOff = off
+	return w.add(p, n)
+}
+
+// addObjectFile adds the regular file entry e with its content stored in
+// the composefs object at path obj, referenced by the overlay xattrs with
+// the metacopy value
+func (w *Writer) addObjectFile(e *Entry, obj, metacopy string) error {
+	p := path.Clean(e.Path)
+	st := e.Stat
+	st.Size = 0
+	n, err := w.entryNode(p, &Entry{Path: p, Stat: st})
+	if err != nil {
+		return err
+	}
+	// The references are added after the xattrs of the entry are escaped
+	n.xattrs = maps.Clone(n.xattrs)
+	if n.xattrs == nil {
+		n.xattrs = map[string]string{}
+	}
+	n.xattrs[overlayXattrPrefix+redirectXattr] = "/" + strings.TrimPrefix(obj, "/")
+	n.xattrs[overlayXattrPrefix+metacopyXattr] = metacopy
+	n.size = e.Stat.Size
+	n.object = n.size > 0
+	return w.add(p, n)
+}
+
+// AddSource adds all entries from src to the image
+func (w *Writer) AddSource(src Source) error {
+	for e, err := range src.Entries() {
+		if err != nil {
+			return err
+		}
+		if err := w.Add(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup returns the inode at path p
+func (w *Writer) lookup(p string) (*node, error) {
+	n := w.root
+	if p == "." {
+		return n, nil
+	}
+	for _, name := range strings.Split(p, "/") {
+		if n = n.children[name]; n == nil {
+			return nil, fmt.Errorf("%s: %w", p, fs.ErrNotExist)
+		}
+	}
+	return n, nil
+}
+
+// FSSource returns a Source for the files in fsys. When the file info of an
+// entry returns a *Stat, as for erofs images, the ownership, device numbers
+// and xattrs are used and hardlinks are detected from the node ids of the
+// directory entries. Otherwise all files are owned by root.
+//
+// Symlinks are read with ReadLink when implemented by fsys, otherwise the
+// content of the symlink is used as the target as returned by erofs images.
+func FSSource(fsys fs.FS) Source {
+	return fsSource{fsys}
+}
+
+type fsSource struct {
+	fsys fs.FS
+}
+
+func (s fsSource) Entries() iter.Seq2[*Entry, error] {
+	return func(yield func(*Entry, error) bool) {
+		links := map[uint64]string{}
+		for we, err := range Walk(s.fsys, ".") {
+			if err != nil {
+				yield(nil, fmt.Errorf("failed to read %s: %w", we.Path, err))
+				return
+			}
+			e, err := s.entry(we, links)
+			if !yield(e, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLinkFS is implemented by file systems which can read symlinks,
+// matching fs.ReadLinkFS in newer Go versions
+type readLinkFS interface {
+	ReadLink(name string) (string, error)
+}
+
+func (s fsSource) entry(we *WalkEntry, links map[uint64]string) (*Entry, error) {
+	fi, err := we.Info()
+	if err != nil {
+		return nil, err
+	}
+	e := &Entry{Path: we.Path}
+	if st, ok := fi.Sys().(*Stat); ok {
+		e.Stat = *st
+	} else {
+		e.Stat = Stat{
+			Mode: fi.Mode(),
+			Size: fi.Size(),
+		}
+		if mtime := fi.ModTime(); mtime.Unix() > 0 {
+			e.Stat.Mtime = uint64(mtime.Unix())
+			e.Stat.MtimeNs = uint32(mtime.Nanosecond())
+		}
+	}
+	if de, ok := we.DirEntry.(DirEntry); ok && !we.IsDir() && e.Stat.Nlink > 1 {
+		if link, ok := links[de.Nid()]; ok {
+			return &Entry{Path: we.Path, Hardlink: link}, nil
+		}
+		links[de.Nid()] = we.Path
+	}
+
+	// Files in erofs images are opened from their directory entry rather
+	// than looking up the path again
+	open := func() (io.ReadCloser, error) {
+		if de, ok := we.DirEntry.(*direntry); ok {
+			f := de.File
+			return &f, nil
+		}
+		return s.fsys.Open(we.Path)
+	}
+	switch e.Stat.Mode.Type() {
+	case 0:
+		e.Open = open
+	case fs.ModeSymlink:
+		if rl, ok := s.fsys.(readLinkFS); ok {
+			e.Link, err = rl.ReadLink(we.Path)
+			return e, err
+		}
+		f, err := open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		target, err := io.ReadAll(f)
+		e.Link = string(target)
+		return e, err
+	}
+	return e, nil
+}
+
+// DirSource returns a Source for the directory tree at dir on the host.
+// Entries are read with lstat and llistxattr without following symlinks,
+// preserving ownership, device numbers, nanosecond modification times,
+// xattrs and hardlinks within the tree. On platforms other than Linux, the
+// files are read through os.DirFS as provided by FSSource.
+func DirSource(dir string) Source {
+	return newDirSource(dir)
+}
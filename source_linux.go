@@ -0,0 +1,138 @@
+package erofs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"iter"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/erofs/go-erofs/internal/disk"
+	"golang.org/x/sys/unix"
+)
+
+func newDirSource(dir string) Source {
+	return dirSource(dir)
+}
+
+type dirSource string
+
+func (s dirSource) Entries() iter.Seq2[*Entry, error] {
+	return func(yield func(*Entry, error) bool) {
+		links := map[[2]uint64]string{}
+		err := filepath.WalkDir(string(s), func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(string(s), p)
+			if err != nil {
+				return err
+			}
+			e, err := s.entry(p, filepath.ToSlash(rel), links)
+			if err != nil {
+				return err
+			}
+			if !yield(e, nil) {
+				return fs.SkipAll
+			}
+			return nil
+		})
+		if err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+func (s dirSource) entry(p, rel string, links map[[2]uint64]string) (*Entry, error) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(p, &st); err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: p, Err: err}
+	}
+	mode := disk.EroFSModeToGoFileMode(uint16(st.Mode))
+	if !mode.IsDir() && st.Nlink > 1 {
+		key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+		if link, ok := links[key]; ok {
+			return &Entry{Path: rel, Hardlink: link}, nil
+		}
+		links[key] = rel
+	}
+	xattrs, err := llistxattrs(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "llistxattr", Path: p, Err: err}
+	}
+
+	e := &Entry{
+		Path: rel,
+		Stat: Stat{
+			Mode:   mode,
+			UID:    st.Uid,
+			GID:    st.Gid,
+			Xattrs: xattrs,
+		},
+	}
+	if sec, nsec := st.Mtim.Unix(); sec > 0 {
+		e.Stat.Mtime = uint64(sec)
+		e.Stat.MtimeNs = uint32(nsec)
+	}
+	switch mode.Type() {
+	case 0:
+		e.Stat.Size = st.Size
+		e.Open = func() (io.ReadCloser, error) {
+			return os.Open(p)
+		}
+	case fs.ModeSymlink:
+		if e.Link, err = os.Readlink(p); err != nil {
+			return nil, err
+		}
+	case fs.ModeDir:
+	default:
+		// Convert from the glibc encoding used by the kernel
+		rdev := uint64(st.Rdev)
+		major := uint32((rdev>>8)&0xfff | (rdev>>32)&^0xfff)
+		minor := uint32(rdev&0xff | (rdev>>12)&^0xff)
+		e.Stat.Rdev = disk.Mkdev(major, minor)
+	}
+	return e, nil
+}
+
+// llistxattrs returns the xattrs of the file at p without following symlinks
+func llistxattrs(p string) (map[string]string, error) {
+	names, err := getxattrBuf(func(buf []byte) (int, error) {
+		return unix.Llistxattr(p, buf)
+	})
+	if errors.Is(err, syscall.ENOTSUP) {
+		return nil, nil
+	} else if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	xattrs := map[string]string{}
+	for _, name := range bytes.Split(bytes.TrimSuffix(names, []byte{0}), []byte{0}) {
+		value, err := getxattrBuf(func(buf []byte) (int, error) {
+			return unix.Lgetxattr(p, string(name), buf)
+		})
+		if err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = string(value)
+	}
+	return xattrs, nil
+}
+
+// getxattrBuf calls fn with a buffer which is grown until the result fits
+func getxattrBuf(fn func(buf []byte) (int, error)) ([]byte, error) {
+	buf := make([]byte, 256)
+	for {
+		n, err := fn(buf)
+		if errors.Is(err, syscall.ERANGE) && len(buf) < 1<<20 {
+			buf = make([]byte, len(buf)*4)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
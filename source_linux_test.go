@@ -0,0 +1,99 @@
+package erofs
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDirSource(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"a/b", "empty"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a/b/file"), []byte("content\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "a/b/file"), filepath.Join(dir, "a/hardlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("b/file", filepath.Join(dir, "a/symlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(dir, "fifo"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	xattrs := map[string]string{"user.test": "value"}
+	if err := unix.Lsetxattr(filepath.Join(dir, "a/b/file"), "user.test", []byte("value"), 0); errors.Is(err, syscall.ENOTSUP) {
+		xattrs = nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	sparse, err := os.Create(filepath.Join(dir, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sparse.WriteAt([]byte("data"), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	sparse.Close()
+	mtime := time.Unix(1600000000, 123456789)
+	if err := os.Chtimes(filepath.Join(dir, "a/b/file"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf writerAtBuffer
+	w, err := NewWriter(&buf, WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddSource(DirSource(dir)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	img, err := Open(bytes.NewReader(buf.b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkFileString(t, img, "/a/b/file", "content\n")
+	checkFileString(t, img, "/a/hardlink", "content\n")
+	checkFileString(t, img, "/a/symlink", "b/file")
+	checkDirectorySize(t, img, "/empty", 0)
+	if xattrs != nil {
+		checkXattrs(t, img, "/a/b/file", xattrs)
+	}
+	st := statOf(t, img, "/a/b/file")
+	if st.Nlink != 2 || st.Mode != 0o640 || int(st.UID) != os.Getuid() {
+		t.Errorf("unexpected stat %+v", st)
+	}
+	if st.Mtime != uint64(mtime.Unix()) || st.MtimeNs != uint32(mtime.Nanosecond()) {
+		t.Errorf("unexpected mtime %d.%d", st.Mtime, st.MtimeNs)
+	}
+	if link := statOf(t, img, "/a/hardlink"); link.Inode != st.Inode {
+		t.Errorf("expected hardlink to share inode")
+	}
+	if st := statOf(t, img, "/a"); st.Mode != fs.ModeDir|0o750 || st.Nlink != 3 {
+		t.Errorf("unexpected directory stat %+v", st)
+	}
+	sparseContent := make([]byte, 1<<20+4)
+	copy(sparseContent[1<<20:], "data")
+	checkFileBytes(t, img, "/sparse", sparseContent)
+	if len(buf.b) > 1<<19 {
+		t.Errorf("expected hole not to be stored, image is %d bytes", len(buf.b))
+	}
+	if st := statOf(t, img, "/fifo"); st.Mode != fs.ModeNamedPipe|0o600 {
+		t.Errorf("unexpected fifo mode %v", st.Mode)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package erofs
+
+import "os"
+
+func newDirSource(dir string) Source {
+	return FSSource(os.DirFS(dir))
+}
@@ -0,0 +1,146 @@
+package erofs
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+func TestCreateFromImage(t *testing.T) {
+	src, err := Open(loadTestFile(t, "basic-default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := createImage(t, src, WriterOptions{})
+	compareImages(t, src, img)
+	compareStats(t, src, img)
+	checkDevice(t, img, "/dev/char1", fs.ModeCharDevice, 0x00000303)
+	checkXattrs(t, img, "/usr/lib/withxattr/f1", map[string]string{
+		"user.xdg.comment": "comment for f1",
+		"user.common":      "same-value",
+	})
+}
+
+func TestWriterAdd(t *testing.T) {
+	var buf writerAtBuffer
+	w, err := NewWriter(&buf, WriterOptions{BlockSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := func(s string) func() (io.ReadCloser, error) {
+		return func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(s)), nil
+		}
+	}
+	xattrs := map[string]string{
+		"user.long":                strings.Repeat("v", 700),
+		"trusted.overlay.opaque":   "y",
+		"security.selinux":         "system_u:object_r:etc_t:s0",
+		"system.posix_acl_access":  "\x02\x00\x00\x00",
+		"system.posix_acl_default": "\x02\x00\x00\x00",
+		"other.name":               "x",
+	}
+	for _, e := range []*Entry{
+		{Path: ".", Stat: Stat{Mode: fs.ModeDir | 0o755, UID: 1, GID: 2, Mtime: 100}},
+		{Path: "etc/passwd", Stat: Stat{Mode: 0o644, Size: 5, UID: 70000, Mtime: 100, Xattrs: xattrs}, Open: content("root\n")},
+		{Path: "etc/group", Stat: Stat{Mode: 0o644, Size: 6, Mtime: 100}, Open: content("first\n")},
+		{Path: "etc/group", Stat: Stat{Mode: 0o600, Size: 7, Mtime: 100}, Open: content("second\n")},
+		{Path: "etc/link", Hardlink: "etc/passwd"},
+		{Path: "etc/symlink", Stat: Stat{Mode: fs.ModeSymlink | 0o777, Mtime: 100}, Link: "passwd"},
+		{Path: "dev/null", Stat: Stat{Mode: fs.ModeCharDevice | 0o666, Rdev: disk.Mkdev(1, 3), Mtime: 100}},
+		{Path: "dev/big", Stat: Stat{Mode: fs.ModeDevice | 0o600, Rdev: disk.Mkdev(259, 300000), Mtime: 100}},
+	} {
+		if err := w.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Add(&Entry{Path: "bad", Hardlink: "etc"}); err == nil {
+		t.Error("expected error adding hardlink to directory")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := Open(bytes.NewReader(buf.b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFileString(t, img, "/etc/passwd", "root\n")
+	checkFileString(t, img, "/etc/link", "root\n")
+	checkFileString(t, img, "/etc/group", "second\n")
+	checkFileString(t, img, "/etc/symlink", "passwd")
+	checkXattrs(t, img, "/etc/passwd", xattrs)
+	checkDevice(t, img, "/dev/null", fs.ModeCharDevice, 0x103)
+
+	st := statOf(t, img, "/dev/big")
+	if major, minor := disk.RdevMajor(st.Rdev), disk.RdevMinor(st.Rdev); major != 259 || minor != 300000 {
+		t.Errorf("unexpected device number %d:%d", major, minor)
+	}
+	st = statOf(t, img, "/etc/passwd")
+	if st.UID != 70000 || st.Nlink != 2 || st.Mode != 0o644 {
+		t.Errorf("unexpected stat %+v", st)
+	}
+	if link := statOf(t, img, "/etc/link"); link.Inode != st.Inode {
+		t.Errorf("expected hardlink to share inode %d, got %d", st.Inode, link.Inode)
+	}
+	if st := statOf(t, img, "/"); st.UID != 1 || st.GID != 2 || st.Nlink != 4 {
+		t.Errorf("unexpected root stat %+v", st)
+	}
+	if st := statOf(t, img, "/etc/group"); st.Mode != 0o600 {
+		t.Errorf("expected later entry to replace earlier, got mode %v", st.Mode)
+	}
+}
+
+// statOf returns the Stat for the file at p
+func statOf(t testing.TB, fsys fs.FS, p string) *Stat {
+	t.Helper()
+	fi, err := fs.Stat(fsys, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Sys().(*Stat)
+}
+
+// compareStats compares the ownership, xattrs, device numbers and link
+// counts of all entries in the images
+func compareStats(t testing.TB, expected, img *Image) {
+	t.Helper()
+	var stats []*Stat
+	for e, err := range Walk(expected, ".") {
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := e.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats = append(stats, fi.Sys().(*Stat))
+	}
+	var i int
+	for e, err := range Walk(img, ".") {
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := e.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, est := fi.Sys().(*Stat), stats[i]
+		i++
+		if st.UID != est.UID || st.GID != est.GID || st.Rdev != est.Rdev || st.Nlink != est.Nlink || st.Mode != est.Mode {
+			t.Errorf("%s: unexpected stat %+v, expected %+v", e.Path, st, est)
+		}
+		if len(st.Xattrs) != len(est.Xattrs) {
+			t.Errorf("%s: unexpected xattrs %v, expected %v", e.Path, st.Xattrs, est.Xattrs)
+		}
+		for k, v := range est.Xattrs {
+			if st.Xattrs[k] != v {
+				t.Errorf("%s: unexpected xattr %s %q, expected %q", e.Path, k, st.Xattrs[k], v)
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package erofs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// verityBlockSize is the Merkle tree block size of the fs-verity digests
+// used by composefs
+const verityBlockSize = 4096
+
+// verityDigest returns the fs-verity SHA-256 file digest of the content read
+// from r, using 4096 byte Merkle tree blocks without salt. This is the
+// digest reported by FS_IOC_MEASURE_VERITY and used by composefs.
+func verityDigest(r io.Reader) ([sha256.Size]byte, error) {
+	var (
+		hashes []byte
+		size   int64
+		buf    = make([]byte, verityBlockSize)
+	)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			clear(buf[n:])
+			h := sha256.Sum256(buf)
+			hashes = append(hashes, h[:]...)
+			size += int64(n)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		} else if err != nil {
+			return [sha256.Size]byte{}, err
+		}
+	}
+
+	// Each level holds the hashes of the blocks of the level below until a
+	// single hash remains, which is the root hash. The root hash of an
+	// empty file is all zeros.
+	var root [sha256.Size]byte
+	for len(hashes) > sha256.Size {
+		var next []byte
+		for off := 0; off < len(hashes); off += verityBlockSize {
+			clear(buf)
+			copy(buf, hashes[off:])
+			h := sha256.Sum256(buf)
+			next = append(next, h[:]...)
+		}
+		hashes = next
+	}
+	copy(root[:], hashes)
+
+	// struct fsverity_descriptor
+	desc := make([]byte, 256)
+	desc[0] = 1  // version
+	desc[1] = 1  // hash algorithm, SHA-256
+	desc[2] = 12 // log2 of the block size
+	binary.LittleEndian.PutUint64(desc[8:], uint64(size))
+	copy(desc[16:], root[:])
+	return sha256.Sum256(desc), nil
+}
@@ -0,0 +1,168 @@
+package erofs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"iter"
+	"path"
+)
+
+// HardlinkWalkFunc is the type of the function called by WalkHardlinks to
+// visit each file or directory. The path and err arguments are the same as
+// for fs.WalkDirFunc.
+//
+// When the entry refers to an inode which was already visited under another
+// path, link is set to the path where the inode was first seen. Otherwise
+// link is empty. Directories are never reported as links.
+type HardlinkWalkFunc func(path string, d fs.DirEntry, link string, err error) error
+
+// WalkHardlinks walks the file tree rooted at root in the same order as
+// fs.WalkDir, calling fn for each file or directory and reporting whether
+// the entry is the first path seen for its inode or a hardlink to a path
+// visited earlier.
+//
+// Only entries implementing DirEntry can be identified as hardlinks, entries
+// from other file systems are always reported as first seen.
+func WalkHardlinks(fsys fs.FS, root string, fn HardlinkWalkFunc) error {
+	seen := map[uint64]string{}
+	return fs.WalkDir(fsys, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return fn(path, d, "", err)
+		}
+		de, ok := d.(DirEntry)
+		if !ok {
+			return fn(path, d, "", nil)
+		}
+		if link, ok := seen[de.Nid()]; ok {
+			return fn(path, d, link, nil)
+		}
+		seen[de.Nid()] = path
+		return fn(path, d, "", nil)
+	})
+}
+
+// WalkEntry is an entry visited by Walk
+type WalkEntry struct {
+	fs.DirEntry
+
+	// Path is the path of the entry, formed by joining the root passed to
+	// Walk with the names of the directories leading to the entry
+	Path string
+
+	skip bool
+}
+
+// SkipDir prevents Walk from descending into the entry when the entry
+// is a directory. It has no effect on other entries.
+func (e *WalkEntry) SkipDir() {
+	e.skip = true
+}
+
+// Walk returns an iterator over the file tree rooted at root, visiting
+// directories before their contents in lexical order. Unlike fs.WalkDir,
+// directories of an erofs image are read with Dir.Entries one block at a
+// time, so memory use only grows with the depth of the tree rather than
+// the size of directories.
+//
+// Errors opening or reading a directory are yielded along with the entry for
+// that directory, after which iteration continues with the next sibling.
+// Call SkipDir on a directory entry to skip its contents.
+func Walk(fsys fs.FS, root string) iter.Seq2[*WalkEntry, error] {
+	return func(yield func(*WalkEntry, error) bool) {
+		d, err := rootEntry(fsys, root)
+		if err != nil {
+			yield(&WalkEntry{Path: root}, err)
+			return
+		}
+		walk(fsys, &WalkEntry{DirEntry: d, Path: root}, yield)
+	}
+}
+
+func rootEntry(fsys fs.FS, root string) (fs.DirEntry, error) {
+	f, err := fsys.Open(root)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if d, ok := f.(*Dir); ok {
+		return &direntry{File: File{
+			img:   d.img,
+			name:  d.name,
+			inode: d.inode,
+			ftype: d.ftype,
+		}}, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return fs.FileInfoToDirEntry(fi), nil
+}
+
+func walk(fsys fs.FS, e *WalkEntry, yield func(*WalkEntry, error) bool) bool {
+	if !yield(e, nil) {
+		return false
+	}
+	if !e.IsDir() || e.skip {
+		return true
+	}
+	for child, err := range readDirEntries(fsys, e) {
+		if err != nil {
+			return yield(e, err)
+		}
+		if !walk(fsys, &WalkEntry{DirEntry: child, Path: path.Join(e.Path, child.Name())}, yield) {
+			return false
+		}
+	}
+	return true
+}
+
+// readDirEntries iterates over the entries of the directory for a walk entry.
+// Directories in an erofs image are opened directly from their node id,
+// other file systems must implement fs.ReadDirFile.
+func readDirEntries(fsys fs.FS, e *WalkEntry) iter.Seq2[fs.DirEntry, error] {
+	return func(yield func(fs.DirEntry, error) bool) {
+		if de, ok := e.DirEntry.(*direntry); ok {
+			d := &Dir{File: File{
+				img:   de.img,
+				name:  de.name,
+				inode: de.inode,
+				ftype: de.ftype,
+			}}
+			for child, err := range d.Entries() {
+				if !yield(child, err) {
+					return
+				}
+			}
+			return
+		}
+
+		f, err := fsys.Open(e.Path)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer f.Close()
+		rd, ok := f.(fs.ReadDirFile)
+		if !ok {
+			yield(nil, &fs.PathError{Op: "readdir", Path: e.Path, Err: errors.New("not implemented")})
+			return
+		}
+		for {
+			ents, err := rd.ReadDir(128)
+			for _, child := range ents {
+				if !yield(child, nil) {
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					yield(nil, err)
+				}
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package erofs
+
+import (
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+func TestWalkHardlinks(t *testing.T) {
+	efs, err := EroFS(loadTestFile(t, "basic-default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nids := map[uint64]string{}
+	var files int
+	err = WalkHardlinks(efs, "/", func(path string, d fs.DirEntry, link string, err error) error {
+		if err != nil {
+			return err
+		}
+		if link != "" {
+			t.Errorf("unexpected hardlink from %s to %s", path, link)
+		}
+		de, ok := d.(DirEntry)
+		if !ok {
+			// Root entry is returned from stat
+			if path != "/" {
+				t.Errorf("expected erofs DirEntry for %s, got %T", path, d)
+			}
+			return nil
+		}
+		if other, ok := nids[de.Nid()]; ok {
+			t.Errorf("duplicate nid %d for %s and %s", de.Nid(), path, other)
+		}
+		nids[de.Nid()] = path
+		if !d.IsDir() {
+			files++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files < 5000 {
+		t.Errorf("expected at least 5000 files, got %d", files)
+	}
+}
+
+// hardlinkImage creates an image holding /a/file with a hardlink to it at
+// /b/link
+func hardlinkImage(t testing.TB) *Image {
+	t.Helper()
+	img, err := Open(testImage(t, []testEntry{
+		{path: "a", mode: disk.StatTypeDir | 0o755},
+		{path: "a/dir", mode: disk.StatTypeDir | 0o750},
+		{path: "a/file", mode: disk.StatTypeReg | 0o640, data: "shared\n"},
+		{path: "b", mode: disk.StatTypeDir | 0o755},
+		{path: "b/link", link: "a/file"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestWalkHardlinksLinked(t *testing.T) {
+	img := hardlinkImage(t)
+
+	links := map[string]string{}
+	err := WalkHardlinks(img, "/", func(path string, d fs.DirEntry, link string, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && link != "" {
+			t.Errorf("unexpected hardlink for directory %s to %s", path, link)
+		}
+		if link != "" {
+			links[path] = link
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links["/b/link"] != "/a/file" {
+		t.Errorf("expected /b/link to link to /a/file, got %v", links)
+	}
+
+	for _, p := range []string{"/a/file", "/b/link"} {
+		f, err := img.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := f.(*File).readInfo(true)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.isize != disk.SizeInodeCompact {
+			t.Errorf("%s: expected compact inode, got size %d", p, fi.isize)
+		}
+		if fi.stat.Nlink != 2 {
+			t.Errorf("%s: unexpected link count %d", p, fi.stat.Nlink)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	efs, err := EroFS(loadTestFile(t, "basic-default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []string
+	err = fs.WalkDir(efs, "/", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == "/usr/lib/testdir/lotsoffiles" {
+			return fs.SkipDir
+		}
+		expected = append(expected, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actual []string
+	for e, err := range Walk(efs, "/") {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Path == "/usr/lib/testdir/lotsoffiles" {
+			e.SkipDir()
+			continue
+		}
+		actual = append(actual, e.Path)
+	}
+
+	if len(actual) != len(expected) {
+		t.Fatalf("unexpected number of entries: got %d, expected %d", len(actual), len(expected))
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("unexpected entry %d: got %s, expected %s", i, actual[i], expected[i])
+		}
+	}
+}
+
+func TestDirEntries(t *testing.T) {
+	efs, err := EroFS(loadTestFile(t, "basic-default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := efs.Open("/usr/lib/testdir/lotsoffiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	d, ok := f.(*Dir)
+	if !ok {
+		t.Fatalf("expected *Dir, got %T", f)
+	}
+
+	var n int
+	var last string
+	for e, err := range d.Entries() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Name() <= last {
+			t.Errorf("entries out of order: %q after %q", e.Name(), last)
+		}
+		last = e.Name()
+		n++
+	}
+	if n != 5000 {
+		t.Errorf("unexpected number of entries: got %d, expected 5000", n)
+	}
+
+	// Batched reads must return the same entries
+	var batched int
+	for {
+		ents, err := d.ReadDir(100)
+		batched += len(ents)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if batched != n {
+		t.Errorf("unexpected number of batched entries: got %d, expected %d", batched, n)
+	}
+}
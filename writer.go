@@ -0,0 +1,739 @@
+package erofs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"math/bits"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+// WriterOptions configures a Writer
+type WriterOptions struct {
+	// BlockSize is the block size of the image, a power of two between 512
+	// and 65536. The default is 4096. Images can only be mounted by kernels
+	// with a page size of at least the block size.
+	BlockSize int
+
+	// XattrPrefixes are long xattr name prefixes such as "trusted.overlay.",
+	// stored once in the image instead of in every xattr name starting with
+	// them. Each prefix extends the user., trusted. or security. prefix and
+	// at most 128 prefixes are supported. Images with long prefixes can be
+	// mounted by Linux 6.4 and later.
+	XattrPrefixes []string
+
+	// ObjectDir writes a composefs image, storing the content of regular
+	// files in ObjectDir instead of the image. Each file is stored once in
+	// the object directory, at a path formed by the hex encoded fs-verity
+	// digest of its content split after the first byte. The file in the
+	// image is a sparse file referencing the object with the
+	// trusted.overlay.redirect and trusted.overlay.metacopy xattrs, using the
+	// "trusted.overlay." long xattr prefix. Existing trusted.overlay. xattrs
+	// of files are escaped as trusted.overlay.overlay. xattrs.
+	ObjectDir string
+}
+
+// Writer builds an erofs image. Files are added to the writer and the image
+// is laid out and written when the writer is closed.
+//
+// Inodes are written in the compact format unless a field does not fit or
+// the modification time differs from the build time of the image, which is
+// the most common modification time. The last partial block of files,
+// directories and symlinks is stored inline after the inode when it fits.
+// Directory entries are sorted by name and split across blocks as needed.
+// Regular files with holes, as reported by seeking the content with SeekData
+// and SeekHole, are written as chunk based files without storing the holes.
+type Writer struct {
+	w      io.WriterAt
+	bits   uint8
+	root   *node
+	closed bool
+
+	// devices are the extra devices referenced by chunk indexes
+	devices []disk.DeviceSlot
+
+	// prefixes are the long xattr name prefixes
+	prefixes []string
+	// objectDir is the composefs object directory, empty when the content
+	// of files is stored in the image
+	objectDir string
+}
+
+// NewWriter returns a Writer writing an image to w
+func NewWriter(w io.WriterAt, opts WriterOptions) (*Writer, error) {
+	blkSize := opts.BlockSize
+	if blkSize == 0 {
+		blkSize = 4096
+	}
+	if blkSize < 512 || blkSize > 65536 || blkSize&(blkSize-1) != 0 {
+		return nil, fmt.Errorf("invalid block size %d: %w", opts.BlockSize, ErrInvalid)
+	}
+	prefixes := slices.Clone(opts.XattrPrefixes)
+	if opts.ObjectDir != "" && !slices.Contains(prefixes, overlayXattrPrefix) {
+		prefixes = append(prefixes, overlayXattrPrefix)
+	}
+	if len(prefixes) > disk.XattrLongPrefixMask+1 {
+		return nil, fmt.Errorf("%d long xattr prefixes: %w", len(prefixes), ErrInvalid)
+	}
+	for i, p := range prefixes {
+		idx, infix := xattrPrefix(p)
+		if !strings.HasSuffix(idx.String(), ".") || infix == "" || slices.Contains(prefixes[:i], p) {
+			return nil, fmt.Errorf("invalid long xattr prefix %q: %w", p, ErrInvalid)
+		}
+	}
+	return &Writer{
+		w:    w,
+		bits: uint8(bits.TrailingZeros(uint(blkSize))),
+		root: &node{
+			mode:     fs.ModeDir | 0o755,
+			children: map[string]*node{},
+		},
+		prefixes:  prefixes,
+		objectDir: opts.ObjectDir,
+	}, nil
+}
+
+// Create writes an erofs image holding the files in src to w
+func Create(w io.WriterAt, src fs.FS, opts WriterOptions) error {
+	ew, err := NewWriter(w, opts)
+	if err != nil {
+		return err
+	}
+	if err := ew.CopyFS(src); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+// node is an inode in the image being written
+type node struct {
+	mode    fs.FileMode
+	uid     uint32
+	gid     uint32
+	mtime   uint64
+	mtimeNs uint32
+	size    int64
+	rdev    uint32
+	xattrs  map[string]string
+
+	// open returns the content of regular files
+	open func() (io.ReadCloser, error)
+	// link is the target of symlinks
+	link string
+	// children are the entries of directories by name
+	children map[string]*node
+
+	// Set when laying out the image
+	parent  *node
+	names   []string // sorted directory entry names, including . and ..
+	nid     uint64
+	ino     uint32
+	nlink   int
+	compact bool
+	xattr   []byte // encoded inline xattrs
+	inline  int64  // size of the tail stored after the inode and xattrs
+	blkaddr uint32
+
+	// Set for chunk based files, chunks holds the block address of each
+	// chunk or NullAddr for holes
+	chunkBits uint8
+	chunks    []uint32
+
+	// device is the extra device holding the data of regular files, which
+	// starts at byte offset devOff. The data is referenced by chunk indexes.
+	device uint16
+	devOff int64
+
+	// object is set for regular files with the content in a composefs
+	// object already referenced by the xattrs
+	object bool
+}
+
+// CopyFS adds the files in src to the image as provided by FSSource.
+// Regular files are opened and read from src when the writer is closed.
+func (w *Writer) CopyFS(src fs.FS) error {
+	return w.AddSource(FSSource(src))
+}
+
+// add adds the inode at path p, replacing an existing entry. Directories
+// replacing a directory keep its entries. Missing parent directories are
+// created.
+func (w *Writer) add(p string, n *node) error {
+	if !fs.ValidPath(p) {
+		return fmt.Errorf("invalid path %q: %w", p, ErrInvalid)
+	}
+	switch n.mode.Type() {
+	case 0, fs.ModeDir, fs.ModeSymlink, fs.ModeNamedPipe, fs.ModeSocket, fs.ModeDevice, fs.ModeCharDevice, fs.ModeDevice | fs.ModeCharDevice:
+	default:
+		return fmt.Errorf("unsupported file type %v for %s: %w", n.mode.Type(), p, ErrNotImplemented)
+	}
+	if n.mode.IsDir() {
+		n.children = map[string]*node{}
+	}
+	if p == "." {
+		if !n.mode.IsDir() {
+			return fmt.Errorf("root is not a directory: %w", ErrInvalid)
+		}
+		n.children = w.root.children
+		w.root = n
+		return nil
+	}
+
+	dir := w.root
+	elems := strings.Split(p, "/")
+	for _, name := range elems[:len(elems)-1] {
+		child := dir.children[name]
+		if child == nil {
+			child = &node{
+				mode:     fs.ModeDir | 0o755,
+				children: map[string]*node{},
+			}
+			dir.children[name] = child
+		} else if !child.mode.IsDir() {
+			return fmt.Errorf("parent of %s is not a directory: %w", p, ErrInvalid)
+		}
+		dir = child
+	}
+	name := elems[len(elems)-1]
+	if len(name) > maxNameLen {
+		return fmt.Errorf("name of %s too long: %w", p, ErrInvalid)
+	}
+	if old := dir.children[name]; old != nil && old.mode.IsDir() && n.mode.IsDir() {
+		n.children = old.children
+	}
+	dir.children[name] = n
+	return nil
+}
+
+// remove removes the entry at path p and its children if it exists
+func (w *Writer) remove(p string) {
+	dir, name := path.Split(p)
+	if parent, err := w.lookup(path.Clean(dir)); err == nil && name != "" {
+		delete(parent.children, name)
+	}
+}
+
+// maxNameLen is the maximum length of a directory entry name
+const maxNameLen = 255
+
+// Close lays out the image and writes it, reading the content of regular
+// files. The writer cannot be used after Close.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	blkSize := int64(1) << w.bits
+	nodes := w.collect()
+	var features uint32
+	for _, n := range nodes {
+		var err error
+		if n.device != 0 {
+			err = w.deviceChunks(n)
+		} else if n.object {
+			w.holeChunks(n)
+		} else if w.objectDir != "" && n.mode.IsRegular() && n.size > 0 {
+			err = w.writeObject(n)
+		} else {
+			err = w.probeHoles(n)
+		}
+		if err != nil {
+			return err
+		}
+		if n.chunks != nil {
+			features |= disk.FeatureIncompatChunkedFile
+		}
+	}
+	if len(w.devices) > 0 {
+		features |= disk.FeatureIncompatDeviceTable
+	}
+	if len(w.prefixes) > 0 {
+		features |= disk.FeatureIncompatXattrPrefixes
+	}
+
+	// Compact inodes use the build time as modification time
+	var (
+		buildTime   uint64
+		buildTimeNs uint32
+	)
+	type mtime struct {
+		sec uint64
+		ns  uint32
+	}
+	counts := map[mtime]int{}
+	for _, n := range nodes {
+		counts[mtime{n.mtime, n.mtimeNs}]++
+	}
+	best := -1
+	for t, c := range counts {
+		if c > best || c == best && (t.sec < buildTime || t.sec == buildTime && t.ns < buildTimeNs) {
+			buildTime, buildTimeNs, best = t.sec, t.ns, c
+		}
+	}
+
+	// Place the inodes with their inline tails in the metadata area
+	var pos int64
+	for i, n := range nodes {
+		n.ino = uint32(i + 1)
+		n.compact = n.size <= math.MaxUint32 && n.uid <= math.MaxUint16 && n.gid <= math.MaxUint16 &&
+			n.nlink <= math.MaxUint16 && n.mtime == buildTime && n.mtimeNs == buildTimeNs
+		isize := int64(disk.SizeInodeExtended)
+		if n.compact {
+			isize = disk.SizeInodeCompact
+		}
+		var err error
+		if n.xattr, err = encodeXattrs(n.xattrs, w.prefixes); err != nil {
+			return fmt.Errorf("inode %d: %w", n.ino, err)
+		}
+		isize += int64(len(n.xattr))
+
+		pos = alignUp(pos, disk.SizeInodeCompact)
+		n.inline = 0
+		switch n.mode.Type() {
+		case 0, fs.ModeDir, fs.ModeSymlink:
+			if n.device != 0 {
+				// Chunk indexes are aligned to their size
+				isize = alignUp(isize, disk.SizeChunkIndex) + int64(len(n.chunks))*disk.SizeChunkIndex
+				break
+			} else if n.chunks != nil {
+				isize += int64(len(n.chunks)) * disk.SizeChunkAddr
+				break
+			}
+			tail := n.size & (blkSize - 1)
+			if tail == 0 || isize+tail > blkSize {
+				break
+			}
+			// Pad to the next block when the tail does not fit in the current
+			// block, unless storing the tail in a data block wastes less space
+			if room := blkSize - pos&(blkSize-1); isize+tail <= room {
+				n.inline = tail
+			} else if room < blkSize-tail {
+				pos = alignUp(pos, blkSize)
+				n.inline = tail
+			}
+		}
+		n.nid = uint64(pos / disk.SizeInodeCompact)
+		pos += isize + n.inline
+	}
+	if nodes[0].nid > math.MaxUint16 {
+		return fmt.Errorf("root nid %d too large: %w", nodes[0].nid, ErrInvalid)
+	}
+
+	// The device table and the long xattr prefixes follow the super block,
+	// the metadata area follows them and data follows the metadata area
+	devtOff := int64(disk.SuperBlockOffset + disk.SizeSuperBlock)
+	prefixOff := devtOff + int64(len(w.devices))*disk.SizeDeviceSlot
+	prefixTable := encodeXattrPrefixes(w.prefixes)
+	metaBlk := alignUp(prefixOff+int64(len(prefixTable)), blkSize) >> w.bits
+	metaBlocks := alignUp(pos, blkSize) >> w.bits
+	blocks := metaBlk + metaBlocks
+	for _, n := range nodes {
+		if n.device != 0 {
+			continue
+		} else if n.chunks != nil {
+			chunkSize := int64(1) << n.chunkBits
+			for i, addr := range n.chunks {
+				if addr != disk.NullAddr {
+					n.chunks[i] = uint32(blocks)
+					blocks += alignUp(min(chunkSize, n.size-int64(i)*chunkSize), blkSize) >> w.bits
+				}
+			}
+		} else if nblocks := alignUp(n.size-n.inline, blkSize) >> w.bits; nblocks > 0 {
+			n.blkaddr = uint32(blocks)
+			blocks += nblocks
+		}
+	}
+	if blocks > math.MaxUint32 {
+		return fmt.Errorf("image too large with %d blocks: %w", blocks, ErrInvalid)
+	}
+
+	meta := make([]byte, (metaBlk+metaBlocks)<<w.bits)
+	metaStart := metaBlk << w.bits
+	for _, n := range nodes {
+		addr := metaStart + int64(n.nid)*disk.SizeInodeCompact
+		isize, err := w.encodeInode(meta[addr:], n)
+		if err != nil {
+			return err
+		}
+		addr += isize
+		addr += int64(copy(meta[addr:], n.xattr))
+		if n.device != 0 {
+			addr = metaStart + alignUp(addr-metaStart, disk.SizeChunkIndex)
+			for _, chunk := range n.chunks {
+				binary.Encode(meta[addr:], binary.LittleEndian, &disk.ChunkIndex{
+					DeviceID: n.device,
+					BlkAddr:  chunk,
+				})
+				addr += disk.SizeChunkIndex
+			}
+			continue
+		} else if n.chunks != nil {
+			for _, chunk := range n.chunks {
+				binary.LittleEndian.PutUint32(meta[addr:], chunk)
+				addr += disk.SizeChunkAddr
+			}
+			if err := w.writeChunks(n); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.writeData(n, meta[addr:]); err != nil {
+			return err
+		}
+	}
+
+	for i := range w.devices {
+		if _, err := binary.Encode(meta[devtOff+int64(i)*disk.SizeDeviceSlot:], binary.LittleEndian, &w.devices[i]); err != nil {
+			return err
+		}
+	}
+	copy(meta[prefixOff:], prefixTable)
+	sb := disk.SuperBlock{
+		MagicNumber:     disk.MagicNumber,
+		FeatureIncompat: features,
+		BlkSizeBits:     w.bits,
+		RootNid:         uint16(nodes[0].nid),
+		Inos:            uint64(len(nodes)),
+		BuildTime:       buildTime,
+		BuildTimeNs:     buildTimeNs,
+		Blocks:          uint32(blocks),
+		MetaBlkAddr:     uint32(metaBlk),
+		ExtraDevices:    uint16(len(w.devices)),
+		DevtSlotOff:     uint16(devtOff / disk.SizeDeviceSlot),
+	}
+	if len(w.prefixes) > 0 {
+		sb.XattrPrefixCount = uint8(len(w.prefixes))
+		sb.XattrPrefixStart = uint32(prefixOff / 4)
+	}
+	if _, err := binary.Encode(meta[disk.SuperBlockOffset:], binary.LittleEndian, &sb); err != nil {
+		return err
+	}
+	_, err := w.w.WriteAt(meta, 0)
+	return err
+}
+
+// collect returns the inodes in depth first order of sorted names starting
+// with the root, setting the link counts and directory entry names
+func (w *Writer) collect() []*node {
+	var nodes []*node
+	var visit func(n, parent *node)
+	visit = func(n, parent *node) {
+		n.nlink++
+		if n.nlink > 1 {
+			return
+		}
+		nodes = append(nodes, n)
+		if n.mode.Type() == fs.ModeSymlink {
+			n.size = int64(len(n.link))
+		}
+		if !n.mode.IsDir() {
+			return
+		}
+		n.parent = parent
+		n.nlink = 2
+		n.names = append(n.names[:0], ".", "..")
+		for name, child := range n.children {
+			n.names = append(n.names, name)
+			if child.mode.IsDir() {
+				n.nlink++
+			}
+		}
+		slices.Sort(n.names)
+		n.size = dirSize(n.names, int64(1)<<w.bits)
+		for _, name := range n.names {
+			if child := n.children[name]; child != nil {
+				visit(child, n)
+			}
+		}
+	}
+	visit(w.root, w.root)
+	return nodes
+}
+
+// dirSize returns the size of a directory with the sorted names, entries
+// are not split across blocks and the last block is not padded
+func dirSize(names []string, blkSize int64) int64 {
+	var size, used int64
+	for _, name := range names {
+		l := int64(disk.SizeDirent + len(name))
+		if used+l > blkSize {
+			size += blkSize
+			used = 0
+		}
+		used += l
+	}
+	return size + used
+}
+
+// encodeInode encodes the inode for n into b, returning the inode size
+func (w *Writer) encodeInode(b []byte, n *node) (int64, error) {
+	layout := uint16(disk.LayoutFlatPlain)
+	data := n.blkaddr
+	if n.inline > 0 {
+		layout = disk.LayoutFlatInline
+	} else if n.chunks != nil {
+		layout = disk.LayoutChunkBased
+		data = uint32(n.chunkBits - w.bits)
+		if n.device != 0 {
+			data |= disk.LayoutChunkFormatIndexes
+		}
+	}
+	switch n.mode.Type() {
+	case fs.ModeDevice, fs.ModeCharDevice, fs.ModeDevice | fs.ModeCharDevice, fs.ModeNamedPipe, fs.ModeSocket:
+		data = n.rdev
+	}
+	mode := disk.GoFileModeToEroFSMode(n.mode)
+	var xcount uint16
+	if len(n.xattr) > 0 {
+		xcount = uint16((len(n.xattr)-disk.SizeXattrBodyHeader)/disk.SizeXattrEntry + 1)
+	}
+	if n.compact {
+		ino := disk.InodeCompact{
+			Format:     layout << 1,
+			XattrCount: xcount,
+			Mode:       mode,
+			Nlink:      uint16(n.nlink),
+			Size:       uint32(n.size),
+			InodeData:  data,
+			Inode:      n.ino,
+			UID:        uint16(n.uid),
+			GID:        uint16(n.gid),
+		}
+		_, err := binary.Encode(b, binary.LittleEndian, &ino)
+		return disk.SizeInodeCompact, err
+	}
+	ino := disk.InodeExtended{
+		Format:     layout<<1 | 1,
+		XattrCount: xcount,
+		Mode:       mode,
+		Size:       uint64(n.size),
+		InodeData:  data,
+		Inode:      n.ino,
+		UID:        n.uid,
+		GID:        n.gid,
+		Mtime:      n.mtime,
+		MtimeNs:    n.mtimeNs,
+		Nlink:      uint32(n.nlink),
+	}
+	_, err := binary.Encode(b, binary.LittleEndian, &ino)
+	return disk.SizeInodeExtended, err
+}
+
+// writeData writes the data blocks of n and copies the inline tail into
+// the metadata following the inode
+func (w *Writer) writeData(n *node, tail []byte) error {
+	var r io.Reader
+	switch n.mode.Type() {
+	case 0:
+		if n.size == 0 {
+			return nil
+		}
+		f, err := n.open()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	case fs.ModeDir:
+		r = strings.NewReader(string(w.dirData(n)))
+	case fs.ModeSymlink:
+		r = strings.NewReader(n.link)
+	default:
+		return nil
+	}
+
+	blkSize := int64(1) << w.bits
+	size := n.size - n.inline
+	if err := w.copyBlocks(int64(n.blkaddr)<<w.bits, r, size, blkSize); err != nil {
+		return fmt.Errorf("failed to write data for inode %d: %w", n.ino, err)
+	}
+	if _, err := io.ReadFull(r, tail[:n.inline]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("failed to read inline data for inode %d: %w", n.ino, err)
+	}
+	if m, _ := r.Read(make([]byte, 1)); m > 0 {
+		return fmt.Errorf("data for inode %d larger than size %d: %w", n.ino, n.size, ErrInvalid)
+	}
+	return nil
+}
+
+// probeHoles finds the holes in the content of regular files, setting up
+// the chunks of sparse files. Chunks are as large as possible while keeping
+// holes and data aligned to chunks, holes smaller than a block are data.
+func (w *Writer) probeHoles(n *node) error {
+	n.chunks = nil
+	if !n.mode.IsRegular() || n.size == 0 {
+		return nil
+	}
+	r, err := n.open()
+	if err != nil {
+		return err
+	}
+	segs, err := dataSegments(r, n.size)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	blkSize := int64(1) << w.bits
+	var data []sparseEntry
+	for _, s := range segs {
+		start := s.offset &^ (blkSize - 1)
+		end := min(alignUp(s.offset+s.length, blkSize), n.size)
+		if last := len(data) - 1; last >= 0 && data[last].offset+data[last].length >= start {
+			data[last].length = end - data[last].offset
+		} else {
+			data = append(data, sparseEntry{start, end - start})
+		}
+	}
+	if len(data) == 1 && data[0].offset == 0 && data[0].length == n.size {
+		return nil
+	}
+
+	var bounds int64
+	for _, s := range data {
+		bounds |= s.offset
+		if end := s.offset + s.length; end < n.size {
+			bounds |= end
+		}
+	}
+	chunkBits := max(uint8(bits.Len64(uint64(n.size-1))), w.bits)
+	if bounds != 0 {
+		chunkBits = min(chunkBits, uint8(bits.TrailingZeros64(uint64(bounds))))
+	}
+	n.chunkBits = min(chunkBits, w.bits+disk.LayoutChunkFormatBits)
+	chunkSize := int64(1) << n.chunkBits
+	n.chunks = make([]uint32, (n.size+chunkSize-1)>>n.chunkBits)
+	for i := range n.chunks {
+		n.chunks[i] = disk.NullAddr
+	}
+	for _, s := range data {
+		for i := s.offset >> n.chunkBits; i<<n.chunkBits < s.offset+s.length; i++ {
+			// Allocated when laying out the data blocks
+			n.chunks[i] = 0
+		}
+	}
+	return nil
+}
+
+// deviceChunks sets up the chunks of a regular file stored contiguously on
+// an extra device. The file is covered by as few chunks as possible.
+func (w *Writer) deviceChunks(n *node) error {
+	n.chunks = nil
+	if n.size == 0 {
+		n.device = 0
+		return nil
+	}
+	if n.devOff&(1<<w.bits-1) != 0 || (n.devOff+n.size-1)>>w.bits >= disk.NullAddr {
+		return fmt.Errorf("invalid device offset %d for %d bytes of data: %w", n.devOff, n.size, ErrInvalid)
+	}
+	chunkBits := max(uint8(bits.Len64(uint64(n.size-1))), w.bits)
+	n.chunkBits = min(chunkBits, w.bits+disk.LayoutChunkFormatBits)
+	n.chunks = make([]uint32, (n.size-1)>>n.chunkBits+1)
+	for i := range n.chunks {
+		n.chunks[i] = uint32(n.devOff>>w.bits) + uint32(i)<<(n.chunkBits-w.bits)
+	}
+	return nil
+}
+
+// writeChunks writes the data chunks of a chunk based file
+func (w *Writer) writeChunks(n *node) error {
+	if !slices.ContainsFunc(n.chunks, func(addr uint32) bool { return addr != disk.NullAddr }) {
+		// Nothing to write for files which are one hole
+		return nil
+	}
+	r, err := n.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	s, ok := r.(io.Seeker)
+	if !ok {
+		return fmt.Errorf("content of inode %d not seekable: %w", n.ino, ErrInvalid)
+	}
+
+	blkSize := int64(1) << w.bits
+	chunkSize := int64(1) << n.chunkBits
+	for i, addr := range n.chunks {
+		if addr == disk.NullAddr {
+			continue
+		}
+		off := int64(i) << n.chunkBits
+		size := min(chunkSize, n.size-off)
+		if _, err := s.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+		if err := w.copyBlocks(int64(addr)<<w.bits, r, size, blkSize); err != nil {
+			return fmt.Errorf("failed to write data for inode %d: %w", n.ino, err)
+		}
+	}
+	return nil
+}
+
+// copyBlocks copies size bytes from r to off, padding the last block
+func (w *Writer) copyBlocks(off int64, r io.Reader, size, blkSize int64) error {
+	if _, err := io.CopyN(io.NewOffsetWriter(w.w, off), r, size); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if pad := alignUp(size, blkSize) - size; pad > 0 {
+		if _, err := w.w.WriteAt(make([]byte, pad), off+size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirData encodes the directory blocks for n
+func (w *Writer) dirData(n *node) []byte {
+	blkSize := int64(1) << w.bits
+	buf := make([]byte, 0, n.size)
+	for start := 0; start < len(n.names); {
+		// Find the entries which fit in the block
+		end, used := start, int64(0)
+		for end < len(n.names) && used+int64(disk.SizeDirent+len(n.names[end])) <= blkSize {
+			used += int64(disk.SizeDirent + len(n.names[end]))
+			end++
+		}
+		block := make([]byte, (end-start)*disk.SizeDirent, blkSize)
+		for i, name := range n.names[start:end] {
+			target := n.children[name]
+			switch name {
+			case ".":
+				target = n
+			case "..":
+				target = n.parent
+			}
+			de := disk.Dirent{
+				Nid:      target.nid,
+				NameOff:  uint16(len(block)),
+				FileType: disk.GoFileModeToFtype(target.mode),
+			}
+			binary.Encode(block[i*disk.SizeDirent:], binary.LittleEndian, &de)
+			block = append(block, name...)
+		}
+		if end < len(n.names) {
+			block = block[:blkSize]
+		}
+		buf = append(buf, block...)
+		start = end
+	}
+	return buf
+}
+
+// alignUp rounds n up to a multiple of the power of two a
+func alignUp(n, a int64) int64 {
+	return (n + a - 1) &^ (a - 1)
+}
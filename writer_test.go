@@ -0,0 +1,301 @@
+package erofs
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+func TestCreate(t *testing.T) {
+	src, err := Open(loadTestFile(t, "basic-default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blkSize := range []int{512, 4096, 16384} {
+		t.Run(strconv.Itoa(blkSize), func(t *testing.T) {
+			img := createImage(t, src, WriterOptions{BlockSize: blkSize})
+			if bits := img.sb.BlkSizeBits; 1<<bits != blkSize {
+				t.Fatalf("unexpected block size bits %d", bits)
+			}
+			compareImages(t, src, img)
+			checkDirectorySize(t, img, "/usr/lib/testdir/lotsoffiles", 5000)
+			checkFileBytes(t, img, "/usr/lib/testdir/16k-sequence.raw", bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 128*16))
+		})
+	}
+}
+
+func TestCreateLayout(t *testing.T) {
+	mtime := time.Unix(1700000000, 0)
+	src := fstest.MapFS{
+		".":           {Mode: fs.ModeDir | 0o755, ModTime: mtime},
+		"small":       {Data: []byte("small file\n"), Mode: 0o644, ModTime: mtime},
+		"tail":        {Data: bytes.Repeat([]byte("0123456789"), 450), Mode: 0o600, ModTime: mtime},
+		"blocks":      {Data: bytes.Repeat([]byte("abcdefgh"), 1024), Mode: 0o644, ModTime: mtime},
+		"newer":       {Data: []byte("newer\n"), Mode: fs.ModeSetuid | 0o755, ModTime: mtime.Add(time.Second + 5)},
+		"link":        {Data: []byte("small"), Mode: fs.ModeSymlink | 0o777, ModTime: mtime},
+		"!first":      {Mode: fs.ModeDir | 0o700, ModTime: mtime},
+		"!first/file": {Data: []byte("sorted before dot\n"), ModTime: mtime},
+		"fifo":        {Mode: fs.ModeNamedPipe | 0o644, ModTime: mtime},
+		"empty":       {Mode: 0o644, ModTime: mtime},
+	}
+	img := createImage(t, src, WriterOptions{})
+	compareImages(t, src, img)
+
+	for name, expected := range map[string]struct {
+		layout  uint8
+		compact bool
+	}{
+		"/small":  {disk.LayoutFlatInline, true},
+		"/tail":   {disk.LayoutFlatInline, true},
+		"/blocks": {disk.LayoutFlatPlain, true},
+		"/newer":  {disk.LayoutFlatInline, false},
+		"/link":   {disk.LayoutFlatInline, true},
+		"/":       {disk.LayoutFlatInline, true},
+	} {
+		st, err := fs.Stat(img, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi := st.(*fileInfo)
+		if fi.inodeLayout != expected.layout {
+			t.Errorf("%s: unexpected layout %d, expected %d", name, fi.inodeLayout, expected.layout)
+		}
+		if compact := fi.isize == disk.SizeInodeCompact; compact != expected.compact {
+			t.Errorf("%s: unexpected compact inode %t", name, compact)
+		}
+	}
+	if img.sb.BuildTime != uint64(mtime.Unix()) {
+		t.Errorf("unexpected build time %d", img.sb.BuildTime)
+	}
+
+	var again writerAtBuffer
+	if err := Create(&again, src, WriterOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var first writerAtBuffer
+	if err := Create(&first, src, WriterOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.b, again.b) {
+		t.Error("expected identical images for the same input")
+	}
+}
+
+func TestCreateErrors(t *testing.T) {
+	for _, blkSize := range []int{256, 3000, 1 << 17} {
+		if _, err := NewWriter(&writerAtBuffer{}, WriterOptions{BlockSize: blkSize}); !errors.Is(err, ErrInvalid) {
+			t.Errorf("expected invalid block size %d error, got %v", blkSize, err)
+		}
+	}
+	src := fstest.MapFS{
+		strings.Repeat("x", 256): {Data: []byte("x")},
+	}
+	if err := Create(&writerAtBuffer{}, src, WriterOptions{}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected invalid name error, got %v", err)
+	}
+}
+
+// writerAtBuffer is an in memory io.WriterAt
+type writerAtBuffer struct {
+	b []byte
+}
+
+func (w *writerAtBuffer) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(w.b) {
+		w.b = append(w.b, make([]byte, end-len(w.b))...)
+	}
+	return copy(w.b[off:], p), nil
+}
+
+// createImage writes an image from src to a temporary file and opens it
+func createImage(t testing.TB, src fs.FS, opts WriterOptions) *Image {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "test.erofs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if err := Create(f, src, opts); err != nil {
+		t.Fatal(err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := int64(img.sb.Blocks) << img.sb.BlkSizeBits; size != st.Size() {
+		t.Errorf("image size %d does not match %d blocks", st.Size(), img.sb.Blocks)
+	}
+	return img
+}
+
+// compareImages compares the names, modes, times and content of all files
+func compareImages(t testing.TB, expected fs.FS, img *Image) {
+	t.Helper()
+	var infos []fs.FileInfo
+	var paths []string
+	err := fs.WalkDir(expected, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		paths = append(paths, p)
+		infos = append(infos, fi)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var i int
+	err = fs.WalkDir(img, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if i >= len(paths) || paths[i] != p {
+			t.Fatalf("unexpected path %s", p)
+		}
+		efi := infos[i]
+		i++
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.Mode() != efi.Mode() {
+			t.Errorf("%s: unexpected mode %v, expected %v", p, fi.Mode(), efi.Mode())
+		}
+		if !fi.ModTime().Equal(efi.ModTime()) {
+			t.Errorf("%s: unexpected mtime %v, expected %v", p, fi.ModTime(), efi.ModTime())
+		}
+
+		var eb []byte
+		switch efi.Mode().Type() {
+		case 0:
+			if efi.Size() == 0 {
+				return nil
+			}
+			if eb, err = fs.ReadFile(expected, p); err != nil {
+				return err
+			}
+		case fs.ModeSymlink:
+			// Symlinks are read as their target
+			rl, ok := expected.(readLinkFS)
+			if !ok {
+				return nil
+			}
+			target, err := rl.ReadLink(p)
+			if err != nil {
+				return err
+			}
+			eb = []byte(target)
+		default:
+			return nil
+		}
+		b, err := fs.ReadFile(img, p)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(b, eb) {
+			t.Errorf("%s: unexpected content", p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != len(paths) {
+		t.Errorf("found %d entries, expected %d", i, len(paths))
+	}
+}
+
+func TestCreateSparse(t *testing.T) {
+	src, err := Open(loadTestFile(t, "basic-chunk-4096"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blkSize := range []int{512, 4096} {
+		t.Run(strconv.Itoa(blkSize), func(t *testing.T) {
+			img := createImage(t, src, WriterOptions{BlockSize: blkSize})
+			compareImages(t, src, img)
+			if img.sb.FeatureIncompat&disk.FeatureIncompatChunkedFile == 0 {
+				t.Error("expected chunked file feature")
+			}
+			st := statOf(t, img, "/usr/lib/testdir/13k-zeros.raw")
+			if st.InodeLayout != disk.LayoutChunkBased {
+				t.Errorf("expected chunk based layout, got %d", st.InodeLayout)
+			}
+			exts, err := img.Extents("/usr/lib/testdir/13k-zeros.raw")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(exts) == 0 || exts[0].Flags&ExtentHole == 0 {
+				t.Errorf("expected hole, got %+v", exts)
+			}
+			if st := statOf(t, img, "/usr/lib/testdir/16k-sequence.raw"); st.InodeLayout == disk.LayoutChunkBased {
+				t.Error("expected file without holes to not be chunk based")
+			}
+		})
+	}
+}
+
+func TestCreateXattrPrefixes(t *testing.T) {
+	xattrs := map[string]string{
+		"user.test.long":           "1",
+		"user.test.longer.name":    "2",
+		"user.other":               "3",
+		"trusted.overlay.redirect": "/dir",
+		"security.selinux":         "system_u:object_r:usr_t:s0",
+	}
+	src := fstest.MapFS{
+		"file": {Data: []byte("data"), Mode: 0o644, Sys: &Stat{Mode: 0o644, Xattrs: xattrs}},
+		"dir":  {Mode: fs.ModeDir | 0o755, Sys: &Stat{Mode: fs.ModeDir | 0o755, Xattrs: xattrs}},
+	}
+	img := createImage(t, src, WriterOptions{XattrPrefixes: []string{"user.test.", "user.test.longer.", "trusted.overlay."}})
+	if img.sb.FeatureIncompat&disk.FeatureIncompatXattrPrefixes == 0 || img.sb.XattrPrefixCount != 3 {
+		t.Errorf("expected 3 long xattr prefixes, got %d", img.sb.XattrPrefixCount)
+	}
+	for _, p := range []string{"/file", "/dir"} {
+		if st := statOf(t, img, p); !maps.Equal(st.Xattrs, xattrs) {
+			t.Errorf("%s: unexpected xattrs %v", p, st.Xattrs)
+		}
+	}
+
+	plain := createImage(t, src, WriterOptions{})
+	long, err := fs.Stat(img, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, err := fs.Stat(plain, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, s := long.(*fileInfo).xsize, short.(*fileInfo).xsize; l >= s {
+		t.Errorf("xattrs with long prefixes take %d bytes, %d without", l, s)
+	}
+
+	for _, prefixes := range [][]string{
+		{"user."},
+		{"other.prefix."},
+		{"system.posix_acl_access.x"},
+		{"user.a.", "user.a."},
+		slices.Repeat([]string{"user.a"}, 129),
+	} {
+		if _, err := NewWriter(&writerAtBuffer{}, WriterOptions{XattrPrefixes: prefixes}); !errors.Is(err, ErrInvalid) {
+			t.Errorf("expected invalid prefixes error for %v, got %v", prefixes, err)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package erofs
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"path"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/erofs/go-erofs/internal/disk"
+)
+
+// TarOptions configures WriteTar
+type TarOptions struct {
+	// ClampMtime limits modification times to at most the given time, as
+	// done for SOURCE_DATE_EPOCH. Times are not changed when zero.
+	ClampMtime time.Time
+}
+
+// WriteTar writes the contents of the image to w as a PAX tar stream.
+// Entries are written in lexical order with paths relative to the root,
+// directory names end with a slash and the root itself is not included.
+// Xattrs are stored as SCHILY.xattr PAX records, additional links to an
+// inode are written as hardlinks and sparse files are written using the
+// GNU sparse 1.0 format. Sockets can not be represented and are skipped.
+// The output only depends on the image and options.
+func WriteTar(img *Image, w io.Writer, opts TarOptions) error {
+	tw := tar.NewWriter(w)
+	links := map[uint64]string{}
+	for e, err := range Walk(img, "/") {
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", e.Path, err)
+		}
+		if e.Path == "/" {
+			continue
+		}
+		name := e.Path[1:]
+		if err := writeTarEntry(tw, w, e.DirEntry.(*direntry), name, links, opts); err != nil {
+			return fmt.Errorf("failed to write %s: %w", e.Path, err)
+		}
+	}
+	return tw.Close()
+}
+
+func writeTarEntry(tw *tar.Writer, w io.Writer, de *direntry, name string, links map[uint64]string, opts TarOptions) error {
+	fi, err := de.Info()
+	if err != nil {
+		return err
+	}
+	st := fi.Sys().(*Stat)
+
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(unixMode(st.Mode)),
+		Uid:     int(st.UID),
+		Gid:     int(st.GID),
+		ModTime: time.Unix(int64(st.Mtime), int64(st.MtimeNs)),
+		Format:  tar.FormatPAX,
+	}
+	if !opts.ClampMtime.IsZero() && hdr.ModTime.After(opts.ClampMtime) {
+		hdr.ModTime = opts.ClampMtime
+	}
+	if len(st.Xattrs) > 0 {
+		hdr.PAXRecords = make(map[string]string, len(st.Xattrs))
+		for k, v := range st.Xattrs {
+			hdr.PAXRecords["SCHILY.xattr."+k] = v
+		}
+	}
+
+	if !fi.IsDir() && st.Nlink > 1 {
+		if first, ok := links[de.inode]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			return tw.WriteHeader(hdr)
+		}
+		links[de.inode] = name
+	}
+
+	switch mode := st.Mode; mode.Type() {
+	case fs.ModeDir:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case fs.ModeSymlink:
+		f := de.File
+		target, err := io.ReadAll(&f)
+		if err != nil {
+			return err
+		}
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = string(target)
+	case fs.ModeDevice, fs.ModeCharDevice, fs.ModeDevice | fs.ModeCharDevice:
+		hdr.Typeflag = tar.TypeBlock
+		if mode&fs.ModeCharDevice != 0 {
+			hdr.Typeflag = tar.TypeChar
+		}
+		hdr.Devmajor = int64(disk.RdevMajor(st.Rdev))
+		hdr.Devminor = int64(disk.RdevMinor(st.Rdev))
+	case fs.ModeNamedPipe:
+		hdr.Typeflag = tar.TypeFifo
+	case fs.ModeSocket:
+		return nil
+	case 0:
+		hdr.Typeflag = tar.TypeReg
+		f := de.File
+		defer f.Close()
+		return writeTarFile(tw, w, hdr, &f, st.Size)
+	default:
+		return fmt.Errorf("unsupported file type %v: %w", mode.Type(), ErrNotImplemented)
+	}
+	return tw.WriteHeader(hdr)
+}
+
+// writeTarFile writes a regular file, using the GNU sparse 1.0 format
+// when the file has holes
+func writeTarFile(tw *tar.Writer, w io.Writer, hdr *tar.Header, f *File, size int64) error {
+	data, err := dataSegments(f, size)
+	if err != nil {
+		return err
+	}
+
+	if len(data) == 1 && data[0].length == size || size == 0 {
+		hdr.Size = size
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, f)
+		return err
+	}
+
+	// The map ends with an empty entry at the end of the file when the
+	// file ends with a hole, as written by GNU tar
+	if n := len(data); n == 0 || data[n-1].offset+data[n-1].length < size {
+		data = append(data, sparseEntry{size, 0})
+	}
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(data))
+	var dataSize int64
+	for _, s := range data {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", s.offset, s.length)
+		dataSize += s.length
+	}
+	sparseMap.Write(make([]byte, (blockSize-sparseMap.Len()%blockSize)%blockSize))
+
+	// archive/tar does not write GNU.sparse records, so the PAX header is
+	// written directly before the entry header which must not need one
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     hdr.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(size, 10),
+	}
+	maps.Copy(records, hdr.PAXRecords)
+	if hdr.Uid > maxUstarID {
+		records["uid"] = strconv.Itoa(hdr.Uid)
+		hdr.Uid = 0
+	}
+	if hdr.Gid > maxUstarID {
+		records["gid"] = strconv.Itoa(hdr.Gid)
+		hdr.Gid = 0
+	}
+	if ns := hdr.ModTime.Nanosecond(); ns != 0 {
+		records["mtime"] = fmt.Sprintf("%d.%09d", hdr.ModTime.Unix(), ns)
+		hdr.ModTime = hdr.ModTime.Truncate(time.Second)
+	}
+	base := path.Base(hdr.Name)
+	if len(base) > 80 {
+		base = base[:80]
+	}
+	hdr.Name = "GNUSparseFile.0/" + base
+	hdr.PAXRecords = nil
+	hdr.Format = tar.FormatUSTAR
+	hdr.Size = int64(sparseMap.Len()) + dataSize
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if err := writePAXHeader(w, "PaxHeaders.0/"+base, records); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(sparseMap.Bytes()); err != nil {
+		return err
+	}
+	for _, s := range data {
+		if _, err := f.Seek(s.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(tw, f, s.length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	// blockSize is the size of tar blocks
+	blockSize = 512
+
+	// maxUstarID is the largest uid or gid in a ustar header
+	maxUstarID = 1<<21 - 1
+)
+
+// writePAXHeader writes a PAX extended header holding records to w
+func writePAXHeader(w io.Writer, name string, records map[string]string) error {
+	var data bytes.Buffer
+	for _, k := range slices.Sorted(maps.Keys(records)) {
+		// The record length includes the length field itself
+		rec := " " + k + "=" + records[k] + "\n"
+		size := len(rec) + len(strconv.Itoa(len(rec)))
+		if len(strconv.Itoa(size))+len(rec) != size {
+			size = len(strconv.Itoa(size)) + len(rec)
+		}
+		data.WriteString(strconv.Itoa(size) + rec)
+	}
+
+	// Encode as a regular file header, then change the type flag which
+	// archive/tar does not allow to be written directly
+	var hbuf bytes.Buffer
+	htw := tar.NewWriter(&hbuf)
+	if err := htw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0o644,
+		Size:     int64(data.Len()),
+		Format:   tar.FormatUSTAR,
+	}); err != nil {
+		return err
+	}
+	block := hbuf.Bytes()[:blockSize]
+	block[156] = tar.TypeXHeader
+	// Checksum is computed with the checksum field filled with spaces
+	copy(block[148:156], "        ")
+	var sum int64
+	for _, c := range block {
+		sum += int64(c)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	data.Write(make([]byte, (blockSize-data.Len()%blockSize)%blockSize))
+	if _, err := w.Write(block); err != nil {
+		return err
+	}
+	_, err := w.Write(data.Bytes())
+	return err
+}
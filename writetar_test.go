@@ -0,0 +1,176 @@
+package erofs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestWriteTar(t *testing.T) {
+	for _, name := range []string{
+		"default",
+		"chunk-4096",
+	} {
+		t.Run(name, func(t *testing.T) {
+			img, err := Open(loadTestFile(t, "basic-"+name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := WriteTar(img, &buf, TarOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			var again bytes.Buffer
+			if err := WriteTar(img, &again, TarOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), again.Bytes()) {
+				t.Error("expected identical output for the same image")
+			}
+
+			hdrs := map[string]*tar.Header{}
+			var names []string
+			tr := tar.NewReader(&buf)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				names = append(names, hdr.Name)
+				hdrs[hdr.Name] = hdr
+
+				if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+					continue
+				}
+				b, err := io.ReadAll(tr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f, err := img.Open("/" + hdr.Name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected, err := io.ReadAll(f)
+				f.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(b, expected) {
+					t.Errorf("unexpected content for %s", hdr.Name)
+				}
+			}
+			if len(names) != 5029 {
+				t.Errorf("unexpected number of entries: %d", len(names))
+			}
+			if names[0] != "dev/" || names[1] != "dev/block0" {
+				t.Errorf("unexpected first entries: %v", names[:2])
+			}
+
+			if hdr := hdrs["dev/char1"]; hdr == nil || hdr.Typeflag != tar.TypeChar || hdr.Devmajor != 3 || hdr.Devminor != 3 {
+				t.Errorf("unexpected char device header: %+v", hdr)
+			}
+			if hdr := hdrs["dev/block0"]; hdr == nil || hdr.Typeflag != tar.TypeBlock || hdr.Devmajor != 1 || hdr.Devminor != 1 {
+				t.Errorf("unexpected block device header: %+v", hdr)
+			}
+			if hdr := hdrs["dev/fifo0"]; hdr == nil || hdr.Typeflag != tar.TypeFifo {
+				t.Errorf("unexpected fifo header: %+v", hdr)
+			}
+			hdr := hdrs["usr/lib/withxattr/f1"]
+			if hdr == nil || hdr.PAXRecords["SCHILY.xattr.user.xdg.comment"] != "comment for f1" {
+				t.Errorf("missing xattrs: %+v", hdr)
+			}
+			hdr = hdrs["usr/lib/testdir/"]
+			if hdr == nil || hdr.Typeflag != tar.TypeDir || hdr.Uid != 1000 || hdr.Mode != 0o755 {
+				t.Errorf("unexpected directory header: %+v", hdr)
+			}
+			if hdr := hdrs["usr/lib/testdir/13k-zeros.raw"]; hdr == nil || hdr.Size != 13*1024 {
+				t.Errorf("unexpected sparse file header: %+v", hdr)
+			}
+		})
+	}
+}
+
+func TestWriteTarSparse(t *testing.T) {
+	img, err := Open(loadTestFile(t, "basic-chunk-4096"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteTar(img, &buf, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// The hole is not written to the tar
+	var full bytes.Buffer
+	img, err = Open(loadTestFile(t, "basic-default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTar(img, &full, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() >= full.Len() {
+		t.Errorf("expected sparse output to be smaller, got %d and %d bytes", buf.Len(), full.Len())
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("GNU.sparse.name=usr/lib/testdir/13k-zeros.raw")) {
+		t.Error("expected GNU sparse records")
+	}
+}
+
+func TestWriteTarClamp(t *testing.T) {
+	img, err := Open(loadTestFile(t, "basic-default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clamp := time.Unix(1000, 0)
+	var buf bytes.Buffer
+	if err := WriteTar(img, &buf, TarOptions{ClampMtime: clamp}); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if !hdr.ModTime.Equal(clamp) {
+			t.Fatalf("unexpected mtime for %s: %v", hdr.Name, hdr.ModTime)
+		}
+	}
+}
+
+func TestWriteTarHardlinks(t *testing.T) {
+	img := hardlinkImage(t)
+	var buf bytes.Buffer
+	if err := WriteTar(img, &buf, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	hdrs := map[string]*tar.Header{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		hdrs[hdr.Name] = hdr
+	}
+	if hdr := hdrs["a/file"]; hdr == nil || hdr.Typeflag != tar.TypeReg || hdr.Size != 7 {
+		t.Errorf("unexpected header for first path: %+v", hdr)
+	}
+	if hdr := hdrs["b/link"]; hdr == nil || hdr.Typeflag != tar.TypeLink || hdr.Linkname != "a/file" || hdr.Size != 0 {
+		t.Errorf("unexpected hardlink header: %+v", hdr)
+	}
+	for _, name := range []string{"a/", "a/dir/", "b/"} {
+		if hdr := hdrs[name]; hdr == nil || hdr.Typeflag != tar.TypeDir {
+			t.Errorf("unexpected directory header for %s: %+v", name, hdr)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package erofs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// WriteTo writes the remaining file data to w, implementing io.WriterTo so
+// io.Copy does not need an intermediate buffer. Data stored uncompressed in
+// contiguous extents is written directly from the memory mapped image when
+// opened with OpenFile. When the image is read from an *os.File on Linux, it
+// is copied in the kernel with copy_file_range when w is an *os.File, which
+// allows reflinks on file systems such as XFS and btrfs, or with sendfile
+// when w is a file or socket. Otherwise the data is copied through a buffer.
+func (b *File) WriteTo(w io.Writer) (int64, error) {
+	if b.img.closed.Load() {
+		return 0, &fs.PathError{Op: "read", Path: b.name, Err: fs.ErrClosed}
+	}
+	fi, err := b.readInfo(false)
+	if err != nil {
+		return 0, err
+	}
+	if obj, err := b.openObject(); err != nil {
+		return 0, err
+	} else if obj != nil {
+		return b.writeObject(w, obj, fi)
+	}
+
+	var written int64
+	for b.offset < fi.size {
+		ext, err := b.img.mapCached(fi, b.offset, &b.ext)
+		if err != nil {
+			return written, err
+		}
+		l := ext.logical + ext.length - b.offset
+		addr := ext.physical + b.offset - ext.logical
+
+		var n int64
+		switch {
+		case ext.physical == -1:
+			n, err = io.CopyN(w, zeroReader{}, l)
+		case ext.device != 0:
+			var handled bool
+			dev := b.img.devices[ext.device-1].r
+			if dev == nil {
+				return written, fmt.Errorf("extra device %d not provided", ext.device)
+			}
+			n, handled, err = copyRange(w, dev, addr, l)
+			if !handled {
+				n, err = io.CopyN(w, io.NewSectionReader(dev, addr, l), l)
+			}
+		case b.img.mapped != nil:
+			if addr+l > int64(len(b.img.mapped.data)) {
+				return written, fmt.Errorf("data for nid %d beyond end of image: %w", fi.inode, ErrInvalid)
+			}
+			var wn int
+			wn, err = b.img.mapped.writeTo(w, addr, l)
+			n = int64(wn)
+		default:
+			var handled bool
+			n, handled, err = copyRange(w, b.img.meta, addr, l)
+			if !handled {
+				n, err = io.CopyN(w, io.NewSectionReader(readerAtFunc(b.img.readData), addr, l), l)
+			}
+		}
+		written += n
+		b.offset += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+type readerAtFunc func([]byte, int64) (int, error)
+
+func (f readerAtFunc) ReadAt(p []byte, off int64) (int, error) {
+	return f(p, off)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,136 @@
+package erofs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	content := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 128*16)
+	const name = "/usr/lib/testdir/16k-sequence.raw"
+
+	open := func(t *testing.T, img string, mapped bool) io.Reader {
+		t.Helper()
+		var (
+			efs *Image
+			err error
+		)
+		if mapped {
+			efs, err = OpenFile("testdata/basic-" + img + ".erofs")
+		} else {
+			efs, err = Open(loadTestFile(t, "basic-"+img))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { efs.Close() })
+		f, err := efs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		if _, ok := f.(io.WriterTo); !ok {
+			t.Fatalf("expected io.WriterTo, got %T", f)
+		}
+		return f
+	}
+
+	for _, img := range []string{"default", "chunk-4096", "chunk-8192"} {
+		for _, mapped := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/mapped=%t", img, mapped), func(t *testing.T) {
+				// Copy to host file
+				out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer out.Close()
+				// Write a prefix to ensure the destination offset is respected
+				out.WriteString("prefix")
+				f := open(t, img, mapped)
+				n, err := f.(io.WriterTo).WriteTo(out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != int64(len(content)) {
+					t.Fatalf("unexpected written size %d", n)
+				}
+				b, err := os.ReadFile(out.Name())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(b, append([]byte("prefix"), content...)) {
+					t.Fatal("unexpected content copied to file")
+				}
+
+				// Copy to socket
+				fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+				if err != nil {
+					t.Skip(err)
+				}
+				w := os.NewFile(uintptr(fds[0]), "w")
+				r := os.NewFile(uintptr(fds[1]), "r")
+				defer r.Close()
+				// Open before the goroutine, t.Fatal must not be called from it
+				src := open(t, img, mapped)
+				errC := make(chan error, 1)
+				go func() {
+					_, err := io.Copy(w, src)
+					w.Close()
+					errC <- err
+				}()
+				b, err = io.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := <-errC; err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(b, content) {
+					t.Fatal("unexpected content copied to socket")
+				}
+
+				// Buffered fallback
+				var buf bytes.Buffer
+				if _, err := open(t, img, mapped).(io.WriterTo).WriteTo(&buf); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(buf.Bytes(), content) {
+					t.Fatal("unexpected content copied to buffer")
+				}
+			})
+		}
+	}
+}
+
+func TestCopyRangeFallback(t *testing.T) {
+	dir := t.TempDir()
+	src, err := os.Create(filepath.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if _, err := src.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := os.Create(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	// Nothing is copied from beyond the end of the file, the caller must
+	// fall back instead of failing
+	n, handled, err := copyRange(dst, src, 16, 4)
+	if err != nil || handled || n != 0 {
+		t.Fatalf("expected fallback, got %d, %v, %v", n, handled, err)
+	}
+	n, handled, err = copyRange(dst, src, 0, 4)
+	if err != nil || !handled || n != 4 {
+		t.Fatalf("expected copy, got %d, %v, %v", n, handled, err)
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"maps"
+	"math"
+	"slices"
 	"strings"
 
 	"github.com/erofs/go-erofs/internal/disk"
@@ -25,9 +28,9 @@ func (idx xattrIndex) String() string {
 	case 1:
 		return "user."
 	case 2:
-		return "system.posix_acl_access."
+		return "system.posix_acl_access"
 	case 3:
-		return "system.posix_acl_default."
+		return "system.posix_acl_default"
 	case 4:
 		return "trusted."
 	case 5:
@@ -39,7 +42,142 @@ func (idx xattrIndex) String() string {
 	}
 }
 
-func setXattrs(b *file, addr int64, blk *block) (err error) {
+// xattrPrefix returns the index of the short prefix of name and the
+// remaining name. The POSIX ACL indexes are only used for the complete
+// ACL names, index 0 is returned with the full name when no prefix matches.
+func xattrPrefix(name string) (xattrIndex, string) {
+	for _, idx := range []xattrIndex{1, 2, 3, 4, 6} {
+		prefix := idx.String()
+		if name == prefix || strings.HasSuffix(prefix, ".") && strings.HasPrefix(name, prefix) {
+			return idx, name[len(prefix):]
+		}
+	}
+	return 0, name
+}
+
+// longXattrPrefix returns the name index for the longest of the long
+// prefixes name starts with and the remaining name, ok is false when no
+// long prefix matches
+func longXattrPrefix(name string, prefixes []string) (idx uint8, suffix string, ok bool) {
+	for i, p := range prefixes {
+		if len(name) > len(p) && strings.HasPrefix(name, p) && (!ok || len(p) > len(name)-len(suffix)) {
+			idx, suffix, ok = disk.XattrLongPrefixBit|uint8(i), name[len(p):], true
+		}
+	}
+	return idx, suffix, ok
+}
+
+// encodeXattrPrefixes encodes the long xattr prefix table, each prefix is
+// aligned to 4 bytes
+func encodeXattrPrefixes(prefixes []string) []byte {
+	var b []byte
+	for _, p := range prefixes {
+		idx, infix := xattrPrefix(p)
+		b = binary.LittleEndian.AppendUint16(b, uint16(1+len(infix)))
+		b = append(b, uint8(idx))
+		b = append(b, infix...)
+		b = append(b, make([]byte, -len(b)&3)...)
+	}
+	return b
+}
+
+// encodeXattrs encodes the inline xattr body for an inode, sorted by name.
+// Names starting with one of the long prefixes reference the prefix. No
+// body is returned when there are no xattrs.
+func encodeXattrs(xattrs map[string]string, prefixes []string) ([]byte, error) {
+	if len(xattrs) == 0 {
+		return nil, nil
+	}
+	b := make([]byte, disk.SizeXattrBodyHeader)
+	for _, name := range slices.Sorted(maps.Keys(xattrs)) {
+		idx, suffix, ok := longXattrPrefix(name, prefixes)
+		if !ok {
+			short, rest := xattrPrefix(name)
+			idx, suffix = uint8(short), rest
+		}
+		value := xattrs[name]
+		if len(suffix) > math.MaxUint8 || len(value) > math.MaxUint16 {
+			return nil, fmt.Errorf("xattr %s too long: %w", name, ErrInvalid)
+		}
+		b, _ = binary.Append(b, binary.LittleEndian, &disk.XattrEntry{
+			NameLen:   uint8(len(suffix)),
+			NameIndex: idx,
+			ValueLen:  uint16(len(value)),
+		})
+		b = append(b, suffix...)
+		b = append(b, value...)
+		b = append(b, make([]byte, -len(b)&3)...)
+	}
+	if (len(b)-disk.SizeXattrBodyHeader)/disk.SizeXattrEntry+1 > math.MaxUint16 {
+		return nil, fmt.Errorf("xattrs too large: %w", ErrInvalid)
+	}
+	return b, nil
+}
+
+// xattrNamePrefix returns the prefix of xattr names for the name index of
+// an xattr entry, which is either a short prefix or a long prefix
+func (img *Image) xattrNamePrefix(idx uint8) (string, error) {
+	if idx&disk.XattrLongPrefixBit == 0 {
+		return xattrIndex(idx).String(), nil
+	}
+	i := int(idx & disk.XattrLongPrefixMask)
+	if i >= len(img.xattrPrefixes) {
+		return "", fmt.Errorf("long xattr prefix %d not in prefix table: %w", i, ErrInvalid)
+	}
+	return img.xattrPrefixes[i], nil
+}
+
+// loadXattrPrefixes reads the long xattr name prefix table, which is stored
+// in the packed inode when the image has one and otherwise in the primary
+// device. Each prefix is a length, the index of the short prefix and the
+// infix following the short prefix, aligned to 4 bytes.
+func (img *Image) loadXattrPrefixes() error {
+	if img.sb.FeatureIncompat&disk.FeatureIncompatXattrPrefixes == 0 || img.sb.XattrPrefixCount == 0 {
+		return nil
+	}
+	r := img.meta
+	if img.sb.PackedNid != 0 {
+		f := &File{img: img, inode: img.sb.PackedNid}
+		fi, err := f.readInfo(false)
+		if err != nil {
+			return fmt.Errorf("failed to read packed inode: %w", err)
+		}
+		r = readerAtFunc(func(p []byte, off int64) (int, error) {
+			return img.readAt(fi, p, off, nil)
+		})
+	}
+	readFull := func(b []byte, off int64) error {
+		n, err := r.ReadAt(b, off)
+		if n == len(b) {
+			return nil
+		} else if err == nil || err == io.EOF {
+			err = ErrInvalid
+		}
+		return fmt.Errorf("failed to read long xattr prefixes: %w", err)
+	}
+
+	pos := int64(img.sb.XattrPrefixStart) * 4
+	prefixes := make([]string, img.sb.XattrPrefixCount)
+	for i := range prefixes {
+		var l [2]byte
+		if err := readFull(l[:], pos); err != nil {
+			return err
+		}
+		b := make([]byte, binary.LittleEndian.Uint16(l[:]))
+		if err := readFull(b, pos+2); err != nil {
+			return err
+		}
+		if len(b) == 0 || xattrIndex(b[0]).String() == "" {
+			return fmt.Errorf("invalid long xattr prefix %d: %w", i, ErrInvalid)
+		}
+		prefixes[i] = xattrIndex(b[0]).String() + string(b[1:])
+		pos = alignUp(pos+2+int64(len(b)), 4)
+	}
+	img.xattrPrefixes = prefixes
+	return nil
+}
+
+func setXattrs(b *File, addr int64, blk *block) (err error) {
 	b.info.stat.Xattrs = map[string]string{}
 	blkSize := int32(1 << b.img.sb.BlkSizeBits)
 
@@ -86,13 +224,9 @@ func setXattrs(b *file, addr int64, blk *block) (err error) {
 			return err
 		}
 		sb = sb[disk.SizeXattrEntry:]
-		var prefix string
-		if xattrEntry.NameIndex&0x80 == 0x80 {
-			//nameIndex := xattrEntry.NameIndex & 0x7F
-			// TODO: Get long prefix
-			return fmt.Errorf("shared xattr with long prefix not implemented for nid %d", b.inode)
-		} else if xattrEntry.NameIndex != 0 {
-			prefix = xattrIndex(xattrEntry.NameIndex).String()
+		prefix, err := b.img.xattrNamePrefix(xattrEntry.NameIndex)
+		if err != nil {
+			return fmt.Errorf("shared xattr for nid %d: %w", b.inode, err)
 		}
 
 		if len(sb) < int(xattrEntry.NameLen)+int(xattrEntry.ValueLen) {
@@ -128,13 +262,9 @@ func setXattrs(b *file, addr int64, blk *block) (err error) {
 		}
 		pos += disk.SizeXattrEntry
 		xb = xb[disk.SizeXattrEntry:]
-		var prefix string
-		if xattrEntry.NameIndex&0x80 == 0x80 {
-			//nameIndex := xattrEntry.NameIndex & 0x7F
-			// TODO: Get long prefix
-			return fmt.Errorf("shared xattr with long prefix not implemented for nid %d", b.inode)
-		} else if xattrEntry.NameIndex != 0 {
-			prefix = xattrIndex(xattrEntry.NameIndex).String()
+		prefix, err := b.img.xattrNamePrefix(xattrEntry.NameIndex)
+		if err != nil {
+			return fmt.Errorf("xattr for nid %d: %w", b.inode, err)
 		}
 
 		if len(xb) < int(xattrEntry.NameLen) {
@@ -190,5 +320,8 @@ func setXattrs(b *file, addr int64, blk *block) (err error) {
 			}
 		}
 	}
+	if b.img.objects != nil {
+		unescapeOverlayXattrs(b.info)
+	}
 	return nil
 }